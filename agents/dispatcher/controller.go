@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/lease"
+	"github.com/Azure/adx-automation-agent/sdk/logging"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/schedule"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/Azure/adx-automation-agent/sdk/store"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+)
+
+// pendingStatuses are the statuses of the runs the controller drives. Published and running runs are resumed when no
+// dispatcher holds their lease, e.g. after the controller restarted.
+var pendingStatuses = []string{common.RunStatusInitialized, common.RunStatusPublished, common.RunStatusRunning}
+
+// product is a product whose runs the controller drives
+type product struct {
+	metadata *models.DroidMetadata
+
+	// getIndex is the path of the product's get_index script
+	getIndex string
+
+	// limit is the number of the product's runs driven at the same time
+	limit int
+}
+
+// runLister lists the runs in the store. It is implemented by store.Client.
+type runLister interface {
+	ListRuns(ctx context.Context, opts store.RunListOptions) ([]models.Run, error)
+}
+
+// controller drives the pending runs of many products at the same time. It polls the store for pending runs and
+// drives each of them in a worker. The number of workers is bounded, as is the number of runs of each product.
+type controller struct {
+	runs     runLister
+	products map[string]*product
+
+	// workers is the number of runs driven at the same time
+	workers int
+
+	// interval is the time between two polls of the store
+	interval time.Duration
+
+	// backoff is the time a run which failed is left alone before it is driven again
+	backoff time.Duration
+
+	// drive drives the run till it is completed
+	drive func(ctx context.Context, run *models.Run, p *product) error
+
+	lock    sync.Mutex
+	active  map[int]string
+	running map[string]int
+	failed  map[int]time.Time
+	wg      sync.WaitGroup
+}
+
+func newController(runs runLister, products map[string]*product, workers int) *controller {
+	return &controller{
+		runs:     runs,
+		products: products,
+		workers:  workers,
+		interval: 30 * time.Second,
+		backoff:  5 * time.Minute,
+		active:   make(map[int]string),
+		running:  make(map[string]int),
+		failed:   make(map[int]time.Time),
+	}
+}
+
+// run polls the store till the context is done, then waits for the workers to stop
+func (c *controller) run(ctx context.Context) {
+	logrus.Infof("Drive the runs of %d product(s) with %d workers.", len(c.products), c.workers)
+	for {
+		c.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			logrus.Info("Wait for the workers to stop ...")
+			c.wg.Wait()
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// poll lists the pending runs and starts driving as many of them as the limits allow. The runs are listed by status
+// only, because the runs created by the CLI or the API have no product detail till they are published, and each run
+// is attributed to its product by Run.GetProduct. The products take turns, the oldest run of each product first, so a
+// product with many pending runs doesn't hold up the others.
+func (c *controller) poll(ctx context.Context) {
+	names := make([]string, 0, len(c.products))
+	for name := range c.products {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pending := make(map[string][]models.Run)
+	for _, status := range pendingStatuses {
+		runs, err := c.runs.ListRuns(ctx, store.RunListOptions{Status: status})
+		if err != nil {
+			logrus.Warnf("Fail to list the %s runs: %s", status, err)
+			continue
+		}
+
+		for _, run := range runs {
+			name := run.GetProduct()
+			if _, ok := c.products[name]; !ok {
+				logrus.WithField(logging.FieldRunID, run.ID).Debugf("Skip the run of product %q which isn't driven.", name)
+				continue
+			}
+			pending[name] = append(pending[name], run)
+		}
+	}
+	for _, name := range names {
+		sort.Slice(pending[name], func(i, j int) bool { return pending[name][i].ID < pending[name][j].ID })
+	}
+
+	for started := true; started; {
+		started = false
+		for _, name := range names {
+			for len(pending[name]) > 0 {
+				run := pending[name][0]
+				pending[name] = pending[name][1:]
+				if c.start(ctx, &run, name) {
+					started = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// start drives the run in a new worker if the limits allow. It returns false if the run isn't started.
+func (c *controller) start(ctx context.Context, run *models.Run, name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p := c.products[name]
+	if _, ok := c.active[run.ID]; ok {
+		return false
+	} else if failedAt, ok := c.failed[run.ID]; ok && time.Since(failedAt) < c.backoff {
+		return false
+	} else if len(c.active) >= c.workers || c.running[name] >= p.limit {
+		return false
+	}
+
+	c.active[run.ID] = name
+	c.running[name]++
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		err := c.safeDrive(ctx, run, p)
+		if err != nil {
+			logrus.WithField(logging.FieldRunID, run.ID).Errorf("Fail to drive the run: %s", err)
+		}
+		c.finish(run.ID, name, err)
+	}()
+
+	return true
+}
+
+// safeDrive drives the run and turns a panic into an error, so one run doesn't stop the others
+func (c *controller) safeDrive(ctx context.Context, run *models.Run, p *product) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return c.drive(ctx, run, p)
+}
+
+func (c *controller) finish(runID int, name string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.active, runID)
+	c.running[name]--
+	if err != nil {
+		c.failed[runID] = time.Now()
+	} else {
+		delete(c.failed, runID)
+	}
+}
+
+// runDriver drives a single run in the controller. Each run has its own lease, task broker connection and dispatcher.
+type runDriver struct {
+	client    kubernetes.Interface
+	namespace string
+	storage   *storage.Config
+	store     *store.Client
+	identity  string
+
+	storeSecret *droidjob.StoreSecret
+}
+
+// drive drives the run if no other dispatcher holds its lease
+func (r *runDriver) drive(ctx context.Context, run *models.Run, p *product) error {
+	log := logrus.WithField(logging.FieldRunID, run.ID)
+	ctx = metrics.WithRun(ctx, p.metadata.Product, strconv.Itoa(run.ID))
+
+	runLease := lease.New(r.client, r.namespace, getLeaseName(run.ID), r.identity)
+	acquired, err := runLease.TryAcquire(ctx)
+	if err != nil {
+		return err
+	} else if !acquired {
+		log.Info("Another dispatcher drives the run.")
+		return nil
+	}
+
+	held, cancel := context.WithCancel(ctx)
+	defer runLease.Release(context.Background())
+	defer cancel()
+	held = runLease.Hold(held)
+
+	// the run may have moved on since it was listed
+	if run, err = r.store.GetRun(held, run.ID); err != nil {
+		return fmt.Errorf("fail to query the run: %s", err.Error())
+	} else if run.Status == common.RunStatusCompleted || run.Status == common.RunStatusCanceled {
+		return nil
+	}
+
+	broker := schedule.CreateInClusterTaskBroker()
+	completed := false
+	defer func() {
+		// the queue of a run which isn't completed is kept, so the run is resumed later
+		if !completed {
+			broker.Disconnect()
+		}
+	}()
+
+	d := &dispatcher{
+		client:    r.client,
+		namespace: r.namespace,
+		metadata:  p.metadata,
+		storage:   r.storage,
+		queue:     broker,
+
+		storeSecret: r.storeSecret,
+		update: func(ctx context.Context, run *models.Run, changes func(*models.Run) error) (*models.Run, error) {
+			return models.UpdateRun(ctx, r.store, run, changes)
+		},
+		queryTests: func(run *models.Run) []models.TaskSetting {
+			return run.QueryTestsFrom(p.getIndex)
+		},
+		tasks: r.store,
+	}
+
+	log.Infof("Drive the %s run.", p.metadata.Product)
+	if run, err = d.drive(held, run); err != nil {
+		if runLease.Lost() {
+			log.Warn("Another dispatcher took over the run.")
+			return nil
+		}
+		return err
+	}
+
+	completed = true
+	broker.Close()
+	log.Infof("The run is %s.", strings.ToLower(run.Status))
+	return nil
+}
+
+// limitFlag is a list of product=limit pairs
+type limitFlag map[string]int
+
+func (f limitFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, limit := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, limit))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f limitFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expect product=limit but found %s", value)
+	}
+
+	limit, err := strconv.Atoi(parts[1])
+	if err != nil || limit < 1 {
+		return fmt.Errorf("invalid limit of product %s: %s", parts[0], parts[1])
+	}
+
+	f[parts[0]] = limit
+	return nil
+}
+
+// loadProducts loads the products in the given directory. Each product is a subdirectory holding its metadata.yml and
+// get_index script. The product of the image is loaded if the directory is empty.
+func loadProducts(dir string, defaultLimit int, limits limitFlag) (map[string]*product, error) {
+	var paths [][2]string
+	if len(dir) == 0 {
+		paths = append(paths, [2]string{common.PathMetadataYml, common.PathScriptGetIndex})
+	} else {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read the products: %s", err.Error())
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				productDir := filepath.Join(dir, entry.Name())
+				paths = append(paths, [2]string{filepath.Join(productDir, "metadata.yml"), filepath.Join(productDir, "get_index")})
+			}
+		}
+	}
+
+	products := make(map[string]*product)
+	for _, path := range paths {
+		metadata, err := models.ReadDroidMetadata(path[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := products[metadata.Product]; ok {
+			return nil, fmt.Errorf("product %s is defined twice", metadata.Product)
+		}
+
+		limit, ok := limits[metadata.Product]
+		if !ok {
+			limit = defaultLimit
+		}
+		products[metadata.Product] = &product{metadata: metadata, getIndex: path[1], limit: limit}
+	}
+
+	if len(products) == 0 {
+		return nil, fmt.Errorf("no product is found in %s", dir)
+	}
+
+	return products, nil
+}
+
+// controllerCommand drives the pending runs of the products till the dispatcher is asked to shut down. It replaces
+// the dispatcher launched for each run.
+//
+//	a01dispatcher controller [--products <dir>] [--workers <n>] [--limit <n>] [--product-limit <product>=<n>]...
+func controllerCommand(args []string) {
+	limits := make(limitFlag)
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	productsDir := flags.String("products", "", "The directory of the products, each in a subdirectory holding its metadata.yml and get_index. It defaults to the product of the image.")
+	workers := flags.Int("workers", 8, "The number of runs driven at the same time")
+	defaultLimit := flags.Int("limit", 2, "The number of runs of a product driven at the same time")
+	interval := flags.Duration("interval", 30*time.Second, "The time between two polls of the store")
+	flags.Var(limits, "product-limit", "The number of runs of the given product driven at the same time, as product=limit. It may be repeated.")
+	flags.Parse(args)
+
+	logging.Setup(logrus.Fields{logging.FieldPodName: getIdentity()})
+	logrus.WithFields(logrus.Fields{"version": version, "commit": sourceCommit}).Info("A01 Droid Dispatcher Controller.")
+
+	if *workers < 1 || *defaultLimit < 1 {
+		logrus.Fatal("The workers and the limit must be positive")
+	}
+
+	products, err := loadProducts(*productsDir, *defaultLimit, limits)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	clientset, err := kubeutils.CreateKubeClientset()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	ctx, cancel := common.NewSignalContext()
+	defer cancel()
+
+	storageConfig, err := storage.LoadConfig(ctx)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	metrics.Serve(fmt.Sprintf(":%d", common.PortMetrics))
+
+	storeClient := store.NewClientFromEnv()
+	driver := &runDriver{
+		client:    clientset,
+		namespace: common.GetCurrentNamespace("a01-prod"),
+		storage:   storageConfig,
+		store:     storeClient,
+		identity:  getIdentity(),
+
+		storeSecret: droidjob.LoadStoreSecret(ctx),
+	}
+
+	c := newController(storeClient, products, *workers)
+	c.interval = *interval
+	c.drive = driver.drive
+	c.run(ctx)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/store"
+)
+
+// fakeRuns lists the runs of each product and status. The runs of a product are created as the CLI does, with the
+// product's image and no product detail.
+type fakeRuns map[string]map[string][]int
+
+func (runs fakeRuns) ListRuns(ctx context.Context, opts store.RunListOptions) ([]models.Run, error) {
+	if len(opts.Product) > 0 {
+		return nil, errors.New("the product filter matches the runs with a product detail only")
+	}
+
+	var result []models.Run
+	for name, byStatus := range runs {
+		for _, id := range byStatus[opts.Status] {
+			result = append(result, models.Run{
+				ID:       id,
+				Settings: map[string]interface{}{common.KeyImageName: "azureclidev.azurecr.io/" + name + ":latest"},
+				Status:   opts.Status,
+			})
+		}
+	}
+	return result, nil
+}
+
+// blockingDriver records the runs being driven. The runs are driven till they are released.
+type blockingDriver struct {
+	lock     sync.Mutex
+	driving  map[int]string
+	released chan struct{}
+	err      error
+}
+
+func newBlockingDriver() *blockingDriver {
+	return &blockingDriver{driving: make(map[int]string), released: make(chan struct{})}
+}
+
+func (driver *blockingDriver) drive(ctx context.Context, run *models.Run, p *product) error {
+	driver.lock.Lock()
+	driver.driving[run.ID] = p.metadata.Product
+	driver.lock.Unlock()
+
+	<-driver.released
+	return driver.err
+}
+
+// waitDriving waits till the given number of runs are being driven and returns them by product
+func (driver *blockingDriver) waitDriving(t *testing.T, count int) map[string][]int {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		driver.lock.Lock()
+		if len(driver.driving) == count {
+			byProduct := make(map[string][]int)
+			for id, name := range driver.driving {
+				byProduct[name] = append(byProduct[name], id)
+			}
+			driver.lock.Unlock()
+			return byProduct
+		}
+		driver.lock.Unlock()
+	}
+
+	t.Fatalf("expect %d runs being driven but found %d", count, len(driver.driving))
+	return nil
+}
+
+func newTestProducts(limits map[string]int) map[string]*product {
+	products := make(map[string]*product)
+	for name, limit := range limits {
+		products[name] = &product{metadata: &models.DroidMetadata{Product: name}, limit: limit}
+	}
+	return products
+}
+
+func TestControllerLimits(t *testing.T) {
+	runs := fakeRuns{
+		"azurecli": {
+			common.RunStatusInitialized: {5, 1, 3, 4},
+			common.RunStatusRunning:     {2},
+		},
+		"azurepowershell": {
+			common.RunStatusInitialized: {10, 11},
+		},
+		"azurecore": {
+			common.RunStatusInitialized: {0},
+		},
+	}
+	driver := newBlockingDriver()
+	c := newController(runs, newTestProducts(map[string]int{"azurecli": 2, "azurepowershell": 2}), 3)
+	c.drive = driver.drive
+
+	c.poll(context.Background())
+	byProduct := driver.waitDriving(t, 3)
+
+	// the products take turns, the oldest run first, till the workers are busy
+	if cli := byProduct["azurecli"]; len(cli) != 2 || cli[0]+cli[1] != 3 {
+		t.Errorf("expect azurecli runs 1 and 2 but found %v", cli)
+	}
+	if ps := byProduct["azurepowershell"]; len(ps) != 1 || ps[0] != 10 {
+		t.Errorf("expect azurepowershell run 10 but found %v", ps)
+	}
+
+	// the runs being driven aren't started again
+	c.poll(context.Background())
+	driver.waitDriving(t, 3)
+
+	close(driver.released)
+	c.wg.Wait()
+	if len(c.active) != 0 || c.running["azurecli"] != 0 || c.running["azurepowershell"] != 0 {
+		t.Errorf("expect no run being driven but found %v", c.active)
+	}
+}
+
+func TestControllerBackoff(t *testing.T) {
+	runs := fakeRuns{"azurecli": {common.RunStatusPublished: {1}}}
+	driver := newBlockingDriver()
+	driver.err = errors.New("the task broker is unavailable")
+	close(driver.released)
+
+	c := newController(runs, newTestProducts(map[string]int{"azurecli": 1}), 1)
+	c.drive = driver.drive
+
+	c.poll(context.Background())
+	c.wg.Wait()
+	if _, ok := c.failed[1]; !ok {
+		t.Fatal("expect the run to be recorded as failed")
+	}
+
+	delete(driver.driving, 1)
+	c.poll(context.Background())
+	c.wg.Wait()
+	if len(driver.driving) != 0 {
+		t.Error("expect a failed run to be left alone during the backoff")
+	}
+
+	c.backoff = 0
+	driver.err = nil
+	c.poll(context.Background())
+	c.wg.Wait()
+	if len(driver.driving) != 1 {
+		t.Error("expect a failed run to be driven again after the backoff")
+	}
+	if _, ok := c.failed[1]; ok {
+		t.Error("expect the failure to be forgotten once the run is driven")
+	}
+}
+
+func TestControllerPanic(t *testing.T) {
+	runs := fakeRuns{"azurecli": {common.RunStatusInitialized: {1}}}
+	c := newController(runs, newTestProducts(map[string]int{"azurecli": 1}), 1)
+	c.drive = func(ctx context.Context, run *models.Run, p *product) error {
+		panic("fail to execute get_index")
+	}
+
+	c.poll(context.Background())
+	c.wg.Wait()
+	if _, ok := c.failed[1]; !ok || c.running["azurecli"] != 0 {
+		t.Error("expect the panic to fail the run only")
+	}
+}
+
+func TestLoadProducts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"azurecli", "azurepowershell"} {
+		productDir := filepath.Join(dir, name)
+		if err := os.Mkdir(productDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		metadata := "kind: DroidMetadata\nversion: v3\nproduct: " + name + "\n"
+		if err := ioutil.WriteFile(filepath.Join(productDir, "metadata.yml"), []byte(metadata), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	products, err := loadProducts(dir, 2, limitFlag{"azurecli": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products["azurecli"].limit != 4 || products["azurepowershell"].limit != 2 {
+		t.Errorf("unexpected products %+v", products)
+	}
+	if getIndex := products["azurecli"].getIndex; getIndex != filepath.Join(dir, "azurecli", "get_index") {
+		t.Errorf("unexpected get_index %s", getIndex)
+	}
+}
+
+func TestLimitFlag(t *testing.T) {
+	limits := make(limitFlag)
+	if err := limits.Set("azurecli=4"); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"azurecli", "azurecli=0", "azurecli=many"} {
+		if err := limits.Set(value); err == nil {
+			t.Errorf("expect %s to be refused", value)
+		}
+	}
+	if limits.String() != "azurecli=4" {
+		t.Errorf("unexpected limits %s", limits)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The markers separating the metadata and the index in the log of an inspector pod
+const (
+	markerMetadata = "--- a01 metadata ---"
+	markerIndex    = "--- a01 index ---"
+)
+
+// inspectScript prints the image's metadata and index. The index is printed last, and get_index's stderr is
+// dropped, so the index is the rest of the log.
+var inspectScript = fmt.Sprintf("echo '%s' && cat %s && echo '%s' && %s 2>/dev/null",
+	markerMetadata, common.PathMetadataYml, markerIndex, common.PathScriptGetIndex)
+
+// inspectInterval is the time between two checks of an inspector pod
+var inspectInterval = 2 * time.Second
+
+// getInspectorName returns the name of the pod inspecting an image of the run
+func getInspectorName(jobName string, image string) string {
+	return models.GetImageJobName(jobName, image) + "-index"
+}
+
+// inspectImagePod reads the metadata and the tasks of an image of the run. A pod running in the image prints its
+// metadata.yml and the output of its get_index, and is deleted once its log is read or it failed. The pod of a
+// previous dispatcher is used as is.
+func (d *dispatcher) inspectImagePod(ctx context.Context, run *models.Run, image models.RunImage) (*models.DroidMetadata, []models.TaskSetting, error) {
+	name := getInspectorName(run.Details[common.KeyJobName], image.Name)
+	pods := d.client.CoreV1().Pods(d.namespace)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"run_id": strconv.Itoa(run.ID), "component": "inspector"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "inspector",
+					Image:   image.Image,
+					Command: []string{"/bin/sh", "-c", inspectScript},
+				},
+			},
+			RestartPolicy: corev1.RestartPolicyNever,
+		},
+	}
+	if secret, _ := run.ForImage(image).Settings[common.KeyImagePullSecret].(string); len(secret) > 0 {
+		pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: secret}}
+	}
+	if d.owner != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*d.owner}
+	}
+
+	if _, err := pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, nil, fmt.Errorf("fail to create pod %s: %s", name, err.Error())
+	}
+	logrus.Infof("Inspect image %s in pod %s.", image.Image, name)
+
+	for {
+		pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to get pod %s: %s", name, err.Error())
+		}
+		if pod.Status.Phase == corev1.PodFailed {
+			// the image is inspected again by the next attempt
+			d.deleteInspector(ctx, name)
+			return nil, nil, fmt.Errorf("pod %s failed to inspect image %s: %s", name, image.Image, pod.Status.Message)
+		} else if pod.Status.Phase == corev1.PodSucceeded {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(inspectInterval):
+		}
+	}
+
+	logs, err := pods.GetLogs(name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to read the log of pod %s: %s", name, err.Error())
+	}
+
+	metadata, tasks, err := parseInspection(image.Image, logs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d.deleteInspector(ctx, name)
+	return metadata, tasks, nil
+}
+
+// deleteInspector deletes the inspector pod of the given name
+func (d *dispatcher) deleteInspector(ctx context.Context, name string) {
+	err := d.client.CoreV1().Pods(d.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		logrus.Warnf("Fail to delete pod %s: %s", name, err)
+	}
+}
+
+// parseInspection parses the metadata and the tasks of the image from the log of its inspector pod
+func parseInspection(image string, logs []byte) (*models.DroidMetadata, []models.TaskSetting, error) {
+	metadataStart := bytes.Index(logs, []byte(markerMetadata+"\n"))
+	indexStart := bytes.LastIndex(logs, []byte(markerIndex+"\n"))
+	if metadataStart < 0 || indexStart < metadataStart {
+		return nil, nil, fmt.Errorf("image %s doesn't print its metadata and index", image)
+	}
+
+	metadata, err := models.ParseDroidMetadata(image+":"+common.PathMetadataYml,
+		logs[metadataStart+len(markerMetadata)+1:indexStart])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tasks []models.TaskSetting
+	if err := json.Unmarshal(logs[indexStart+len(markerIndex)+1:], &tasks); err != nil {
+		return nil, nil, fmt.Errorf("invalid index of image %s: %s", image, err.Error())
+	}
+
+	return metadata, tasks, nil
+}
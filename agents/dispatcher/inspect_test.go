@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testInspection = `--- a01 metadata ---
+kind: DroidMetadata
+version: v3
+product: azurecli
+--- a01 index ---
+[{"ver": "1.0", "execution": {"command": "true"}, "classifier": {"identifier": "test_0"}}]
+`
+
+func TestParseInspection(t *testing.T) {
+	metadata, tasks, err := parseInspection("azurecli:py36", []byte("pulling...\n"+testInspection))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Product != "azurecli" {
+		t.Errorf("expect the image's product but found %s", metadata.Product)
+	}
+	if len(tasks) != 1 || tasks[0].GetIdentifier() != "test_0" {
+		t.Errorf("expect the image's task but found %v", tasks)
+	}
+}
+
+func TestParseInspectionInvalid(t *testing.T) {
+	for _, logs := range []string{
+		"fake logs",
+		strings.Replace(testInspection, "--- a01 index ---", "", 1),
+		strings.Replace(testInspection, "product: azurecli", "product: [", 1),
+		strings.Replace(testInspection, `"test_0"}}]`, `"test_0"}}`, 1),
+	} {
+		if _, _, err := parseInspection("azurecli:py36", []byte(logs)); err == nil {
+			t.Errorf("expect an error: %s", logs)
+		}
+	}
+}
+
+func TestInspectImagePodFailed(t *testing.T) {
+	run := newTestRun()
+	image := models.RunImage{Name: "py36", Image: "a01test.azurecr.io/azurecli:py36"}
+
+	// the pod of a previous dispatcher failed
+	d, client := newTestDispatcher(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: testJobName + "-py36-index", Namespace: testNamespace},
+		Status:     corev1.PodStatus{Phase: corev1.PodFailed, Message: "image not found"},
+	})
+
+	if _, _, err := d.inspectImagePod(context.Background(), run, image); err == nil || !strings.Contains(err.Error(), "image not found") {
+		t.Errorf("expect the failure of the pod but found %v", err)
+	}
+	if _, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), testJobName+"-py36-index", metav1.GetOptions{}); err == nil {
+		t.Error("expect the failed pod to be deleted so the image is inspected again")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
+	"github.com/Azure/adx-automation-agent/sdk/lease"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// dispatcher holds what the dispatcher works with. The Kubernetes client, the task queue and the store are injected
+// so the dispatcher can be tested without a cluster.
+type dispatcher struct {
+	client    kubernetes.Interface
+	namespace string
+	metadata  *models.DroidMetadata
+	storage   *storage.Config
+	queue     taskQueue
+
+	// storeSecret is the secret of the store referenced by the droid Job. It defaults to droidjob.DefaultStoreSecret().
+	storeSecret *droidjob.StoreSecret
+
+	// update applies the changes to the run and stores it in the task store. The changes are applied again to the
+	// latest version of the run if it was changed concurrently.
+	update func(ctx context.Context, run *models.Run, changes func(*models.Run) error) (*models.Run, error)
+
+	// queryTests returns the tasks of the run
+	queryTests func(run *models.Run) []models.TaskSetting
+
+	// inspectImage returns the metadata and the tasks of an image of a multi-image run. The image is inspected in a
+	// pod if it is nil.
+	inspectImage func(ctx context.Context, run *models.Run, image models.RunImage) (*models.DroidMetadata, []models.TaskSetting, error)
+
+	// inspected keeps the images of the run inspected by the dispatcher by name
+	inspected map[string]*inspectedImage
+
+	// tasks, if set, lists the tasks of the run, so the results of a multi-image run are reported by image
+	tasks taskLister
+
+	// observe is called, if set, whenever the run moves to another status
+	observe func(run *models.Run)
+
+	// owner, if set, owns the Job of the run, so the Job is deleted with it
+	owner *metav1.OwnerReference
+}
+
+// taskLister lists the tasks of a run. It is implemented by store.Client.
+type taskLister interface {
+	ListAllTasks(ctx context.Context, runID int) ([]models.TaskResult, error)
+}
+
+// createTaskJob creates the Job running the droids of the run. If the Job already exists, because a previous
+// dispatcher created it before it stopped, the existing Job is adopted.
+func (d *dispatcher) createTaskJob(ctx context.Context, run *models.Run, jobName string) (*batchv1.Job, error) {
+	definition, err := droidjob.Render(run, d.metadata, d.storage, d.storeSecret, jobName)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := d.getBudget(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if budget > 0 {
+		unlock, err := d.lockBudget(ctx, jobName)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		parallelism, err := d.getParallelism(ctx, budget, *definition.Spec.Parallelism, jobName)
+		if err != nil {
+			return nil, err
+		}
+		definition.Spec.Parallelism = &parallelism
+	}
+
+	if d.owner != nil {
+		definition.OwnerReferences = []metav1.OwnerReference{*d.owner}
+	}
+
+	job, err := d.client.BatchV1().Jobs(d.namespace).Create(ctx, definition, metav1.CreateOptions{})
+	if err == nil {
+		return job, nil
+	} else if !errors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("fail to create job %s: %s", jobName, err.Error())
+	}
+
+	job, err = d.getTaskJob(ctx, run, jobName)
+	if err != nil {
+		return nil, err
+	} else if job == nil {
+		return nil, fmt.Errorf("job %s already exists but can't be found", jobName)
+	}
+
+	logrus.Infof("Job %s already exists. It is adopted.", jobName)
+	return job, nil
+}
+
+// budgetExhaustedError is returned when the droid pods of the product's other runs use up the product's budget
+type budgetExhaustedError struct {
+	product string
+	budget  int
+}
+
+func (e *budgetExhaustedError) Error() string {
+	return fmt.Sprintf("the budget of %d droid pods of %s is used up", e.budget, e.product)
+}
+
+// isBudgetExhausted returns true if the error is a budgetExhaustedError
+func isBudgetExhausted(err error) bool {
+	_, ok := err.(*budgetExhaustedError)
+	return ok
+}
+
+// budgetLockRetryPeriod is the time between two attempts to acquire the lease of a product's budget
+var budgetLockRetryPeriod = time.Second
+
+// lockBudget acquires the lease of the product's budget, so the dispatchers creating the Jobs of the product's runs at
+// the same time allocate the budget one after the other. It returns the function releasing the lease. A lease whose
+// holder stopped before releasing it is taken over once it expires.
+func (d *dispatcher) lockBudget(ctx context.Context, jobName string) (func(), error) {
+	budgetLease := lease.New(d.client, d.namespace, "a01-budget-"+d.metadata.Product, getIdentity()+"/"+jobName)
+	budgetLease.RetryPeriod = budgetLockRetryPeriod
+
+	acquireCtx, cancel := context.WithTimeout(ctx, 2*budgetLease.Duration)
+	defer cancel()
+	if err := budgetLease.Acquire(acquireCtx); err != nil {
+		return nil, fmt.Errorf("fail to lock the budget of %s: %s", d.metadata.Product, err.Error())
+	}
+
+	return func() {
+		if err := budgetLease.Release(context.Background()); err != nil {
+			logrus.Warnf("Fail to unlock the budget of %s: %s", d.metadata.Product, err)
+		}
+	}, nil
+}
+
+// getParallelism returns the parallelism of the run's Job within the product's budget of droid pods. The pods the
+// unfinished Jobs of the product's other runs may run are deducted from the budget. The budget must be locked.
+func (d *dispatcher) getParallelism(ctx context.Context, budget int, requested int32, jobName string) (int32, error) {
+	selector := fmt.Sprintf("%s=%s", droidjob.LabelProduct, d.metadata.Product)
+	jobs, err := d.client.BatchV1().Jobs(d.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return 0, fmt.Errorf("fail to list the jobs of %s: %s", d.metadata.Product, err.Error())
+	}
+
+	available := budget
+	for _, job := range jobs.Items {
+		if job.Name != jobName && !isJobFinished(&job) && job.Spec.Parallelism != nil {
+			available -= int(*job.Spec.Parallelism)
+		}
+	}
+
+	if available < 1 {
+		return 0, &budgetExhaustedError{product: d.metadata.Product, budget: budget}
+	} else if int(requested) > available {
+		logrus.Infof("The parallelism is reduced from %d to %d within the budget of %s.", requested, available, d.metadata.Product)
+		return int32(available), nil
+	}
+	return requested, nil
+}
+
+// getBudget returns the number of droid pods the product may run at the same time, or 0 if it is unlimited. The
+// budget of the product in the system config overrides the default budget.
+func (d *dispatcher) getBudget(ctx context.Context) (int, error) {
+	configMap, err := d.client.CoreV1().ConfigMaps(d.namespace).Get(ctx, common.SystemConfigMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("fail to get the system config: %s", err.Error())
+	}
+
+	for _, key := range []string{common.ConfigKeyDroidBudget + "." + d.metadata.Product, common.ConfigKeyDroidBudget} {
+		if value, ok := configMap.Data[key]; ok {
+			budget, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, fmt.Errorf("invalid system config %s: %s", key, err.Error())
+			}
+			return budget, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// isJobFinished returns true if the Job completed or failed
+func isJobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// getTaskJob returns the run's Job of the given name, or nil if the Job doesn't exist. It returns an error if a Job of
+// the name exists but belongs to another run.
+func (d *dispatcher) getTaskJob(ctx context.Context, run *models.Run, jobName string) (*batchv1.Job, error) {
+	job, err := d.client.BatchV1().Jobs(d.namespace).Get(ctx, jobName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to get job %s: %s", jobName, err.Error())
+	}
+
+	if runID := job.Labels["run_id"]; runID != strconv.Itoa(run.ID) {
+		return nil, fmt.Errorf("job %s belongs to run %q instead of run %d", jobName, runID, run.ID)
+	}
+
+	return job, nil
+}
+
+// getReportSettings returns the owners of the product and the URL of the email template from the run's secret. The
+// template URL is empty if the secret doesn't define it, in which case a generic template is used.
+func (d *dispatcher) getReportSettings(ctx context.Context, run *models.Run) (owners []string, templateURL string, err error) {
+	secret, err := d.client.CoreV1().Secrets(d.namespace).Get(ctx, run.GetSecretName(d.metadata), metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get the kubernetes secret: %s", err.Error())
+	}
+
+	template, ok := secret.Data["email.path.template"]
+	if !ok {
+		logrus.Warn("Failed to get the `email.path.template` value from the kubernetes secret. A generic template will be used instead")
+	}
+
+	return strings.Split(string(secret.Data["owners"]), ","), string(template), nil
+}
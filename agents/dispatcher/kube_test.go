@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	batchv1 "k8s.io/api/batch/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testNamespace = "a01-test"
+	testJobName   = "azurecli-42-abc"
+)
+
+func newTestDispatcher(objects ...runtime.Object) (*dispatcher, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+	return &dispatcher{
+		client:    client,
+		namespace: testNamespace,
+		metadata: &models.DroidMetadata{
+			Kind:    models.DroidMetadataKind,
+			Version: models.DroidMetadataV3,
+			Product: "azurecli",
+			Storage: true,
+		},
+		storage: storage.DefaultConfig(),
+	}, client
+}
+
+func newTestRun() *models.Run {
+	return &models.Run{
+		ID:   42,
+		Name: "test run",
+		Settings: map[string]interface{}{
+			common.KeyImageName:       "a01test.azurecr.io/azurecli:latest",
+			common.KeyImagePullSecret: "azureclidev-registry",
+			common.KeyInitParallelism: float64(4),
+			common.KeyLiveMode:        "False",
+			common.KeyAgentVersion:    "latest",
+		},
+		Details: map[string]string{common.KeyJobName: testJobName},
+	}
+}
+
+func TestCreateTaskJob(t *testing.T) {
+	d, client := newTestDispatcher()
+
+	job, err := d.createTaskJob(context.Background(), newTestRun(), testJobName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != testJobName {
+		t.Errorf("expect job %s but found %s", testJobName, job.Name)
+	}
+
+	created, err := client.BatchV1().Jobs(testNamespace).Get(context.Background(), testJobName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expect the job created in %s: %s", testNamespace, err)
+	}
+	if created.Labels["run_id"] != "42" {
+		t.Errorf("expect the run_id label but found %v", created.Labels)
+	}
+	if spec := created.Spec.Template.Spec; len(spec.Containers) != 1 || spec.Containers[0].Image != "a01test.azurecr.io/azurecli:latest" {
+		t.Errorf("unexpected containers %+v", spec.Containers)
+	}
+}
+
+func TestCreateTaskJobAlreadyExists(t *testing.T) {
+	existing := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: testJobName, Namespace: testNamespace, Labels: map[string]string{"run_id": "42"}},
+	}
+	d, _ := newTestDispatcher(existing)
+
+	job, err := d.createTaskJob(context.Background(), newTestRun(), testJobName)
+	if err != nil {
+		t.Fatalf("expect the existing job to be adopted but found error %s", err)
+	}
+	if job.Name != testJobName || job.Spec.Parallelism != nil {
+		t.Errorf("expect the existing job but found %+v", job)
+	}
+}
+
+func TestCreateTaskJobExistsForAnotherRun(t *testing.T) {
+	d, _ := newTestDispatcher(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: testJobName, Namespace: testNamespace, Labels: map[string]string{"run_id": "41"}},
+	})
+
+	if _, err := d.createTaskJob(context.Background(), newTestRun(), testJobName); err == nil {
+		t.Error("expect an error when the job belongs to another run")
+	}
+}
+
+func TestCreateTaskJobFailure(t *testing.T) {
+	d, client := newTestDispatcher()
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("jobs.batch is forbidden")
+	})
+
+	if _, err := d.createTaskJob(context.Background(), newTestRun(), testJobName); err == nil {
+		t.Error("expect an error when the job isn't created")
+	}
+}
+
+func TestCreateTaskJobRenderFailure(t *testing.T) {
+	d, client := newTestDispatcher()
+	d.metadata.Environments = []models.DroidMetadataEnvDef{{Name: "A01_BROKEN", Type: models.EnvTypeTemplate, Value: "{{ .Missing }}"}}
+
+	if _, err := d.createTaskJob(context.Background(), newTestRun(), testJobName); err == nil {
+		t.Error("expect an error when the job can't be rendered")
+	}
+	if jobs, _ := client.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{}); len(jobs.Items) != 0 {
+		t.Errorf("expect no job created but found %d", len(jobs.Items))
+	}
+}
+
+func newBudgetJob(name string, product string, parallelism int32, finished bool) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: map[string]string{droidjob.LabelProduct: product}},
+		Spec:       batchv1.JobSpec{Parallelism: &parallelism},
+	}
+	if finished {
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	}
+	return job
+}
+
+func newSystemConfig(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: common.SystemConfigMapName, Namespace: testNamespace},
+		Data:       data,
+	}
+}
+
+func TestCreateTaskJobBudget(t *testing.T) {
+	d, _ := newTestDispatcher(
+		newSystemConfig(map[string]string{"droid.budget": "100", "droid.budget.azurecli": "6"}),
+		newBudgetJob("azurecli-40", "azurecli", 3, false),
+		newBudgetJob("azurecli-39", "azurecli", 8, true),
+		newBudgetJob("azurepowershell-41", "azurepowershell", 8, false),
+	)
+
+	job, err := d.createTaskJob(context.Background(), newTestRun(), testJobName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *job.Spec.Parallelism != 3 {
+		t.Errorf("expect the parallelism to be reduced to the rest of the budget but found %d", *job.Spec.Parallelism)
+	}
+
+	run := newTestRun()
+	run.ID = 43
+	if _, err := d.createTaskJob(context.Background(), run, "azurecli-43"); !isBudgetExhausted(err) {
+		t.Errorf("expect the budget to be used up but found %v", err)
+	}
+}
+
+// withLeaseVersions makes the fake client refuse to update a Lease from an outdated resource version, as the API server
+// does, so the leases exclude each other
+func withLeaseVersions(client *fake.Clientset) {
+	var lock sync.Mutex
+	leases := coordinationv1.SchemeGroupVersion.WithResource("leases")
+
+	client.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch action.GetVerb() {
+		case "create":
+			created := action.(k8stesting.CreateAction).GetObject().(*coordinationv1.Lease).DeepCopy()
+			created.ResourceVersion = "1"
+			return true, created, client.Tracker().Create(leases, created, action.GetNamespace())
+		case "update":
+			updated := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease).DeepCopy()
+			current, err := client.Tracker().Get(leases, action.GetNamespace(), updated.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			if current.(*coordinationv1.Lease).ResourceVersion != updated.ResourceVersion {
+				return true, nil, apierrors.NewConflict(leases.GroupResource(), updated.Name, errors.New("outdated"))
+			}
+
+			version, _ := strconv.Atoi(updated.ResourceVersion)
+			updated.ResourceVersion = strconv.Itoa(version + 1)
+			return true, updated, client.Tracker().Update(leases, updated, action.GetNamespace())
+		default:
+			return false, nil, nil
+		}
+	})
+}
+
+// TestCreateTaskJobBudgetConcurrently verifies the dispatchers creating the Jobs of a product at the same time don't
+// exceed its budget together
+func TestCreateTaskJobBudgetConcurrently(t *testing.T) {
+	defer func(period time.Duration) { budgetLockRetryPeriod = period }(budgetLockRetryPeriod)
+	budgetLockRetryPeriod = 10 * time.Millisecond
+
+	d, client := newTestDispatcher(newSystemConfig(map[string]string{"droid.budget": "6"}))
+	withLeaseVersions(client)
+
+	// widen the window between the allocation of the budget and the creation of the Job
+	client.PrependReactor("list", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(20 * time.Millisecond)
+		return false, nil, nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			run := newTestRun()
+			run.ID = 42 + i
+			_, errs[i] = d.createTaskJob(context.Background(), run, fmt.Sprintf("azurecli-%d", run.ID))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && !isBudgetExhausted(err) {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := client.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pods int32
+	for _, job := range jobs.Items {
+		pods += *job.Spec.Parallelism
+	}
+	if pods != 6 || len(jobs.Items) != 2 {
+		t.Errorf("expect the Jobs to share the budget of 6 droid pods but found %d Jobs of %d pods", len(jobs.Items), pods)
+	}
+}
+
+func TestCreateTaskJobWithinBudget(t *testing.T) {
+	for _, data := range []map[string]string{nil, {"droid.budget": "0"}, {"droid.budget": "20"}} {
+		d, _ := newTestDispatcher(newSystemConfig(data), newBudgetJob("azurecli-40", "azurecli", 8, false))
+
+		job, err := d.createTaskJob(context.Background(), newTestRun(), testJobName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *job.Spec.Parallelism != 4 {
+			t.Errorf("%v: expect the requested parallelism but found %d", data, *job.Spec.Parallelism)
+		}
+	}
+
+	d, _ := newTestDispatcher(newSystemConfig(map[string]string{"droid.budget": "many"}))
+	if _, err := d.createTaskJob(context.Background(), newTestRun(), testJobName); err == nil {
+		t.Error("expect an error for an invalid budget")
+	}
+}
+
+func TestGetReportSettings(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azurecli", Namespace: testNamespace},
+		Data: map[string][]byte{
+			"owners":              []byte("alice@example.com,bob@example.com"),
+			"email.path.template": []byte("https://example.com/template.html"),
+		},
+	}
+	d, _ := newTestDispatcher(secret)
+
+	owners, templateURL, err := d.getReportSettings(context.Background(), newTestRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 2 || owners[0] != "alice@example.com" || owners[1] != "bob@example.com" {
+		t.Errorf("unexpected owners %v", owners)
+	}
+	if templateURL != "https://example.com/template.html" {
+		t.Errorf("unexpected template %q", templateURL)
+	}
+
+	delete(secret.Data, "email.path.template")
+	d, _ = newTestDispatcher(secret)
+	if _, templateURL, err = d.getReportSettings(context.Background(), newTestRun()); err != nil || templateURL != "" {
+		t.Errorf("expect the generic template but found %q, %v", templateURL, err)
+	}
+}
+
+func TestGetReportSettingsMissingSecret(t *testing.T) {
+	d, _ := newTestDispatcher(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azurecli", Namespace: "another-namespace"},
+	})
+
+	if _, _, err := d.getReportSettings(context.Background(), newTestRun()); err == nil {
+		t.Error("expect an error when the secret doesn't exist in the namespace")
+	}
+}
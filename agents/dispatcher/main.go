@@ -1,33 +1,32 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base32"
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
 	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/lease"
+	"github.com/Azure/adx-automation-agent/sdk/logging"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
 	"github.com/Azure/adx-automation-agent/sdk/models"
-	"github.com/Azure/adx-automation-agent/sdk/monitor"
-	"github.com/Azure/adx-automation-agent/sdk/reportutils"
 	"github.com/Azure/adx-automation-agent/sdk/schedule"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/Azure/adx-automation-agent/sdk/store"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
 	"github.com/sirupsen/logrus"
-	batchv1 "k8s.io/api/batch/v1"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	taskBroker    = schedule.CreateInClusterTaskBroker()
-	namespace     = common.GetCurrentNamespace("a01-prod")
-	droidMetadata = models.ReadDroidMetadata(common.PathMetadataYml)
-	clientset     = kubeutils.TryCreateKubeClientset()
-	version       = "Unknown"
-	sourceCommit  = "Unknown"
+	taskBroker   *schedule.TaskBroker
+	version      = "Unknown"
+	sourceCommit = "Unknown"
 )
 
 // main defines the logic of A01 dispatcher
@@ -36,307 +35,154 @@ var (
 // status of the queue. When it determines all the tasks are completed, the dispatcher will trigger a reporting and then
 // exit.
 func main() {
-	logrus.Infof("A01 Droid Dispatcher.\nVersion: %s.\nCommit: %s.\n", version, sourceCommit)
-	logrus.Infof("Pod name: %s", os.Getenv(common.EnvPodName))
-
-	var pRunID *int
-	pRunID = flag.Int("run", -1, "The run ID")
-	flag.Parse()
-
-	if *pRunID == -1 {
-		logrus.Fatal("Missing runID")
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		renderCommand(os.Args[2:])
+		return
 	}
 
-	// query the run and then update the product name in the details
-	run, err := models.QueryRun(*pRunID)
-	if err != nil {
-		logrus.Fatal("fail to query the run")
+	if len(os.Args) > 1 && os.Args[1] == "controller" {
+		controllerCommand(os.Args[2:])
+		return
 	}
 
-	if run.Status == common.RunStatusInitialized || len(run.Status) == 0 {
-		run.Details[common.KeyProduct] = droidMetadata.Product
-		run, err = run.SubmitChange()
-		if err != nil {
-			logrus.Fatal("fail to update the run: ", err)
-		}
-
-		logrus.Info(run)
-
-		// generate a job name. the name will be used through out the remaining
-		// session to identify the group of operations and resources
-		jobName := fmt.Sprintf("%s-%d-%s", droidMetadata.Product, run.ID, getRandomString())
-
-		// publish tasks to the task broker which will establish a worker queue
-		err = taskBroker.PublishTasks(jobName, run.QueryTests())
-		if err != nil {
-			logrus.Fatal("Fail to publish tasks to the task broker:", err)
-		}
-		defer taskBroker.Close()
-
-		// update the run status and add job name
-		run.Status = common.RunStatusPublished
-		run.Details[common.KeyJobName] = jobName
-		run, err = run.SubmitChange()
-		if err != nil {
-			logrus.Fatal("fail to update the run: ", err)
-		}
+	if len(os.Args) > 1 && os.Args[1] == "operator" {
+		operatorCommand(os.Args[2:])
+		return
 	}
 
-	if run.Status == common.RunStatusPublished {
-		jobName := run.Details[common.KeyJobName]
-
-		// creates a kubernete job to manage test droid
-		jobDef, err := createTaskJob(run, jobName)
-		if err != nil {
-			logrus.Fatal(err.Error())
-		}
-
-		// ignore this error for now. This API's latest version seems to sending
-		// inaccurate error
-		clientset.BatchV1().Jobs(namespace).Create(jobDef)
-		_, err = clientset.BatchV1().Jobs(namespace).Get(jobDef.Name, metav1.GetOptions{})
-		if err != nil {
-			logrus.Fatal(err.Error())
-		}
-
-		run.Status = common.RunStatusRunning
-		run, err = run.SubmitChange()
-		if err != nil {
-			logrus.Fatal("fail to update the run: ", err)
-		}
+	if len(os.Args) > 1 && os.Args[1] == "scheduler" {
+		schedulerCommand(os.Args[2:])
+		return
 	}
 
-	if run.Status == common.RunStatusRunning {
-		// begin monitoring the job status till the end
-		monitor.WaitTasks(taskBroker, run)
-
-		secret, err := kubeutils.TryCreateKubeClientset().
-			CoreV1().
-			Secrets(namespace).
-			Get(run.GetSecretName(droidMetadata), metav1.GetOptions{})
-		if err != nil {
-			logrus.Fatal("Failed to get the kubernetes secret: ", err)
-		}
+	var pRunID *int
+	pRunID = flag.Int("run", -1, "The run ID")
+	flag.Parse()
 
-		reportutils.RefreshPowerBI(run, run.GetSecretName(droidMetadata))
+	logging.Setup(logrus.Fields{
+		logging.FieldRunID:   *pRunID,
+		logging.FieldPodName: os.Getenv(common.EnvPodName),
+	})
+	logrus.WithFields(logrus.Fields{"version": version, "commit": sourceCommit}).Info("A01 Droid Dispatcher.")
 
-		owners := string(secret.Data["owners"])
-		templateURL, ok := secret.Data["email.path.template"]
-		if ok {
-			reportutils.Report(run, strings.Split(owners, ","), string(templateURL))
-		} else {
-			logrus.Warn("Failed to get the `email.path.template` value from the kubernetes secret. A generic template will be used instead")
-			reportutils.Report(run, strings.Split(owners, ","), "")
-		}
+	droidMetadata, err := models.ReadDroidMetadata(common.PathMetadataYml)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logging.SetField(logging.FieldProduct, droidMetadata.Product)
 
-		run.Status = common.RunStatusCompleted
-		run, err = run.SubmitChange()
-		if err != nil {
-			logrus.Fatal("fail to update the run: ", err)
-		}
+	if *pRunID == -1 {
+		logrus.Fatal("Missing runID")
 	}
 
-	if run.Status == common.RunStatusCompleted {
-		logrus.Info(run)
-		logrus.Infof("The run %d was already completed.", run.ID)
-		os.Exit(0)
+	clientset, err := kubeutils.CreateKubeClientset()
+	if err != nil {
+		logrus.Fatal(err)
 	}
-}
+	taskBroker = schedule.CreateInClusterTaskBroker()
+	defer taskBroker.Close()
 
-///////////////////////////////////////////////////////////////////////////////////////////////////
-// Kubernetes JOB
+	// the root context is canceled when the dispatcher is asked to shut down
+	ctx, cancel := common.NewSignalContext()
+	defer cancel()
 
-func createTaskJob(run *models.Run, jobName string) (job *batchv1.Job, err error) {
-	client, err := kubeutils.CreateKubeClientset()
+	storageConfig, err := storage.LoadConfig(ctx)
 	if err != nil {
-		return nil, err
+		logrus.Fatal(err)
 	}
 
-	parallelism := int32(run.Settings[common.KeyInitParallelism].(float64))
-	var backoff int32 = 5
+	d := &dispatcher{
+		client:    clientset,
+		namespace: common.GetCurrentNamespace("a01-prod"),
+		metadata:  droidMetadata,
+		storage:   storageConfig,
+		queue:     taskBroker,
 
-	definition := batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:   jobName,
-			Labels: getLabels(run),
+		storeSecret: droidjob.LoadStoreSecret(ctx),
+		update: func(ctx context.Context, run *models.Run, changes func(*models.Run) error) (*models.Run, error) {
+			return run.UpdateContext(ctx, changes)
 		},
-		Spec: batchv1.JobSpec{
-			Parallelism:  &parallelism,
-			BackoffLimit: &backoff,
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:   jobName,
-					Labels: getLabels(run),
-				},
-				Spec: corev1.PodSpec{
-					ServiceAccountName: "test-runner-robot",
-					Containers:         getContainerSpecs(run, jobName),
-					ImagePullSecrets:   getImagePullSource(run),
-					Volumes:            getVolumes(run),
-					RestartPolicy:      corev1.RestartPolicyNever,
-				},
-			},
+		queryTests: (*models.Run).QueryTests,
+		tasks:      store.NewClientFromEnv(),
+		observe: func(run *models.Run) {
+			if jobName, ok := run.Details[common.KeyJobName]; ok {
+				logging.SetField(logging.FieldJobName, jobName)
+			}
 		},
 	}
 
-	return client.BatchV1().Jobs(namespace).Create(&definition)
-}
-
-func getLabels(run *models.Run) map[string]string {
-	labels := make(map[string]string)
-	labels["run_id"] = strconv.Itoa(run.ID)
-	labels["run_live"] = run.Settings[common.KeyLiveMode].(string)
+	metrics.SetRun(droidMetadata.Product, strconv.Itoa(*pRunID))
+	metrics.Serve(fmt.Sprintf(":%d", common.PortMetrics))
 
-	return labels
-}
-
-func getVolumes(run *models.Run) (volumes []corev1.Volume) {
-	volumes = []corev1.Volume{
-		{
-			Name: common.StorageVolumeNameTools,
-			VolumeSource: corev1.VolumeSource{
-				AzureFile: &corev1.AzureFileVolumeSource{
-					SecretName: common.SecretNameAgents,
-					ShareName:  fmt.Sprintf("linux-%s", run.Settings[common.KeyAgentVersion]),
-				},
-			},
-		},
+	shutdownTracing, err := tracing.Init(
+		ctx,
+		"a01dispatcher",
+		tracing.AttributeRunID.Int(*pRunID),
+		tracing.AttributeProduct.String(droidMetadata.Product))
+	if err != nil {
+		logrus.Warn("Failed to initialize tracing: ", err)
 	}
 
-	if !droidMetadata.Storage {
-		return
+	ctx, rootSpan := tracing.Start(ctx, "dispatch", trace.WithAttributes(tracing.AttributeRunID.Int(*pRunID)))
+	endTracing := func() {
+		rootSpan.End()
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		shutdownTracing(flushCtx)
 	}
+	defer endTracing()
 
-	volumes = append(volumes,
-		corev1.Volume{
-			Name: common.StorageVolumeNameArtifacts,
-			VolumeSource: corev1.VolumeSource{
-				AzureFile: &corev1.AzureFileVolumeSource{
-					SecretName: run.GetSecretName(droidMetadata),
-					ShareName:  run.Settings[common.KeyStorageShare].(string),
-				},
-			},
-		})
-
-	for _, file := range droidMetadata.SecretFiles {
-		volumes = append(volumes,
-			corev1.Volume{
-				Name: common.StorageVolumeNameSecrets,
-				VolumeSource: corev1.VolumeSource{
-					Secret: &corev1.SecretVolumeSource{
-						SecretName: run.GetSecretName(droidMetadata),
-						Items: []corev1.KeyToPath{
-							{
-								Key:  file.SecretKey,
-								Path: file.Path,
-							},
-						},
-					},
-				},
-			})
+	// only the dispatcher holding the run's lease drives the run. The lease is renewed till the dispatcher exits, and
+	// the context is canceled if the lease is lost to another dispatcher.
+	runLease := lease.New(clientset, d.namespace, getLeaseName(*pRunID), getIdentity())
+	if err := runLease.Acquire(ctx); err != nil {
+		logrus.Fatal("fail to acquire the lease of the run: ", err)
 	}
-	return
-}
-
-func getImagePullSource(run *models.Run) []corev1.LocalObjectReference {
-	return []corev1.LocalObjectReference{{Name: run.Settings[common.KeyImagePullSecret].(string)}}
-}
+	ctx = runLease.Hold(ctx)
+	defer runLease.Release(context.Background())
 
-func getContainerSpecs(run *models.Run, jobName string) (containers []corev1.Container) {
-	c := corev1.Container{
-		Name:    "main",
-		Image:   run.Settings[common.KeyImageName].(string),
-		Env:     getEnvironmentVariableDef(run, jobName),
-		Command: []string{common.PathMountTools + "/a01droid"},
+	fatal := func(args ...interface{}) {
+		if runLease.Lost() {
+			logrus.Warnf("Another dispatcher drives run %d. Exit.", *pRunID)
+			endTracing()
+			os.Exit(0)
+		}
+		logrus.Fatal(args...)
 	}
 
-	volumeMounts := []corev1.VolumeMount{
-		{
-			MountPath: common.PathMountTools,
-			Name:      common.StorageVolumeNameTools,
-		},
+	// query the run and resume from its status
+	run, err := models.QueryRunContext(ctx, *pRunID)
+	if err != nil {
+		fatal("fail to query the run")
 	}
 
-	if droidMetadata.Storage {
-		volumeMounts = append(volumeMounts, corev1.VolumeMount{
-			MountPath: common.PathMountArtifacts,
-			Name:      common.StorageVolumeNameArtifacts,
-		})
+	if run, err = d.drive(ctx, run); err != nil {
+		fatal(err)
 	}
 
-	if len(droidMetadata.SecretFiles) > 0 {
-		volumeMounts = append(volumeMounts, corev1.VolumeMount{
-			MountPath: common.PathMountSecrets,
-			Name:      common.StorageVolumeNameSecrets,
-		})
+	if run.Status == common.RunStatusCompleted {
+		logrus.Info(run)
+		logrus.Infof("The run %d was already completed.", run.ID)
+		runLease.Release(context.Background())
+		endTracing()
+		os.Exit(0)
 	}
+}
 
-	c.VolumeMounts = volumeMounts
-
-	return []corev1.Container{c}
+// getLeaseName returns the name of the lease held by the dispatcher driving the run
+func getLeaseName(runID int) string {
+	return fmt.Sprintf("a01dispatcher-%d", runID)
 }
 
-func getEnvironmentVariableDef(run *models.Run, jobName string) []corev1.EnvVar {
-	result := []corev1.EnvVar{
-		{
-			Name: common.EnvPodName,
-			ValueFrom: &corev1.EnvVarSource{
-				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
-			},
-		},
-		{
-			Name: common.EnvNodeName,
-			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{
-				FieldPath: "spec.nodeName"},
-			},
-		},
-		{
-			Name:  common.EnvJobName,
-			Value: jobName,
-		},
-		{
-			Name: common.EnvKeyInternalCommunicationKey,
-			ValueFrom: &corev1.EnvVarSource{
-				SecretKeyRef: &corev1.SecretKeySelector{
-					LocalObjectReference: corev1.LocalObjectReference{Name: "store-secrets"},
-					Key:                  "comkey",
-				},
-			},
-		},
+// getIdentity returns the name of the dispatcher's pod, or the host name outside of a pod
+func getIdentity() string {
+	if podName := os.Getenv(common.EnvPodName); len(podName) > 0 {
+		return podName
 	}
 
-	for _, def := range droidMetadata.Environments {
-		var envVar *corev1.EnvVar
-		if def.Type == "secret" {
-			envVar = &corev1.EnvVar{
-				Name: def.Name,
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						LocalObjectReference: corev1.LocalObjectReference{Name: run.GetSecretName(droidMetadata)},
-						Key:                  def.Value,
-					},
-				},
-			}
-		} else if def.Type == "argument-switch-live" {
-			if run.Settings[common.KeyLiveMode] == "True" {
-				envVar = &corev1.EnvVar{Name: def.Name, Value: def.Value}
-			}
-		} else if def.Type == "argument-value-mode" {
-			if v, ok := run.Settings[common.KeyTestModel]; ok {
-				envVar = &corev1.EnvVar{Name: def.Name, Value: v.(string)}
-			}
-		}
-
-		if envVar != nil {
-			result = append(result, *envVar)
-		}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Fatal("fail to get the host name: ", err)
 	}
-
-	return result
-}
-
-func getRandomString() string {
-	bytes := make([]byte, 12)
-	rand.Read(bytes)
-	return strings.TrimRight(strings.ToLower(base32.StdEncoding.EncodeToString(bytes)), "=")
+	return hostname
 }
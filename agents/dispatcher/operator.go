@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/apis/v1alpha1"
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
+	"github.com/Azure/adx-automation-agent/sdk/lease"
+	"github.com/Azure/adx-automation-agent/sdk/logging"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/monitor"
+	"github.com/Azure/adx-automation-agent/sdk/schedule"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/Azure/adx-automation-agent/sdk/store"
+	"github.com/go-logr/logr/funcr"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+// operatorQueue is the part of the task broker the operator uses. It is implemented by schedule.TaskBroker.
+type operatorQueue interface {
+	taskQueue
+	QueueDelete(name string) (int, error)
+}
+
+// operatorStore reads, creates and saves runs. It is implemented by store.Client.
+type operatorStore interface {
+	models.RunStore
+	taskLister
+	CreateRunWithKey(ctx context.Context, run *models.Run, key string) (*models.Run, error)
+}
+
+// runReconciler reconciles A01Runs. Each reconciliation moves the run at most one phase forward, and a running run is
+// checked again after the interval, so one reconciler drives many runs without blocking on any of them. The run in
+// the store is created once for each A01Run, and its Job is owned by the A01Run.
+type runReconciler struct {
+	client    client.Client
+	clientset kubernetes.Interface
+	products  map[string]*product
+	storage   *storage.Config
+	store     operatorStore
+	queue     operatorQueue
+	identity  string
+
+	storeSecret *droidjob.StoreSecret
+
+	// interval is the time between two checks of a running run
+	interval time.Duration
+
+	// newLease returns the lease of the run held while the operator drives it
+	newLease func(namespace string, runID int) *lease.Lease
+
+	// held keeps the leases of the runs the operator drives by run ID. Each lease is renewed in the background till the
+	// run is completed, so a slow reconciliation doesn't let it expire.
+	held     map[int]*heldLease
+	heldLock sync.Mutex
+}
+
+// heldLease is a run's lease renewed in the background. Its context is canceled once the lease is lost or released.
+type heldLease struct {
+	a01run types.NamespacedName
+	lease  *lease.Lease
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// holdLease returns the context of the run's lease, which is canceled once the lease is lost. The lease is acquired
+// and renewed in the background if the operator doesn't hold it yet. It returns nil if another dispatcher holds it.
+func (r *runReconciler) holdLease(ctx context.Context, a01run types.NamespacedName, runID int) (context.Context, error) {
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+
+	if held, ok := r.held[runID]; ok {
+		if held.ctx.Err() == nil {
+			return held.ctx, nil
+		}
+		logrus.WithField(logging.FieldRunID, runID).Warn("The lease of the run is lost.")
+		delete(r.held, runID)
+	}
+
+	runLease := r.newLease(a01run.Namespace, runID)
+	if acquired, err := runLease.TryAcquire(ctx); err != nil || !acquired {
+		return nil, err
+	}
+
+	if r.held == nil {
+		r.held = make(map[int]*heldLease)
+	}
+	leaseCtx, cancel := context.WithCancel(context.Background())
+	r.held[runID] = &heldLease{a01run: a01run, lease: runLease, ctx: runLease.Hold(leaseCtx), cancel: cancel}
+	return r.held[runID].ctx, nil
+}
+
+// releaseLease stops renewing the run's lease and releases it
+func (r *runReconciler) releaseLease(ctx context.Context, namespace string, runID int) error {
+	r.heldLock.Lock()
+	runLease := r.newLease(namespace, runID)
+	if held, ok := r.held[runID]; ok {
+		held.cancel()
+		runLease = held.lease
+		delete(r.held, runID)
+	}
+	r.heldLock.Unlock()
+
+	return runLease.Release(ctx)
+}
+
+// releaseLeases releases the held leases which match, so another dispatcher takes their runs over without waiting for
+// the leases to expire
+func (r *runReconciler) releaseLeases(ctx context.Context, match func(held *heldLease) bool) {
+	r.heldLock.Lock()
+	var runIDs []int
+	var namespaces []string
+	for runID, held := range r.held {
+		if match(held) {
+			runIDs = append(runIDs, runID)
+			namespaces = append(namespaces, held.lease.Namespace)
+		}
+	}
+	r.heldLock.Unlock()
+
+	for i, runID := range runIDs {
+		if err := r.releaseLease(ctx, namespaces[i], runID); err != nil {
+			logrus.WithField(logging.FieldRunID, runID).Warnf("Fail to release the lease: %s", err)
+		}
+	}
+}
+
+// Reconcile moves the A01Run of the request one phase forward and mirrors its run in its status
+func (r *runReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var a01run v1alpha1.A01Run
+	if err := r.client.Get(ctx, req.NamespacedName, &a01run); errors.IsNotFound(err) {
+		// the lease of a deleted A01Run isn't renewed anymore
+		r.releaseLeases(ctx, func(held *heldLease) bool { return held.a01run == req.NamespacedName })
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	log := logrus.WithFields(logrus.Fields{"a01run": req.NamespacedName.String(), logging.FieldRunID: a01run.Status.RunID})
+
+	p, ok := r.products[a01run.Spec.Product]
+	if !ok {
+		a01run.Status.Message = fmt.Sprintf("unknown product %s", a01run.Spec.Product)
+		return ctrl.Result{}, r.client.Status().Update(ctx, &a01run)
+	}
+
+	// the A01Run's UID is the idempotency key, so a run is created once even if the status fails to be saved
+	if a01run.Status.RunID == 0 {
+		run, err := r.store.CreateRunWithKey(ctx, &models.Run{
+			Name:     a01run.Name,
+			Settings: a01run.Spec.ToSettings(),
+			Details:  map[string]string{common.KeyProduct: p.metadata.Product},
+			Status:   common.RunStatusInitialized,
+		}, string(a01run.UID))
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("fail to create the run: %s", err.Error())
+		}
+
+		log.WithField(logging.FieldRunID, run.ID).Info("Created the run.")
+		a01run.Status.ObservedGeneration = a01run.Generation
+		r.mirror(ctx, &a01run, run, nil)
+		return ctrl.Result{Requeue: true}, r.client.Status().Update(ctx, &a01run)
+	}
+
+	// the metrics are labelled with the run rather than with the process, which drives many runs
+	ctx = metrics.WithRun(ctx, p.metadata.Product, strconv.Itoa(a01run.Status.RunID))
+
+	// the errors below are retried after the interval rather than with the controller's backoff, so a run is checked
+	// on time whatever happens
+	run, err := r.store.GetRun(ctx, a01run.Status.RunID)
+	if err != nil {
+		log.Errorf("Fail to query the run: %s", err)
+		return ctrl.Result{RequeueAfter: r.interval}, nil
+	}
+
+	if run.Status == common.RunStatusCompleted || run.Status == common.RunStatusCanceled {
+		metrics.SetRunStatusContext(ctx, run.Status)
+		r.mirror(ctx, &a01run, run, nil)
+		if err := r.releaseLease(ctx, a01run.Namespace, run.ID); err != nil {
+			log.Warnf("Fail to release the lease: %s", err)
+		}
+		return ctrl.Result{}, r.client.Status().Update(ctx, &a01run)
+	}
+
+	leaseCtx, err := r.holdLease(ctx, req.NamespacedName, run.ID)
+	if err != nil {
+		log.Errorf("Fail to acquire the lease: %s", err)
+		return ctrl.Result{RequeueAfter: r.interval}, nil
+	} else if leaseCtx == nil {
+		log.Info("Another dispatcher drives the run.")
+		r.mirror(ctx, &a01run, run, nil)
+		return ctrl.Result{RequeueAfter: r.interval}, r.client.Status().Update(ctx, &a01run)
+	}
+
+	// the phase stops if the lease is lost while it runs
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(leaseCtx, cancel)()
+
+	d := r.newDispatcher(&a01run, p)
+	remaining := 0
+	switch run.Status {
+	case common.RunStatusInitialized, "":
+		run, err = d.publish(ctx, run)
+	case common.RunStatusPublished:
+		run, err = d.startJob(ctx, run)
+	case common.RunStatusRunning:
+		var done bool
+		if done, remaining, err = monitor.CheckTasksContext(ctx, d.client, d.namespace, d.queue, run); err == nil && done {
+			if run, err = d.report(ctx, run); err == nil {
+				r.deleteQueue(run)
+			}
+		}
+	}
+
+	if err != nil {
+		// the run in the store isn't changed by a failed phase
+		if run, getErr := r.store.GetRun(ctx, a01run.Status.RunID); getErr == nil {
+			r.mirror(ctx, &a01run, run, err)
+		}
+		if updateErr := r.client.Status().Update(ctx, &a01run); updateErr != nil {
+			log.Warnf("Fail to update the status: %s", updateErr)
+		}
+		log.Errorf("The phase failed: %s", err)
+		return ctrl.Result{RequeueAfter: r.interval}, nil
+	}
+
+	metrics.SetRunStatusContext(ctx, run.Status)
+	r.mirror(ctx, &a01run, run, nil)
+	a01run.Status.RemainingTasks = remaining
+	if err := r.client.Status().Update(ctx, &a01run); err != nil {
+		log.Warnf("Fail to update the status: %s", err)
+		return ctrl.Result{RequeueAfter: r.interval}, nil
+	}
+
+	if run.Status == common.RunStatusRunning {
+		return ctrl.Result{RequeueAfter: r.interval}, nil
+	} else if run.Status == common.RunStatusCompleted {
+		log.Info("The run is completed.")
+		return ctrl.Result{}, r.releaseLease(ctx, a01run.Namespace, run.ID)
+	}
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// newDispatcher returns the dispatcher of the A01Run. The run's Job is created in the A01Run's namespace and owned by
+// it.
+func (r *runReconciler) newDispatcher(a01run *v1alpha1.A01Run, p *product) *dispatcher {
+	return &dispatcher{
+		client:    r.clientset,
+		namespace: a01run.Namespace,
+		metadata:  p.metadata,
+		storage:   r.storage,
+		queue:     r.queue,
+
+		storeSecret: r.storeSecret,
+		update: func(ctx context.Context, run *models.Run, changes func(*models.Run) error) (*models.Run, error) {
+			return models.UpdateRun(ctx, r.store, run, changes)
+		},
+		queryTests: func(run *models.Run) []models.TaskSetting {
+			return run.QueryTestsFrom(p.getIndex)
+		},
+		tasks: r.store,
+		owner: metav1.NewControllerRef(a01run, v1alpha1.GroupVersion.WithKind("A01Run")),
+	}
+}
+
+// mirror copies the state of the run and its Jobs to the status of the A01Run
+func (r *runReconciler) mirror(ctx context.Context, a01run *v1alpha1.A01Run, run *models.Run, err error) {
+	status := &a01run.Status
+	status.RunID = run.ID
+	status.Phase = run.Status
+	status.JobName = run.Details[common.KeyJobName]
+	fmt.Sscan(run.Details[common.KeyPublishedTasks], &status.PublishedTasks)
+
+	status.Message = ""
+	if err != nil {
+		status.Message = err.Error()
+	}
+
+	// the droids of a multi-image run are counted across the Jobs of its images
+	var active, succeeded, failed int32
+	found := false
+	for _, jobName := range run.GetJobNames() {
+		job, getErr := r.clientset.BatchV1().Jobs(a01run.Namespace).Get(ctx, jobName, metav1.GetOptions{})
+		if getErr == nil {
+			found = true
+			active += job.Status.Active
+			succeeded += job.Status.Succeeded
+			failed += job.Status.Failed
+		} else if !errors.IsNotFound(getErr) {
+			logrus.Warnf("Fail to get job %s: %s", jobName, getErr)
+		}
+	}
+
+	if found {
+		status.ActiveDroids, status.SucceededDroids, status.FailedDroids = active, succeeded, failed
+	}
+}
+
+// deleteQueue deletes the queues of a completed run
+func (r *runReconciler) deleteQueue(run *models.Run) {
+	for _, jobName := range run.GetJobNames() {
+		if _, err := r.queue.QueueDelete(jobName); err != nil {
+			logrus.Warnf("Fail to delete queue %s: %s", jobName, err)
+		}
+	}
+}
+
+// operatorCommand reconciles the A01Runs in the current namespace till the dispatcher is asked to shut down. Only
+// one operator is active at a time.
+//
+//	a01dispatcher operator [--products <dir>] [--interval <duration>]
+func operatorCommand(args []string) {
+	flags := flag.NewFlagSet("operator", flag.ExitOnError)
+	productsDir := flags.String("products", "", "The directory of the products, each in a subdirectory holding its metadata.yml and get_index. It defaults to the product of the image.")
+	interval := flags.Duration("interval", 30*time.Second, "The time between two checks of a running run. It must be shorter than half the lease duration.")
+	flags.Parse(args)
+
+	if *interval <= 0 || *interval >= lease.DefaultDuration/2 {
+		logrus.Fatalf("The interval %s must be positive and shorter than %s.", *interval, lease.DefaultDuration/2)
+	}
+
+	logging.Setup(logrus.Fields{logging.FieldPodName: getIdentity()})
+	logrus.WithFields(logrus.Fields{"version": version, "commit": sourceCommit}).Info("A01 Droid Dispatcher Operator.")
+	ctrl.SetLogger(funcr.New(func(prefix, args string) { logrus.Debug(prefix, " ", args) }, funcr.Options{}))
+
+	products, err := loadProducts(*productsDir, 1, nil)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		logrus.Fatal(err)
+	}
+
+	namespace := common.GetCurrentNamespace("a01-prod")
+	config := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
+		Scheme:                  scheme,
+		Cache:                   cache.Options{DefaultNamespaces: map[string]cache.Config{namespace: {}}},
+		Metrics:                 metricsserver.Options{BindAddress: "0"},
+		LeaderElection:          true,
+		LeaderElectionID:        "a01-operator",
+		LeaderElectionNamespace: namespace,
+	})
+	if err != nil {
+		logrus.Fatal("fail to create the manager: ", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logrus.Fatal("fail to create kubernetes client: ", err)
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+	storageConfig, err := storage.LoadConfig(ctx)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	taskBroker := schedule.CreateInClusterTaskBroker()
+	defer taskBroker.Disconnect()
+
+	identity := getIdentity()
+	r := &runReconciler{
+		client:    mgr.GetClient(),
+		clientset: clientset,
+		products:  products,
+		storage:   storageConfig,
+		store:     store.NewClientFromEnv(),
+		queue:     taskBroker,
+		identity:  identity,
+		interval:  *interval,
+
+		storeSecret: droidjob.LoadStoreSecret(ctx),
+		newLease: func(namespace string, runID int) *lease.Lease {
+			return lease.New(clientset, namespace, getLeaseName(runID), identity)
+		},
+	}
+
+	// the task broker isn't safe for concurrent use, so the runs are reconciled one at a time
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.A01Run{}).
+		Owns(&batchv1.Job{}).
+		WithOptions(ctrlcontroller.Options{MaxConcurrentReconciles: 1}).
+		Complete(r)
+	if err != nil {
+		logrus.Fatal("fail to create the controller: ", err)
+	}
+
+	metrics.Serve(fmt.Sprintf(":%d", common.PortMetrics))
+
+	err = mgr.Start(ctx)
+	r.releaseLeases(context.Background(), func(*heldLease) bool { return true })
+	if err != nil {
+		logrus.Fatal("the manager stopped: ", err)
+	}
+}
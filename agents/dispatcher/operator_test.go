@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/apis/v1alpha1"
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/lease"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testA01RunName = "nightly"
+
+// keyedStore is a fakeStore creating its run once for each idempotency key
+type keyedStore struct {
+	fakeStore
+	keys map[string]int
+}
+
+func (store *keyedStore) CreateRunWithKey(ctx context.Context, run *models.Run, key string) (*models.Run, error) {
+	if _, ok := store.keys[key]; !ok {
+		store.run = copyRun(run)
+		store.run.ID = 42
+		store.run.Version = "1"
+		store.keys[key] = store.run.ID
+	}
+	return copyRun(store.run), nil
+}
+
+func (broker *fakeQueues) QueueDelete(name string) (int, error) {
+	deleted := len(broker.queues[name])
+	delete(broker.queues, name)
+	return deleted, nil
+}
+
+type operatorTest struct {
+	reconciler *runReconciler
+	client     client.Client
+	clientset  *fake.Clientset
+	store      *keyedStore
+	queues     *fakeQueues
+}
+
+func newOperatorTest(t *testing.T) *operatorTest {
+	t.Helper()
+
+	getIndex := filepath.Join(t.TempDir(), "get_index")
+	script := "#!/bin/sh\necho '[" +
+		`{"ver": "1.0", "execution": {"command": "true"}, "classifier": {"identifier": "test_0"}},` +
+		`{"ver": "1.0", "execution": {"command": "true"}, "classifier": {"identifier": "test_1"}}` +
+		"]'\n"
+	if err := ioutil.WriteFile(getIndex, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	a01run := &v1alpha1.A01Run{
+		ObjectMeta: metav1.ObjectMeta{Name: testA01RunName, Namespace: testNamespace, UID: "a01run-uid", Generation: 1},
+		Spec: v1alpha1.A01RunSpec{
+			Product:         "azurecli",
+			Image:           "a01test.azurecr.io/azurecli:latest",
+			ImagePullSecret: "azureclidev-registry",
+			InitParallelism: 2,
+		},
+	}
+	c := ctrlfake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(a01run).
+		WithStatusSubresource(&v1alpha1.A01Run{}).
+		Build()
+
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azurecli", Namespace: testNamespace},
+		Data:       map[string][]byte{"owners": []byte("alice@example.com")},
+	})
+	store := &keyedStore{keys: make(map[string]int)}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	test := &operatorTest{
+		reconciler: &runReconciler{
+			client:    c,
+			clientset: clientset,
+			products: map[string]*product{"azurecli": {
+				metadata: &models.DroidMetadata{
+					Kind:    models.DroidMetadataKind,
+					Version: models.DroidMetadataV3,
+					Product: "azurecli",
+				},
+				getIndex: getIndex,
+			}},
+			storage:  storage.DefaultConfig(),
+			store:    store,
+			queue:    queues,
+			identity: "operator-a",
+			interval: 30 * time.Second,
+			newLease: func(namespace string, runID int) *lease.Lease {
+				return lease.New(clientset, namespace, getLeaseName(runID), "operator-a")
+			},
+		},
+		client:    c,
+		clientset: clientset,
+		store:     store,
+		queues:    queues,
+	}
+	t.Cleanup(func() { test.reconciler.releaseLeases(context.Background(), func(*heldLease) bool { return true }) })
+	return test
+}
+
+// reconcile reconciles the A01Run and returns its status
+func (test *operatorTest) reconcile(t *testing.T) (ctrl.Result, v1alpha1.A01RunStatus) {
+	t.Helper()
+
+	name := types.NamespacedName{Namespace: testNamespace, Name: testA01RunName}
+	result, err := test.reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a01run v1alpha1.A01Run
+	if err := test.client.Get(context.Background(), name, &a01run); err != nil {
+		t.Fatal(err)
+	}
+	return result, a01run.Status
+}
+
+func TestReconcile(t *testing.T) {
+	test := newOperatorTest(t)
+
+	_, status := test.reconcile(t)
+	if status.RunID != 42 || status.Phase != common.RunStatusInitialized || status.ObservedGeneration != 1 {
+		t.Fatalf("expect the run to be created but found %+v", status)
+	}
+	if test.store.run.Settings[common.KeyInitParallelism] != float64(2) {
+		t.Errorf("expect the spec in the run's settings but found %v", test.store.run.Settings)
+	}
+
+	_, status = test.reconcile(t)
+	if status.Phase != common.RunStatusPublished || status.PublishedTasks != 2 || len(status.JobName) == 0 {
+		t.Fatalf("expect the tasks to be published but found %+v", status)
+	}
+
+	result, status := test.reconcile(t)
+	if status.Phase != common.RunStatusRunning || status.RemainingTasks != 0 {
+		t.Fatalf("expect the run to be running but found %+v", status)
+	}
+
+	job, err := test.clientset.BatchV1().Jobs(testNamespace).Get(context.Background(), status.JobName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners := job.OwnerReferences; len(owners) != 1 || owners[0].Kind != "A01Run" || owners[0].Name != testA01RunName ||
+		owners[0].Controller == nil || !*owners[0].Controller {
+		t.Errorf("expect the job to be owned by the A01Run but found %+v", owners)
+	}
+
+	result, status = test.reconcile(t)
+	if status.Phase != common.RunStatusRunning || status.RemainingTasks != 2 || result.RequeueAfter != 30*time.Second {
+		t.Fatalf("expect the run to be checked again later but found %+v, %+v", status, result)
+	}
+
+	test.queues.queues[status.JobName] = nil
+	result, status = test.reconcile(t)
+	if status.Phase != common.RunStatusCompleted || result.RequeueAfter != 0 {
+		t.Fatalf("expect the run to be completed but found %+v, %+v", status, result)
+	}
+	if _, ok := test.queues.queues[status.JobName]; ok {
+		t.Error("expect the queue of a completed run to be deleted")
+	}
+
+	runLease, err := test.clientset.CoordinationV1().Leases(testNamespace).Get(context.Background(), getLeaseName(42), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := runLease.Spec.HolderIdentity; holder != nil && len(*holder) > 0 {
+		t.Errorf("expect the lease to be released but found %q", *holder)
+	}
+}
+
+func TestReconcileIdempotentCreate(t *testing.T) {
+	test := newOperatorTest(t)
+	test.reconcile(t)
+
+	// the status is lost as if it failed to be saved
+	var a01run v1alpha1.A01Run
+	name := types.NamespacedName{Namespace: testNamespace, Name: testA01RunName}
+	if err := test.client.Get(context.Background(), name, &a01run); err != nil {
+		t.Fatal(err)
+	}
+	a01run.Status = v1alpha1.A01RunStatus{}
+	if err := test.client.Status().Update(context.Background(), &a01run); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status := test.reconcile(t); status.RunID != 42 || len(test.store.keys) != 1 {
+		t.Errorf("expect the run to be created once but found %+v", test.store.keys)
+	}
+}
+
+func TestReconcileLeased(t *testing.T) {
+	test := newOperatorTest(t)
+	test.reconcile(t)
+
+	other := lease.New(test.clientset, testNamespace, getLeaseName(42), "dispatcher-b")
+	if acquired, err := other.TryAcquire(context.Background()); !acquired || err != nil {
+		t.Fatalf("fail to acquire the lease: %v", err)
+	}
+
+	result, status := test.reconcile(t)
+	if status.Phase != common.RunStatusInitialized || result.RequeueAfter != 30*time.Second {
+		t.Errorf("expect a run driven by another dispatcher to be left alone but found %+v", status)
+	}
+	if len(test.queues.queues) != 0 {
+		t.Errorf("expect no task published but found %v", test.queues.queues)
+	}
+}
+
+// TestReconcileHoldsLease verifies the lease of a run is renewed between the reconciliations, so it doesn't expire
+// whatever the interval, and that the run isn't driven further once the lease is lost
+func TestReconcileHoldsLease(t *testing.T) {
+	test := newOperatorTest(t)
+	test.reconciler.newLease = func(namespace string, runID int) *lease.Lease {
+		runLease := lease.New(test.clientset, namespace, getLeaseName(runID), "operator-a")
+		runLease.RetryPeriod = 10 * time.Millisecond
+		return runLease
+	}
+	test.reconcile(t)
+	test.reconcile(t)
+
+	getRenewTime := func() time.Time {
+		runLease, err := test.clientset.CoordinationV1().Leases(testNamespace).Get(context.Background(), getLeaseName(42), metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runLease.Spec.RenewTime.Time
+	}
+
+	renewed := getRenewTime()
+	time.Sleep(50 * time.Millisecond)
+	if !getRenewTime().After(renewed) {
+		t.Error("expect the lease to be renewed in the background")
+	}
+
+	// the lease is lost to dispatcher-b, which holds it
+	test.reconciler.heldLock.Lock()
+	test.reconciler.held[42].cancel()
+	test.reconciler.heldLock.Unlock()
+	time.Sleep(30 * time.Millisecond) // let a renewal in flight finish
+	leases := test.clientset.CoordinationV1().Leases(testNamespace)
+	runLease, err := leases.Get(context.Background(), getLeaseName(42), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, now := "dispatcher-b", metav1.NewMicroTime(time.Now())
+	runLease.Spec.HolderIdentity, runLease.Spec.RenewTime = &holder, &now
+	if _, err := leases.Update(context.Background(), runLease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status := test.reconcile(t); status.Phase != common.RunStatusPublished {
+		t.Errorf("expect a run whose lease is lost to be left alone but found %+v", status)
+	}
+}
+
+// TestReconcileRequeuesFailure verifies a failed phase is retried after the interval rather than with the backoff of
+// the controller, which could let the lease expire
+func TestReconcileRequeuesFailure(t *testing.T) {
+	test := newOperatorTest(t)
+	test.reconcile(t)
+
+	test.store.failAt = test.store.submits + 1
+	result, status := test.reconcile(t)
+	if result.RequeueAfter != 30*time.Second || status.Phase != common.RunStatusInitialized || len(status.Message) == 0 {
+		t.Errorf("expect the failed phase to be retried after the interval but found %+v, %+v", result, status)
+	}
+}
+
+func TestReconcileDeleted(t *testing.T) {
+	test := newOperatorTest(t)
+	test.reconcile(t)
+	test.reconcile(t)
+
+	var a01run v1alpha1.A01Run
+	name := types.NamespacedName{Namespace: testNamespace, Name: testA01RunName}
+	if err := test.client.Get(context.Background(), name, &a01run); err != nil {
+		t.Fatal(err)
+	}
+	if err := test.client.Delete(context.Background(), &a01run); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := test.reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: name}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := lease.New(test.clientset, testNamespace, getLeaseName(42), "dispatcher-b")
+	if acquired, err := other.TryAcquire(context.Background()); !acquired || err != nil {
+		t.Errorf("expect the lease of a deleted A01Run to be released: %v", err)
+	}
+}
+
+func TestReconcileAbandonedLease(t *testing.T) {
+	test := newOperatorTest(t)
+	test.reconcile(t)
+
+	// dispatcher-b acquired the lease and stopped renewing it, e.g. it crashed
+	abandoned := metav1.NewMicroTime(time.Now().Add(-lease.DefaultDuration - time.Second))
+	holder, duration := "dispatcher-b", int32(lease.DefaultDuration/time.Second)
+	_, err := test.clientset.CoordinationV1().Leases(testNamespace).Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: getLeaseName(42), Namespace: testNamespace},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &abandoned,
+			RenewTime:            &abandoned,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status := test.reconcile(t); status.Phase != common.RunStatusPublished {
+		t.Errorf("expect the operator to take over an abandoned lease but found %+v", status)
+	}
+
+	runLease, err := test.clientset.CoordinationV1().Leases(testNamespace).Get(context.Background(), getLeaseName(42), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := runLease.Spec.HolderIdentity; holder == nil || *holder != "operator-a" {
+		t.Errorf("expect operator-a to hold the lease but found %v", holder)
+	}
+}
+
+func TestReconcileUnknownProduct(t *testing.T) {
+	test := newOperatorTest(t)
+	delete(test.reconciler.products, "azurecli")
+
+	if _, status := test.reconcile(t); status.RunID != 0 || status.Message != "unknown product azurecli" {
+		t.Errorf("expect no run created for an unknown product but found %+v", status)
+	}
+}
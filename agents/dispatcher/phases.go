@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/monitor"
+	"github.com/Azure/adx-automation-agent/sdk/outbox"
+	"github.com/Azure/adx-automation-agent/sdk/reportutils"
+	"github.com/Azure/adx-automation-agent/sdk/schedule"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// taskQueue is the part of the task broker the dispatcher uses. It is implemented by schedule.TaskBroker.
+type taskQueue interface {
+	monitor.Queues
+	QueuePurge(name string) (int, error)
+	PublishTasksContext(ctx context.Context, queueName string, settings []models.TaskSetting) (int, error)
+}
+
+// budgetRetryInterval is the time between two attempts to create a Job while the product's budget is used up
+var budgetRetryInterval = time.Minute
+
+// The phases below are idempotent. The dispatcher may stop at any point, and the dispatcher started after it resumes
+// from the run's status without publishing the tasks twice or creating a second Job.
+
+// getJobName returns the name of the run's job, which is also the name of its task queue. The name is derived from
+// the run, so a restarted dispatcher finds the queue and the Job of the previous one.
+func getJobName(product string, runID int) string {
+	return fmt.Sprintf("%s-%d", product, runID)
+}
+
+// drive moves the run through the phases from its current status till it is completed. A run stopped in any phase is
+// resumed. The run is returned as is if it is already completed or canceled.
+func (d *dispatcher) drive(ctx context.Context, run *models.Run) (*models.Run, error) {
+	d.observeRun(ctx, run)
+
+	var err error
+	if run.Status == common.RunStatusInitialized || len(run.Status) == 0 {
+		ctx, span := tracing.Start(ctx, "publish")
+		logrus.Info(run)
+
+		run, err = d.publish(ctx, run)
+		tracing.End(span, err)
+		if err != nil {
+			return nil, err
+		}
+		d.observeRun(ctx, run)
+	}
+
+	if run.Status == common.RunStatusPublished {
+		jobName := run.Details[common.KeyJobName]
+		ctx, span := tracing.Start(ctx, "create_job", trace.WithAttributes(tracing.AttributeJobName.String(jobName)))
+
+		// creates a kubernete job to manage test droid. The job waits while the product's budget is used up.
+		started, err := d.startJob(ctx, run)
+		for isBudgetExhausted(err) {
+			logrus.Infof("%s. Retry in %s.", err, budgetRetryInterval)
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(budgetRetryInterval):
+				started, err = d.startJob(ctx, run)
+			}
+		}
+		tracing.End(span, err)
+		if err != nil {
+			return nil, err
+		}
+		run = started
+		d.observeRun(ctx, run)
+	}
+
+	if run.Status == common.RunStatusRunning {
+		// begin monitoring the job status till the end
+		monitorCtx, span := tracing.Start(ctx, "monitor")
+		err = monitor.WaitTasksContext(monitorCtx, d.client, d.namespace, d.queue, run)
+		tracing.End(span, err)
+		if err != nil {
+			return nil, fmt.Errorf("stop monitoring the tasks: %s", err.Error())
+		}
+
+		ctx, span := tracing.Start(ctx, "report")
+		run, err = d.report(ctx, run)
+		tracing.End(span, err)
+		if err != nil {
+			return nil, err
+		}
+		d.observeRun(ctx, run)
+	}
+
+	return run, nil
+}
+
+// report reports the results of a run whose tasks are all done and moves the run to the Completed status
+func (d *dispatcher) report(ctx context.Context, run *models.Run) (*models.Run, error) {
+	// commit the task results and upload the artifacts the droids failed to before they exited. The outboxes are
+	// only reachable when the droids share the artifacts storage.
+	storageConfig := d.storage
+	if storageConfig == nil {
+		storageConfig = storage.DefaultConfig()
+	}
+	if d.metadata.Storage && storageConfig.SharesArtifacts() {
+		remaining, err := outbox.ReconcileContext(ctx, run.ID, storageConfig.NewUploader())
+		if err != nil {
+			logrus.Errorf("Failed to reconcile the outboxes. %d entry(s) remain: %s", remaining, err)
+		}
+	}
+
+	owners, templateURL, err := d.getReportSettings(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+
+	imageResults := d.countImageResults(ctx, run)
+	if len(imageResults) > 0 {
+		run = run.Copy()
+		run.Details[common.KeyImageResults] = imageResults
+	}
+
+	reportutils.RefreshPowerBIContext(ctx, run, run.GetSecretName(d.metadata))
+	reportutils.ReportContext(ctx, run, owners, templateURL)
+
+	run, err = d.update(ctx, run, func(run *models.Run) error {
+		if err := checkCanceled(run); err != nil {
+			return err
+		}
+		run.Status = common.RunStatusCompleted
+		if len(imageResults) > 0 {
+			run.Details[common.KeyImageResults] = imageResults
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to update the run: %s", err.Error())
+	}
+
+	return run, nil
+}
+
+// countImageResults returns the JSON form of the results of a multi-image run's tasks by image. It returns an empty
+// string if the run tests a single image or its tasks can't be listed.
+func (d *dispatcher) countImageResults(ctx context.Context, run *models.Run) string {
+	if images, _ := run.GetImages(); len(images) == 0 || d.tasks == nil {
+		return ""
+	}
+
+	tasks, err := d.tasks.ListAllTasks(ctx, run.ID)
+	if err != nil {
+		logrus.Warnf("Fail to list the tasks. The results are not reported by image: %s", err)
+		return ""
+	}
+
+	results := models.CountImageResults(tasks)
+	for _, image := range results.Images() {
+		logrus.Infof("Image %s: %v.", image, results[image])
+	}
+	return results.String()
+}
+
+// observeRun records the run's status in the metrics labelled by the context, and calls observe if set
+func (d *dispatcher) observeRun(ctx context.Context, run *models.Run) {
+	metrics.SetRunStatusContext(ctx, run.Status)
+	if d.observe != nil {
+		d.observe(run)
+	}
+}
+
+// publish publishes the tasks of an initialized run and moves the run to the Published status. The job name is stored
+// in the run before any task is published.
+func (d *dispatcher) publish(ctx context.Context, run *models.Run) (*models.Run, error) {
+	jobName := run.Details[common.KeyJobName]
+	if len(jobName) == 0 || run.Details[common.KeyProduct] != d.metadata.Product {
+		if len(jobName) == 0 {
+			jobName = getJobName(d.metadata.Product, run.ID)
+		}
+
+		var err error
+		run, err = d.update(ctx, run, func(run *models.Run) error {
+			if err := checkCanceled(run); err != nil {
+				return err
+			}
+			run.Details[common.KeyProduct] = d.metadata.Product
+			run.Details[common.KeyJobName] = jobName
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fail to update the run: %s", err.Error())
+		}
+	}
+
+	units, err := d.getUnits(run)
+	if err != nil {
+		return nil, err
+	}
+
+	published := make(map[string]string, len(units))
+	for _, unit := range units {
+		tasks, err := unit.tasks(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := d.ensurePublished(ctx, run, unit.jobName, tasks, -1)
+		if err != nil {
+			return nil, err
+		}
+		published[unit.publishedKey()] = strconv.Itoa(count)
+	}
+
+	run, err = d.update(ctx, run, func(run *models.Run) error {
+		if err := checkCanceled(run); err != nil {
+			return err
+		}
+		run.Status = common.RunStatusPublished
+		for key, value := range published {
+			run.Details[key] = value
+		}
+		countPublished(run, units)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to update the run: %s", err.Error())
+	}
+
+	return run, nil
+}
+
+// startJob creates the Jobs of a published run and moves the run to the Running status. If a Job doesn't exist yet,
+// its queue is verified against the number of published tasks first.
+func (d *dispatcher) startJob(ctx context.Context, run *models.Run) (*models.Run, error) {
+	if len(run.Details[common.KeyJobName]) == 0 {
+		return nil, fmt.Errorf("run %d is published without a job name", run.ID)
+	}
+
+	units, err := d.getUnits(run)
+	if err != nil {
+		return nil, err
+	}
+
+	published := make(map[string]string, len(units))
+	for _, unit := range units {
+		job, err := d.getTaskJob(ctx, unit.run, unit.jobName)
+		if err != nil {
+			return nil, err
+		} else if job != nil {
+			logrus.Infof("Job %s already exists. It is adopted.", unit.jobName)
+			continue
+		}
+
+		// runs published by earlier versions don't record the number of tasks
+		if expected, err := strconv.Atoi(run.Details[unit.publishedKey()]); err == nil {
+			tasks, err := unit.tasks(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			count, err := d.ensurePublished(ctx, run, unit.jobName, tasks, expected)
+			if err != nil {
+				return nil, err
+			}
+			published[unit.publishedKey()] = strconv.Itoa(count)
+		}
+
+		metadata, err := unit.metadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// the Job of an image is rendered from the image's metadata
+		unitDispatcher := *d
+		unitDispatcher.metadata = metadata
+		if _, err := unitDispatcher.createTaskJob(ctx, unit.run, unit.jobName); err != nil {
+			return nil, err
+		}
+	}
+
+	run, err = d.update(ctx, run, func(run *models.Run) error {
+		if err := checkCanceled(run); err != nil {
+			return err
+		}
+		run.Status = common.RunStatusRunning
+		for key, value := range published {
+			run.Details[key] = value
+		}
+		countPublished(run, units)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to update the run: %s", err.Error())
+	}
+
+	return run, nil
+}
+
+// checkCanceled returns an error if the run was canceled, so the dispatcher doesn't overwrite the canceled status
+func checkCanceled(run *models.Run) error {
+	if run.Status == common.RunStatusCanceled {
+		return fmt.Errorf("run %d is canceled", run.ID)
+	}
+	return nil
+}
+
+// ensurePublished makes sure the queue holds all the given tasks and returns their number. A queue holding the
+// expected number of tasks is used as is. Otherwise the queue is purged and the tasks are published again. If expected
+// is negative, the number of the given tasks is expected. It must not be called once the Job exists, because the
+// droids consume the queue.
+func (d *dispatcher) ensurePublished(ctx context.Context, run *models.Run, jobName string, tasks []models.TaskSetting, expected int) (int, error) {
+	if expected < 0 {
+		expected = len(tasks)
+	}
+
+	if queue, err := d.queue.QueueInspect(jobName); err != nil && !schedule.IsQueueNotFound(err) {
+		return 0, fmt.Errorf("fail to inspect queue %s: %s", jobName, err.Error())
+	} else if err == nil {
+		if queue.Messages == expected {
+			logrus.Infof("Queue %s holds the %d tasks.", jobName, expected)
+			return expected, nil
+		}
+
+		if queue.Messages > 0 {
+			logrus.Warnf("Queue %s holds %d of %d tasks. The tasks are published again.", jobName, queue.Messages, expected)
+			if _, err := d.queue.QueuePurge(jobName); err != nil {
+				return 0, fmt.Errorf("fail to purge queue %s: %s", jobName, err.Error())
+			}
+		}
+	}
+
+	published, err := d.queue.PublishTasksContext(ctx, jobName, tasks)
+	if err != nil {
+		return 0, fmt.Errorf("fail to publish tasks to the task broker: %s", err.Error())
+	}
+
+	return published, nil
+}
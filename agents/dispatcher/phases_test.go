@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/streadway/amqp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testTasks = 5
+
+var errCrash = errors.New("the dispatcher stopped")
+
+// fakeStore keeps the run as the task store does. The submission of the given number fails, as if the dispatcher
+// stopped before the change was stored. A run of another version than the stored one is refused.
+type fakeStore struct {
+	run     *models.Run
+	submits int
+	failAt  int
+	tasks   []models.TaskResult
+}
+
+func (store *fakeStore) GetRun(ctx context.Context, runID int) (*models.Run, error) {
+	return copyRun(store.run), nil
+}
+
+func (store *fakeStore) UpdateRun(ctx context.Context, run *models.Run) (*models.Run, error) {
+	store.submits++
+	if store.submits == store.failAt {
+		return nil, errCrash
+	}
+	if run.Version != store.run.Version {
+		return nil, &models.ConflictError{RunID: run.ID, Version: run.Version}
+	}
+
+	store.change(func(stored *models.Run) { *stored = *copyRun(run) })
+	return copyRun(store.run), nil
+}
+
+func (store *fakeStore) ListAllTasks(ctx context.Context, runID int) ([]models.TaskResult, error) {
+	return store.tasks, nil
+}
+
+func (store *fakeStore) update(ctx context.Context, run *models.Run, changes func(*models.Run) error) (*models.Run, error) {
+	return models.UpdateRun(ctx, store, run, changes)
+}
+
+// change changes the stored run and moves it to the next version
+func (store *fakeStore) change(changes func(*models.Run)) {
+	version, _ := strconv.Atoi(store.run.Version)
+	changes(store.run)
+	store.run.Version = strconv.Itoa(version + 1)
+}
+
+func copyRun(run *models.Run) *models.Run {
+	return run.Copy()
+}
+
+// fakeQueues keeps the identifiers of the tasks in each queue. Publishing fails once the given number of tasks is
+// published, as if the dispatcher stopped while publishing. The next inspection fails with inspectErr if set.
+type fakeQueues struct {
+	queues     map[string][]string
+	failAfter  int
+	inspectErr error
+}
+
+func (broker *fakeQueues) QueueInspect(name string) (amqp.Queue, error) {
+	if err := broker.inspectErr; err != nil {
+		broker.inspectErr = nil
+		return amqp.Queue{}, err
+	}
+
+	tasks, ok := broker.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	return amqp.Queue{Name: name, Messages: len(tasks)}, nil
+}
+
+func (broker *fakeQueues) QueuePurge(name string) (int, error) {
+	purged := len(broker.queues[name])
+	broker.queues[name] = nil
+	return purged, nil
+}
+
+func (broker *fakeQueues) PublishTasksContext(ctx context.Context, queueName string, settings []models.TaskSetting) (int, error) {
+	published := 0
+	for _, setting := range settings {
+		if broker.failAfter > 0 && published == broker.failAfter {
+			broker.failAfter = 0
+			return published, errCrash
+		}
+		broker.queues[queueName] = append(broker.queues[queueName], setting.GetIdentifier())
+		published++
+	}
+	if _, ok := broker.queues[queueName]; !ok {
+		broker.queues[queueName] = []string{}
+	}
+	return published, nil
+}
+
+func queryTestTasks(run *models.Run) (tasks []models.TaskSetting) {
+	for i := 0; i < testTasks; i++ {
+		tasks = append(tasks, models.TaskSetting{Classifier: map[string]string{"identifier": fmt.Sprintf("test_%d", i)}})
+	}
+	return
+}
+
+// dispatch runs the phases the way the dispatcher's main does till the run is running
+func dispatch(d *dispatcher, run *models.Run) (*models.Run, error) {
+	var err error
+	if run.Status == common.RunStatusInitialized || len(run.Status) == 0 {
+		if run, err = d.publish(context.Background(), run); err != nil {
+			return nil, err
+		}
+	}
+
+	if run.Status == common.RunStatusPublished {
+		if run, err = d.startJob(context.Background(), run); err != nil {
+			return nil, err
+		}
+	}
+
+	return run, nil
+}
+
+func newPhaseTestDispatcher(client *fake.Clientset, store *fakeStore, queues *fakeQueues) *dispatcher {
+	d, _ := newTestDispatcher()
+	d.client = client
+	d.queue = queues
+	d.update = store.update
+	d.queryTests = queryTestTasks
+	return d
+}
+
+// TestResumption stops the dispatcher at each point of the publish and create_job phases, starts a new one from the
+// stored run and verifies it ends with one Job and one copy of each task.
+func TestResumption(t *testing.T) {
+	cases := []struct {
+		name  string
+		crash func(client *fake.Clientset, store *fakeStore, queues *fakeQueues)
+	}{
+		{
+			name: "before storing the job name",
+			crash: func(client *fake.Clientset, store *fakeStore, queues *fakeQueues) {
+				store.failAt = 1
+			},
+		},
+		{
+			name: "while publishing",
+			crash: func(client *fake.Clientset, store *fakeStore, queues *fakeQueues) {
+				queues.failAfter = 2
+			},
+		},
+		{
+			name: "before storing the published status",
+			crash: func(client *fake.Clientset, store *fakeStore, queues *fakeQueues) {
+				store.failAt = 2
+			},
+		},
+		{
+			name: "before creating the job",
+			crash: func(client *fake.Clientset, store *fakeStore, queues *fakeQueues) {
+				client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					client.ReactionChain = client.ReactionChain[1:]
+					return true, nil, errCrash
+				})
+			},
+		},
+		{
+			name: "before storing the running status",
+			crash: func(client *fake.Clientset, store *fakeStore, queues *fakeQueues) {
+				store.failAt = 3
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+			queues := &fakeQueues{queues: make(map[string][]string)}
+			c.crash(client, store, queues)
+
+			if _, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run)); err == nil {
+				t.Fatal("expect the first dispatcher to stop")
+			}
+
+			run, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run))
+			if err != nil {
+				t.Fatalf("expect the second dispatcher to resume but found error %s", err)
+			}
+
+			assertDispatched(t, client, store, queues, run)
+		})
+	}
+}
+
+// TestResumptionQueueLost verifies the tasks are published again if the queue lost its tasks before the Job is created
+func TestResumptionQueueLost(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		client.ReactionChain = client.ReactionChain[1:]
+		return true, nil, errCrash
+	})
+	if _, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run)); err == nil {
+		t.Fatal("expect the first dispatcher to stop")
+	}
+
+	queues.queues["azurecli-42"] = queues.queues["azurecli-42"][:3]
+
+	run, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run))
+	if err != nil {
+		t.Fatalf("expect the second dispatcher to resume but found error %s", err)
+	}
+
+	assertDispatched(t, client, store, queues, run)
+}
+
+// TestResumptionInspectFailure verifies the tasks aren't published again if the queue holding them fails to be
+// inspected
+func TestResumptionInspectFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		client.ReactionChain = client.ReactionChain[1:]
+		return true, nil, errCrash
+	})
+	if _, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run)); err == nil {
+		t.Fatal("expect the first dispatcher to stop")
+	}
+
+	queues.inspectErr = errors.New("connection reset by peer")
+	if _, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run)); err == nil {
+		t.Fatal("expect the second dispatcher to stop")
+	}
+
+	run, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run))
+	if err != nil {
+		t.Fatalf("expect the third dispatcher to resume but found error %s", err)
+	}
+
+	assertDispatched(t, client, store, queues, run)
+}
+
+func TestResumptionRunning(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	run, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run))
+	if err != nil {
+		t.Fatal(err)
+	}
+	submits := store.submits
+
+	if run, err = dispatch(newPhaseTestDispatcher(client, store, queues), run); err != nil {
+		t.Fatal(err)
+	}
+	if store.submits != submits {
+		t.Errorf("expect a running run to be left as is but it was submitted %d times", store.submits-submits)
+	}
+
+	assertDispatched(t, client, store, queues, run)
+}
+
+// TestConcurrentChange verifies the changes made to the run by others while the dispatcher publishes are kept
+func TestConcurrentChange(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	d := newPhaseTestDispatcher(client, store, queues)
+	d.queryTests = func(run *models.Run) []models.TaskSetting {
+		store.change(func(stored *models.Run) { stored.Details[common.KeyRemark] = "official" })
+		return queryTestTasks(run)
+	}
+
+	run, err := dispatch(d, copyRun(store.run))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.run.Details[common.KeyRemark] != "official" || run.Details[common.KeyRemark] != "official" {
+		t.Errorf("expect the concurrent change to be kept but found %v", store.run.Details)
+	}
+
+	assertDispatched(t, client, store, queues, run)
+}
+
+func TestConcurrentCancel(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	d := newPhaseTestDispatcher(client, store, queues)
+	d.queryTests = func(run *models.Run) []models.TaskSetting {
+		store.change(func(stored *models.Run) { stored.Status = common.RunStatusCanceled })
+		return queryTestTasks(run)
+	}
+
+	if _, err := dispatch(d, copyRun(store.run)); err == nil {
+		t.Fatal("expect the dispatcher to stop when the run is canceled")
+	}
+	if store.run.Status != common.RunStatusCanceled {
+		t.Errorf("expect the run to stay canceled but found %s", store.run.Status)
+	}
+	if jobs, _ := client.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{}); len(jobs.Items) != 0 {
+		t.Errorf("expect no job created but found %d", len(jobs.Items))
+	}
+}
+
+func assertDispatched(t *testing.T, client *fake.Clientset, store *fakeStore, queues *fakeQueues, run *models.Run) {
+	t.Helper()
+
+	if run.Status != common.RunStatusRunning || store.run.Status != common.RunStatusRunning {
+		t.Errorf("expect the run to be running but found %s", store.run.Status)
+	}
+
+	jobName := store.run.Details[common.KeyJobName]
+	if jobName != "azurecli-42" {
+		t.Errorf("expect the deterministic job name but found %q", jobName)
+	}
+	if published := store.run.Details[common.KeyPublishedTasks]; published != fmt.Sprint(testTasks) {
+		t.Errorf("expect %d published tasks but found %s", testTasks, published)
+	}
+
+	jobs, err := client.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 1 || jobs.Items[0].Name != jobName {
+		t.Errorf("expect job %s only but found %d jobs", jobName, len(jobs.Items))
+	}
+
+	if len(queues.queues) != 1 {
+		t.Errorf("expect one queue but found %d", len(queues.queues))
+	}
+	tasks := make(map[string]bool)
+	for _, task := range queues.queues[jobName] {
+		if tasks[task] {
+			t.Errorf("task %s is published twice", task)
+		}
+		tasks[task] = true
+	}
+	if len(tasks) != testTasks {
+		t.Errorf("expect %d tasks in the queue but found %d", testTasks, len(tasks))
+	}
+}
+
+// TestPriorityClass verifies the priority of a run is carried by the PriorityClass of its droid pods
+func TestPriorityClass(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	store.run.Settings[common.KeyPriority] = models.RunPriorityHigh
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	if _, err := dispatch(newPhaseTestDispatcher(client, store, queues), copyRun(store.run)); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := client.BatchV1().Jobs(testNamespace).Get(context.Background(), "azurecli-42", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class := job.Spec.Template.Spec.PriorityClassName; class != models.PriorityClassName(models.RunPriorityHigh) {
+		t.Errorf("expect the droids of a high priority run to use its PriorityClass but found %q", class)
+	}
+}
+
+// TestDriveWaitsForBudget verifies the Job of a run is created once the product's other runs leave room in the budget
+func TestDriveWaitsForBudget(t *testing.T) {
+	defer func(interval time.Duration) { budgetRetryInterval = interval }(budgetRetryInterval)
+	budgetRetryInterval = 10 * time.Millisecond
+
+	other := newBudgetJob("azurecli-40", "azurecli", 4, false)
+	client := fake.NewSimpleClientset(newSystemConfig(map[string]string{"droid.budget": "4"}), other)
+	store := &fakeStore{run: &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+	d := newPhaseTestDispatcher(client, store, queues)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		finished := newBudgetJob("azurecli-40", "azurecli", 4, true)
+		client.BatchV1().Jobs(testNamespace).Update(context.Background(), finished, metav1.UpdateOptions{})
+	}()
+
+	// the run is left running once the Job is created
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	d.drive(ctx, copyRun(store.run))
+
+	if store.run.Status != common.RunStatusRunning {
+		t.Fatalf("expect the run to be running but found %s", store.run.Status)
+	}
+	job, err := client.BatchV1().Jobs(testNamespace).Get(context.Background(), "azurecli-42", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *job.Spec.Parallelism != 4 {
+		t.Errorf("expect the requested parallelism but found %d", *job.Spec.Parallelism)
+	}
+}
+
+// newMultiImageRun returns a run testing the product in two images
+func newMultiImageRun() *models.Run {
+	run := &models.Run{ID: 42, Settings: newTestRun().Settings, Details: map[string]string{}}
+	run.Settings[common.KeyImages] = `[
+		{"name": "py36", "image": "a01test.azurecr.io/azurecli:py36"},
+		{"name": "py39", "image": "a01test.azurecr.io/azurecli:py39", "imagePullSecret": "py39-registry"}
+	]`
+	return run
+}
+
+// inspectTestImage returns the metadata of the dispatcher's product and the tasks of queryTestTasks for each image,
+// and counts the inspections by image
+func inspectTestImage(d *dispatcher, inspections map[string]int) func(context.Context, *models.Run, models.RunImage) (*models.DroidMetadata, []models.TaskSetting, error) {
+	return func(ctx context.Context, run *models.Run, image models.RunImage) (*models.DroidMetadata, []models.TaskSetting, error) {
+		inspections[image.Name]++
+		metadata := *d.metadata
+		return &metadata, queryTestTasks(run), nil
+	}
+}
+
+func TestMultiImage(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: newMultiImageRun()}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+	inspections := make(map[string]int)
+
+	d := newPhaseTestDispatcher(client, store, queues)
+	d.inspectImage = inspectTestImage(d, inspections)
+
+	run, err := dispatch(d, copyRun(store.run))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if run.Status != common.RunStatusRunning {
+		t.Errorf("expect the run to be running but found %s", run.Status)
+	}
+	if published := run.Details[common.KeyPublishedTasks]; published != fmt.Sprint(2*testTasks) {
+		t.Errorf("expect %d published tasks but found %s", 2*testTasks, published)
+	}
+	if inspections["py36"] != 1 || inspections["py39"] != 1 {
+		t.Errorf("expect each image to be inspected once but found %v", inspections)
+	}
+
+	for name, pullSecret := range map[string]string{"py36": "azureclidev-registry", "py39": "py39-registry"} {
+		jobName := "azurecli-42-" + name
+		if len(queues.queues[jobName]) != testTasks {
+			t.Errorf("expect %d tasks in queue %s but found %d", testTasks, jobName, len(queues.queues[jobName]))
+		}
+		if published := run.Details[common.KeyPublishedTasks+"."+name]; published != fmt.Sprint(testTasks) {
+			t.Errorf("expect %d tasks published for image %s but found %s", testTasks, name, published)
+		}
+
+		job, err := client.BatchV1().Jobs(testNamespace).Get(context.Background(), jobName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("expect job %s: %s", jobName, err)
+		}
+		pod := job.Spec.Template.Spec
+		if image := pod.Containers[0].Image; image != "a01test.azurecr.io/azurecli:"+name {
+			t.Errorf("expect job %s to run image %s but found %s", jobName, name, image)
+		}
+		if pod.ImagePullSecrets[0].Name != pullSecret {
+			t.Errorf("expect job %s to pull with %s but found %s", jobName, pullSecret, pod.ImagePullSecrets[0].Name)
+		}
+		if job.Labels["image"] != name {
+			t.Errorf("expect job %s to be labeled with its image but found %v", jobName, job.Labels)
+		}
+	}
+
+	if jobs, _ := client.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{}); len(jobs.Items) != 2 {
+		t.Errorf("expect one job per image but found %d", len(jobs.Items))
+	}
+}
+
+// TestMultiImageResumption verifies a dispatcher stopped between the Jobs of two images adopts the first Job and
+// creates the second one without publishing the tasks again
+func TestMultiImageResumption(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: newMultiImageRun()}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+	inspections := make(map[string]int)
+
+	creates := 0
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if creates++; creates == 2 {
+			return true, nil, errCrash
+		}
+		return false, nil, nil
+	})
+
+	d := newPhaseTestDispatcher(client, store, queues)
+	d.inspectImage = inspectTestImage(d, inspections)
+	if _, err := dispatch(d, copyRun(store.run)); err == nil {
+		t.Fatal("expect the first dispatcher to stop")
+	}
+
+	d = newPhaseTestDispatcher(client, store, queues)
+	d.inspectImage = inspectTestImage(d, inspections)
+	run, err := dispatch(d, copyRun(store.run))
+	if err != nil {
+		t.Fatalf("expect the second dispatcher to resume but found error %s", err)
+	}
+
+	if run.Status != common.RunStatusRunning {
+		t.Errorf("expect the run to be running but found %s", run.Status)
+	}
+	if jobs, _ := client.BatchV1().Jobs(testNamespace).List(context.Background(), metav1.ListOptions{}); len(jobs.Items) != 2 {
+		t.Errorf("expect one job per image but found %d", len(jobs.Items))
+	}
+	for _, jobName := range []string{"azurecli-42-py36", "azurecli-42-py39"} {
+		if len(queues.queues[jobName]) != testTasks {
+			t.Errorf("expect %d tasks in queue %s but found %d", testTasks, jobName, len(queues.queues[jobName]))
+		}
+	}
+	if inspections["py36"] != 1 || inspections["py39"] != 2 {
+		t.Errorf("expect only the image without a job to be inspected again but found %v", inspections)
+	}
+}
+
+func TestMultiImageOtherProduct(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := &fakeStore{run: newMultiImageRun()}
+	queues := &fakeQueues{queues: make(map[string][]string)}
+
+	d := newPhaseTestDispatcher(client, store, queues)
+	d.inspectImage = func(ctx context.Context, run *models.Run, image models.RunImage) (*models.DroidMetadata, []models.TaskSetting, error) {
+		return &models.DroidMetadata{Product: "other"}, queryTestTasks(run), nil
+	}
+
+	if _, err := dispatch(d, copyRun(store.run)); err == nil {
+		t.Fatal("expect an image of another product to be refused")
+	}
+	if len(queues.queues) != 0 {
+		t.Errorf("expect no task published but found %d queues", len(queues.queues))
+	}
+}
+
+func TestCountImageResults(t *testing.T) {
+	store := &fakeStore{run: newMultiImageRun()}
+	for i, result := range []string{"Passed", "Failed", "Passed"} {
+		tasks := models.TagImage(queryTestTasks(store.run)[:1], []string{"py36", "py39"}[i%2])
+		store.tasks = append(store.tasks, models.TaskResult{Result: result, Settings: tasks[0]})
+	}
+
+	d, _ := newTestDispatcher()
+	d.tasks = store
+	if results := d.countImageResults(context.Background(), store.run); results != `{"py36":{"Passed":2},"py39":{"Failed":1}}` {
+		t.Errorf("unexpected results %s", results)
+	}
+
+	if results := d.countImageResults(context.Background(), newTestRun()); len(results) != 0 {
+		t.Errorf("expect the results of a single image run not to be counted but found %s", results)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// Defines the output formats of the render command
+const (
+	outputYAML = "yaml"
+	outputJSON = "json"
+)
+
+// renderCommand prints the Job the dispatcher would create for a run without creating it. The job name is the one
+// recorded in the run's details, or a placeholder if the run is not published yet.
+//
+//	a01dispatcher render --run <id> [-o yaml|json] [--metadata <path>] [--job <name>]
+func renderCommand(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	runID := flags.Int("run", -1, "The run ID")
+	output := flags.String("o", outputYAML, "The output format, yaml or json")
+	metadataPath := flags.String("metadata", common.PathMetadataYml, "The path of the droid metadata")
+	jobName := flags.String("job", "", "The job name. It defaults to the run's job name.")
+	flags.Parse(args)
+
+	if *runID == -1 {
+		logrus.Fatal("Missing runID")
+	}
+
+	metadata, err := models.ReadDroidMetadata(*metadataPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	ctx := context.Background()
+	run, err := models.QueryRunContext(ctx, *runID)
+	if err != nil {
+		logrus.Fatal("fail to query the run: ", err)
+	}
+
+	config, err := storage.LoadConfig(ctx)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if len(*jobName) == 0 {
+		*jobName = getRenderJobName(run, metadata)
+	}
+
+	job, err := droidjob.Render(run, metadata, config, droidjob.LoadStoreSecret(ctx), *jobName)
+	if err != nil {
+		logrus.Fatal("fail to render the job: ", err)
+	}
+
+	if err := writeJob(os.Stdout, job, *output); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// getRenderJobName returns the run's job name, or a placeholder if the run doesn't have one yet
+func getRenderJobName(run *models.Run, metadata *models.DroidMetadata) string {
+	if jobName, ok := run.Details[common.KeyJobName]; ok && len(jobName) > 0 {
+		return jobName
+	}
+
+	return fmt.Sprintf("%s-%d-render", metadata.Product, run.ID)
+}
+
+// writeJob writes the Job manifest in the given format
+func writeJob(w io.Writer, job *batchv1.Job, output string) error {
+	var content []byte
+	var err error
+
+	switch output {
+	case outputYAML:
+		content, err = yaml.Marshal(job)
+	case outputJSON:
+		content, err = json.MarshalIndent(job, "", "  ")
+		content = append(content, '\n')
+	default:
+		return fmt.Errorf("unknown output format %q. Supported formats are %s and %s", output, outputYAML, outputJSON)
+	}
+	if err != nil {
+		return fmt.Errorf("fail to encode the job: %s", err.Error())
+	}
+
+	_, err = w.Write(content)
+	return err
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/droidjob"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/lease"
+	"github.com/Azure/adx-automation-agent/sdk/logging"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/Azure/adx-automation-agent/sdk/store"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// schedulerLeaseName is the name of the lease held by the active scheduler
+const schedulerLeaseName = "a01scheduler"
+
+// scheduleStore lists and creates runs. It is implemented by store.Client.
+type scheduleStore interface {
+	runLister
+	CreateRunWithKey(ctx context.Context, run *models.Run, key string) (*models.Run, error)
+}
+
+// scheduled is the next activation of a schedule
+type scheduled struct {
+	cron string
+	next time.Time
+}
+
+// scheduler creates the runs of the products' schedules on time and launches their dispatchers. The schedules are
+// read from the cluster on every tick, so changes apply without a restart. Activations missed while the scheduler
+// was down are not caught up.
+type scheduler struct {
+	client    kubernetes.Interface
+	namespace string
+	products  map[string]*product
+	storage   *storage.Config
+	store     scheduleStore
+
+	// storeSecret is the secret of the store referenced by the dispatcher Jobs. It defaults to
+	// droidjob.DefaultStoreSecret().
+	storeSecret *droidjob.StoreSecret
+
+	// interval is the time between two ticks. A run is created at most one interval after its time.
+	interval time.Duration
+
+	// launch launches the dispatcher of a created run. Runs are left to a dispatcher in controller mode if it is nil.
+	launch func(ctx context.Context, run *models.Run, p *product) error
+
+	now   func() time.Time
+	state map[string]*scheduled
+}
+
+func newScheduler(client kubernetes.Interface, namespace string, products map[string]*product, runs scheduleStore) *scheduler {
+	return &scheduler{
+		client:    client,
+		namespace: namespace,
+		products:  products,
+		store:     runs,
+		interval:  30 * time.Second,
+		now:       time.Now,
+		state:     make(map[string]*scheduled),
+	}
+}
+
+// run ticks till the context is done
+func (s *scheduler) run(ctx context.Context) {
+	logrus.Infof("Schedule the runs of %d product(s).", len(s.products))
+	for {
+		s.tick(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// tick creates the runs of the schedules whose time has come
+func (s *scheduler) tick(ctx context.Context) {
+	names := make([]string, 0, len(s.products))
+	for name := range s.products {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := s.now()
+	declared := make(map[string]bool)
+	for _, name := range names {
+		schedules, err := s.loadSchedules(ctx, name)
+		if err != nil {
+			logrus.Errorf("Fail to load the schedules of %s: %s", name, err)
+			// keep the state of the schedules till they can be read again
+			for key := range s.state {
+				if strings.HasPrefix(key, name+"/") {
+					declared[key] = true
+				}
+			}
+			continue
+		}
+
+		for _, schedule := range schedules {
+			key := name + "/" + schedule.Name
+			declared[key] = true
+
+			state, ok := s.state[key]
+			if !ok || state.cron != schedule.Cron {
+				state = &scheduled{cron: schedule.Cron, next: schedule.Next(now)}
+				s.state[key] = state
+				logrus.Infof("The next run of schedule %s is at %s.", key, state.next)
+			}
+			if state.next.IsZero() || now.Before(state.next) {
+				continue
+			}
+
+			if err := s.fire(ctx, s.products[name], schedule, state.next); err != nil {
+				logrus.Errorf("Fail to create the run of schedule %s: %s", key, err)
+			}
+			state.next = schedule.Next(now)
+		}
+	}
+
+	for key := range s.state {
+		if !declared[key] {
+			delete(s.state, key)
+		}
+	}
+}
+
+// fire creates the run of the schedule due at the given time, unless the schedule's previous run is still pending
+func (s *scheduler) fire(ctx context.Context, p *product, schedule *models.RunSchedule, due time.Time) error {
+	log := logrus.WithFields(logrus.Fields{logging.FieldProduct: p.metadata.Product, "schedule": schedule.Name})
+
+	for _, status := range pendingStatuses {
+		runs, err := s.store.ListRuns(ctx, store.RunListOptions{Product: p.metadata.Product, Status: status})
+		if err != nil {
+			return fmt.Errorf("fail to list the %s runs: %s", status, err.Error())
+		}
+		for _, run := range runs {
+			if run.Details[common.KeySchedule] == schedule.Name {
+				log.Warnf("Skip the run due at %s: run %d is still %s.", due, run.ID, run.Status)
+				return nil
+			}
+		}
+	}
+
+	// a restarted scheduler doesn't create the run of the same time again
+	key := fmt.Sprintf("schedule/%s/%s/%d", p.metadata.Product, schedule.Name, due.Unix())
+	run, err := s.store.CreateRunWithKey(ctx, schedule.NewRun(p.metadata.Product, due), key)
+	if err != nil {
+		return err
+	}
+	log.WithField(logging.FieldRunID, run.ID).Infof("Created the run due at %s.", due)
+
+	if s.launch == nil {
+		return nil
+	}
+	if err := s.launch(ctx, run, p); err != nil {
+		return fmt.Errorf("fail to launch the dispatcher of run %d: %s", run.ID, err.Error())
+	}
+	return nil
+}
+
+// loadSchedules reads the schedules of the product from the product's secret and ConfigMap. Both are named after the
+// product and optional.
+func (s *scheduler) loadSchedules(ctx context.Context, name string) ([]*models.RunSchedule, error) {
+	var sources [][]byte
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		sources = append(sources, secret.Data[common.ProductSecretKeySchedules])
+	} else if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("fail to get the secret: %s", err.Error())
+	}
+
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		sources = append(sources, []byte(configMap.Data[common.ProductSecretKeySchedules]))
+	} else if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("fail to get the ConfigMap: %s", err.Error())
+	}
+
+	var result []*models.RunSchedule
+	names := make(map[string]bool)
+	for _, content := range sources {
+		schedules, err := models.ParseRunSchedules(content)
+		if err != nil {
+			return nil, err
+		}
+		for _, schedule := range schedules {
+			if names[schedule.Name] {
+				return nil, fmt.Errorf("schedule %s is declared in both the secret and the ConfigMap", schedule.Name)
+			}
+			names[schedule.Name] = true
+			result = append(result, schedule)
+		}
+	}
+
+	return result, nil
+}
+
+// launchDispatcher creates the Job running the dispatcher of the run. An existing Job is left as is.
+func (s *scheduler) launchDispatcher(ctx context.Context, run *models.Run, p *product) error {
+	job, err := droidjob.RenderDispatcher(run, p.metadata, s.storage, s.storeSecret, getLeaseName(run.ID))
+	if err != nil {
+		return fmt.Errorf("fail to render the dispatcher: %s", err.Error())
+	}
+
+	_, err = s.client.BatchV1().Jobs(s.namespace).Create(ctx, job, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// schedulerCommand creates the scheduled runs of the products till the dispatcher is asked to shut down. Only one
+// scheduler is active at a time.
+//
+//	a01dispatcher scheduler [--products <dir>] [--interval <duration>] [--launch=false]
+func schedulerCommand(args []string) {
+	flags := flag.NewFlagSet("scheduler", flag.ExitOnError)
+	productsDir := flags.String("products", "", "The directory of the products, each in a subdirectory holding its metadata.yml and get_index. It defaults to the product of the image.")
+	interval := flags.Duration("interval", 30*time.Second, "The time between two checks of the schedules")
+	launch := flags.Bool("launch", true, "Launch a dispatcher for each created run. Disable it when a dispatcher in controller mode drives the runs.")
+	flags.Parse(args)
+
+	logging.Setup(logrus.Fields{logging.FieldPodName: getIdentity()})
+	logrus.WithFields(logrus.Fields{"version": version, "commit": sourceCommit}).Info("A01 Run Scheduler.")
+
+	products, err := loadProducts(*productsDir, 1, nil)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	clientset, err := kubeutils.CreateKubeClientset()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	ctx, cancel := common.NewSignalContext()
+	defer cancel()
+
+	storageConfig, err := storage.LoadConfig(ctx)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	metrics.Serve(fmt.Sprintf(":%d", common.PortMetrics))
+
+	namespace := common.GetCurrentNamespace("a01-prod")
+	schedulerLease := lease.New(clientset, namespace, schedulerLeaseName, getIdentity())
+	if err := schedulerLease.Acquire(ctx); err != nil {
+		logrus.Fatal("fail to acquire the lease of the scheduler: ", err)
+	}
+	ctx = schedulerLease.Hold(ctx)
+	defer schedulerLease.Release(context.Background())
+
+	s := newScheduler(clientset, namespace, products, store.NewClientFromEnv())
+	s.storage = storageConfig
+	s.storeSecret = droidjob.LoadStoreSecret(ctx)
+	s.interval = *interval
+	if *launch {
+		s.launch = s.launchDispatcher
+	}
+	s.run(ctx)
+
+	if schedulerLease.Lost() {
+		logrus.Fatal("The lease of the scheduler is lost.")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/store"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testSchedules = `
+- name: nightly
+  cron: "0 3 * * *"
+  image: a01test.azurecr.io/azurecli:latest
+  imagePullSecret: azureclidev-registry
+  parallelism: 8
+  live: true
+  settings:
+    a01.reserved.remark: official
+`
+
+// scheduledRuns keeps the runs created by the scheduler
+type scheduledRuns struct {
+	runs []*models.Run
+	keys map[string]*models.Run
+}
+
+func (s *scheduledRuns) ListRuns(ctx context.Context, opts store.RunListOptions) (result []models.Run, err error) {
+	for _, run := range s.runs {
+		if run.Details[common.KeyProduct] == opts.Product && run.Status == opts.Status {
+			result = append(result, *run)
+		}
+	}
+	return result, nil
+}
+
+func (s *scheduledRuns) CreateRunWithKey(ctx context.Context, run *models.Run, key string) (*models.Run, error) {
+	if created, ok := s.keys[key]; ok {
+		return created, nil
+	}
+
+	run.ID = 100 + len(s.runs)
+	s.runs = append(s.runs, run)
+	s.keys[key] = run
+	return run, nil
+}
+
+func newTestScheduler(objects ...*corev1.Secret) (*scheduler, *scheduledRuns, *fake.Clientset, *time.Time) {
+	client := fake.NewSimpleClientset()
+	for _, object := range objects {
+		client.CoreV1().Secrets(testNamespace).Create(context.Background(), object, metav1.CreateOptions{})
+	}
+
+	runs := &scheduledRuns{keys: make(map[string]*models.Run)}
+	products := map[string]*product{"azurecli": {metadata: &models.DroidMetadata{Product: "azurecli"}}}
+	s := newScheduler(client, testNamespace, products, runs)
+
+	now := time.Date(2026, time.March, 4, 2, 59, 50, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, runs, client, &now
+}
+
+func newScheduleSecret(schedules string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azurecli", Namespace: testNamespace},
+		Data:       map[string][]byte{common.ProductSecretKeySchedules: []byte(schedules)},
+	}
+}
+
+func TestSchedulerCreatesRun(t *testing.T) {
+	s, runs, client, now := newTestScheduler(newScheduleSecret(testSchedules))
+	s.launch = s.launchDispatcher
+
+	s.tick(context.Background())
+	if len(runs.runs) != 0 {
+		t.Fatalf("expect no run before its time but found %d", len(runs.runs))
+	}
+
+	*now = now.Add(20 * time.Second)
+	s.tick(context.Background())
+	if len(runs.runs) != 1 {
+		t.Fatalf("expect the run to be created on time but found %d runs", len(runs.runs))
+	}
+
+	run := runs.runs[0]
+	if run.Settings[common.KeyRemark] != "official" || run.Settings[common.KeyLiveMode] != "True" ||
+		run.Settings[common.KeyInitParallelism] != float64(8) {
+		t.Errorf("expect the run to have the schedule's settings but found %v", run.Settings)
+	}
+	if run.Details[common.KeySchedule] != "nightly" || run.Status != common.RunStatusInitialized {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	job, err := client.BatchV1().Jobs(testNamespace).Get(context.Background(), getLeaseName(run.ID), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expect the dispatcher to be launched: %s", err)
+	}
+	if image := job.Spec.Template.Spec.Containers[0].Image; image != "a01test.azurecr.io/azurecli:latest" {
+		t.Errorf("expect the dispatcher to run in the run's image but found %s", image)
+	}
+
+	// the next run is due the next day
+	*now = now.Add(time.Hour)
+	s.tick(context.Background())
+	if len(runs.runs) != 1 {
+		t.Errorf("expect one run a day but found %d", len(runs.runs))
+	}
+}
+
+func TestSchedulerSkipsRunning(t *testing.T) {
+	s, runs, _, now := newTestScheduler(newScheduleSecret(testSchedules))
+
+	s.tick(context.Background())
+	*now = now.Add(time.Minute)
+	s.tick(context.Background())
+	runs.runs[0].Status = common.RunStatusRunning
+
+	*now = now.Add(24 * time.Hour)
+	s.tick(context.Background())
+	if len(runs.runs) != 1 {
+		t.Fatalf("expect the run to be skipped while the previous one is running but found %d runs", len(runs.runs))
+	}
+
+	runs.runs[0].Status = common.RunStatusCompleted
+	*now = now.Add(24 * time.Hour)
+	s.tick(context.Background())
+	if len(runs.runs) != 2 {
+		t.Errorf("expect the run to be created once the previous one is completed but found %d runs", len(runs.runs))
+	}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+	s, runs, client, now := newTestScheduler(newScheduleSecret(testSchedules))
+	s.tick(context.Background())
+	*now = now.Add(time.Minute)
+	s.tick(context.Background())
+
+	// a new scheduler observing the schedule after its time doesn't create the run again
+	restarted := newScheduler(client, testNamespace, s.products, runs)
+	restarted.now = s.now
+	restarted.tick(context.Background())
+	if len(runs.runs) != 1 {
+		t.Errorf("expect one run but found %d", len(runs.runs))
+	}
+}
+
+func TestSchedulerConfigMap(t *testing.T) {
+	s, runs, client, now := newTestScheduler()
+	client.CoreV1().ConfigMaps(testNamespace).Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "azurecli", Namespace: testNamespace},
+		Data:       map[string]string{common.ProductSecretKeySchedules: testSchedules},
+	}, metav1.CreateOptions{})
+
+	s.tick(context.Background())
+	*now = now.Add(time.Minute)
+	s.tick(context.Background())
+	if len(runs.runs) != 1 {
+		t.Errorf("expect the schedule in the ConfigMap to create a run but found %d runs", len(runs.runs))
+	}
+}
+
+func TestSchedulerInvalidSchedules(t *testing.T) {
+	for _, schedules := range []string{
+		"- name: nightly\n  cron: \"0 25 * * *\"\n  image: a\n  imagePullSecret: b\n",
+		"- name: nightly\n  image: a\n  imagePullSecret: b\n",
+		"- name: nightly\n  cron: \"@daily\"\n  image: a\n",
+		"- name: nightly\n  cron: \"@daily\"\n  image: a\n  imagePullSecret: b\n  livemode: true\n",
+		testSchedules + testSchedules,
+	} {
+		s, runs, _, now := newTestScheduler(newScheduleSecret(schedules))
+		s.tick(context.Background())
+		*now = now.Add(24 * time.Hour)
+		s.tick(context.Background())
+
+		if len(runs.runs) != 0 || len(s.state) != 0 {
+			t.Errorf("expect the invalid schedules to be ignored: %s", schedules)
+		}
+		if _, err := s.loadSchedules(context.Background(), "azurecli"); err == nil {
+			t.Errorf("expect an error: %s", schedules)
+		}
+	}
+}
+
+func TestSchedulerRemovedSchedule(t *testing.T) {
+	s, _, client, _ := newTestScheduler(newScheduleSecret(testSchedules))
+	s.tick(context.Background())
+	if len(s.state) != 1 {
+		t.Fatalf("expect one schedule but found %d", len(s.state))
+	}
+
+	client.CoreV1().Secrets(testNamespace).Update(context.Background(), newScheduleSecret(""), metav1.UpdateOptions{})
+	s.tick(context.Background())
+	if len(s.state) != 0 {
+		t.Errorf("expect the removed schedule to be forgotten but found %s", fmt.Sprint(s.state))
+	}
+}
+
+func TestSchedulerImages(t *testing.T) {
+	s, runs, _, now := newTestScheduler(newScheduleSecret(testSchedules + `  images:
+  - name: py36
+    image: a01test.azurecr.io/azurecli:py36
+  - name: py39
+    image: a01test.azurecr.io/azurecli:py39
+    imagePullSecret: py39-registry
+`))
+
+	s.tick(context.Background())
+	*now = now.Add(time.Minute)
+	s.tick(context.Background())
+	if len(runs.runs) != 1 {
+		t.Fatalf("expect one run but found %d", len(runs.runs))
+	}
+
+	images, err := runs.runs[0].GetImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[1].Image != "a01test.azurecr.io/azurecli:py39" || images[1].ImagePullSecret != "py39-registry" {
+		t.Errorf("expect the run to test the schedule's images but found %v", images)
+	}
+
+	if _, err := models.ParseRunSchedules([]byte(testSchedules + "  images:\n  - name: Py36\n    image: a\n")); err == nil {
+		t.Error("expect an invalid image name to be refused")
+	}
+}
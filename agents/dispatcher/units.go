@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+)
+
+// jobUnit is a task queue and the Job whose droids consume it. A run has a single unit, unless it is a multi-image run,
+// which has one unit for each of its images.
+type jobUnit struct {
+	// run is the run as seen by the unit's droids
+	run     *models.Run
+	jobName string
+
+	// image is the name of the unit's image, or empty if the run tests a single image
+	image string
+
+	metadata func(ctx context.Context) (*models.DroidMetadata, error)
+	tasks    func(ctx context.Context) ([]models.TaskSetting, error)
+}
+
+// publishedKey returns the run detail recording the number of tasks published to the unit's queue
+func (unit *jobUnit) publishedKey() string {
+	if len(unit.image) == 0 {
+		return common.KeyPublishedTasks
+	}
+	return common.KeyPublishedTasks + "." + unit.image
+}
+
+// inspectedImage is the metadata and the tasks of an image of a multi-image run
+type inspectedImage struct {
+	metadata *models.DroidMetadata
+	tasks    []models.TaskSetting
+}
+
+// getUnits returns the units of the run. The run must have a job name. The images of a multi-image run are inspected
+// once by the dispatcher, when their metadata or tasks are first needed, and the tasks are tagged with their image.
+func (d *dispatcher) getUnits(run *models.Run) ([]*jobUnit, error) {
+	jobName := run.Details[common.KeyJobName]
+	images, err := run.GetImages()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return []*jobUnit{{
+			run:      run,
+			jobName:  jobName,
+			metadata: func(ctx context.Context) (*models.DroidMetadata, error) { return d.metadata, nil },
+			tasks:    func(ctx context.Context) ([]models.TaskSetting, error) { return d.queryTests(run), nil },
+		}}, nil
+	}
+
+	inspect := d.inspectImage
+	if inspect == nil {
+		inspect = d.inspectImagePod
+	}
+
+	if d.inspected == nil {
+		d.inspected = make(map[string]*inspectedImage)
+	}
+
+	units := make([]*jobUnit, 0, len(images))
+	for _, image := range images {
+		load := func(ctx context.Context) (*inspectedImage, error) {
+			if inspected, ok := d.inspected[image.Name]; ok {
+				return inspected, nil
+			}
+
+			metadata, tasks, err := inspect(ctx, run, image)
+			if err != nil {
+				return nil, fmt.Errorf("fail to inspect image %s: %s", image.Name, err.Error())
+			} else if metadata.Product != d.metadata.Product {
+				return nil, fmt.Errorf("image %s holds product %s instead of %s", image.Name, metadata.Product, d.metadata.Product)
+			}
+
+			inspected := &inspectedImage{metadata: metadata, tasks: models.TagImage(run.FilterTests(tasks), image.Name)}
+			d.inspected[image.Name] = inspected
+			return inspected, nil
+		}
+
+		units = append(units, &jobUnit{
+			run:     run.ForImage(image),
+			jobName: models.GetImageJobName(jobName, image.Name),
+			image:   image.Name,
+			metadata: func(ctx context.Context) (*models.DroidMetadata, error) {
+				inspected, err := load(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return inspected.metadata, nil
+			},
+			tasks: func(ctx context.Context) ([]models.TaskSetting, error) {
+				inspected, err := load(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return inspected.tasks, nil
+			},
+		})
+	}
+
+	return units, nil
+}
+
+// countPublished sets the number of the tasks of a multi-image run to the sum of the tasks published to the queues of
+// its images. The number is left as is if any image's number isn't recorded.
+func countPublished(run *models.Run, units []*jobUnit) {
+	if len(units) == 0 || len(units[0].image) == 0 {
+		return
+	}
+
+	total := 0
+	for _, unit := range units {
+		count, err := strconv.Atoi(run.Details[unit.publishedKey()])
+		if err != nil {
+			return
+		}
+		total += count
+	}
+	run.Details[common.KeyPublishedTasks] = strconv.Itoa(total)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/outbox"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// artifactStore uploads the artifacts written to the storage volume to the object store, if the storage backend
+// requires it. The artifacts which fail to be uploaded are saved to the outbox, which uploads them again.
+type artifactStore struct {
+	config   *storage.Config
+	uploader storage.Uploader
+	box      *outbox.Outbox
+
+	// handled holds the paths of the artifacts uploaded or saved to the outbox after their task. They are skipped
+	// after the run.
+	handled map[string]bool
+}
+
+// newArtifactStore loads the storage configuration. The artifacts are not uploaded if the configuration is invalid.
+func newArtifactStore(ctx context.Context, box *outbox.Outbox) *artifactStore {
+	config, err := storage.LoadConfig(ctx)
+	if err != nil {
+		logrus.Warnf("Failed to load the storage config. The artifacts won't be uploaded: %s", err)
+		return &artifactStore{config: storage.DefaultConfig(), box: box, handled: make(map[string]bool)}
+	}
+
+	uploader := config.NewUploader()
+	if uploader != nil {
+		box.SetUploader(uploader)
+	}
+	return &artifactStore{config: config, uploader: uploader, box: box, handled: make(map[string]bool)}
+}
+
+// afterTask uploads the log and the recording of the task once it is completed. The files which fail to be uploaded
+// are saved to the outbox.
+func (store *artifactStore) afterTask(ctx context.Context, task *models.TaskResult) {
+	if !store.config.UploadsEachTask() {
+		return
+	}
+
+	ctx, span := tracing.Start(ctx, "upload")
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	for _, relPath := range []string{task.GetLogPath(), task.GetRecordingPath()} {
+		if err = storage.UploadFile(ctx, store.uploader, common.PathMountArtifacts, relPath); err != nil {
+			logrus.Errorf("Failed to upload %s: %s. The file is saved to the outbox.", relPath, err)
+			if boxErr := store.box.AddUpload(relPath); boxErr != nil {
+				logrus.Errorf("Failed to save %s to the outbox: %s", relPath, boxErr)
+				continue
+			}
+		}
+		store.handled[filepath.FromSlash(relPath)] = true
+	}
+}
+
+// afterRun uploads all the artifacts of the run but the outboxes and the artifacts handled after their task
+func (store *artifactStore) afterRun(ctx context.Context, runID int) {
+	if !store.config.UploadsAfterRun() {
+		return
+	}
+
+	outboxDir := filepath.FromSlash(fmt.Sprintf(common.PathTemplateOutbox, runID))
+	uploaded, err := storage.UploadDir(ctx, store.uploader, common.PathMountArtifacts, strconv.Itoa(runID),
+		func(relPath string) bool { return relPath == outboxDir || store.handled[relPath] })
+	if err != nil {
+		logrus.Errorf("Failed to upload the artifacts. %d file(s) uploaded: %s", uploaded, err)
+		return
+	}
+
+	logrus.Infof("Uploaded %d artifact(s).", uploaded)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/outbox"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultBatchSize          = 20
+	defaultBatchFlushInterval = 30 * time.Second
+)
+
+// taskBatch collects the results of executed tasks and commits them to the store in batches. A delivery is acked
+// only after its task is committed or saved to the outbox, so a droid crash never loses a result.
+type taskBatch struct {
+	runID    int
+	size     int
+	interval time.Duration
+	box      *outbox.Outbox
+
+	lock       sync.Mutex
+	tasks      []*models.TaskResult
+	deliveries []amqp.Delivery
+	links      []trace.Link
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// newTaskBatch returns a task batch whose size and flush interval are read from the system config
+func newTaskBatch(runID int, box *outbox.Outbox) *taskBatch {
+	batch := &taskBatch{
+		runID:    runID,
+		size:     defaultBatchSize,
+		interval: defaultBatchFlushInterval,
+		box:      box,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if v, exists := kubeutils.TryGetSystemConfig(common.ConfigKeyDroidBatchSize); exists {
+		if size, err := strconv.Atoi(v); err == nil && size > 0 {
+			batch.size = size
+		} else {
+			logrus.Warnf("Invalid batch size %q in system config. Use %d instead.", v, batch.size)
+		}
+	}
+
+	if v, exists := kubeutils.TryGetSystemConfig(common.ConfigKeyDroidBatchInterval); exists {
+		if interval, err := time.ParseDuration(v); err == nil && interval > 0 {
+			batch.interval = interval
+		} else {
+			logrus.Warnf("Invalid batch flush interval %q in system config. Use %s instead.", v, batch.interval)
+		}
+	}
+
+	return batch
+}
+
+// start flushes the batch in the background at the batch's interval till close is called or the context is done.
+func (batch *taskBatch) start(ctx context.Context) {
+	go func() {
+		defer close(batch.done)
+		ticker := time.NewTicker(batch.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-batch.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				batch.flush(ctx)
+			}
+		}
+	}()
+}
+
+// add appends a task result and its delivery to the batch. The batch is flushed when it is full. The commit span of
+// the batch is linked to the task's span in the context.
+func (batch *taskBatch) add(ctx context.Context, task *models.TaskResult, delivery amqp.Delivery) {
+	batch.lock.Lock()
+	batch.tasks = append(batch.tasks, task)
+	batch.deliveries = append(batch.deliveries, delivery)
+	batch.links = append(batch.links, trace.Link{SpanContext: trace.SpanContextFromContext(ctx)})
+	full := len(batch.tasks) >= batch.size
+	batch.lock.Unlock()
+
+	if full {
+		batch.flush(ctx)
+	}
+}
+
+// flush commits the tasks in the batch. Tasks which fail to be committed are saved to the outbox. If a task can't be
+// saved anywhere its delivery is requeued so the task will be executed again.
+func (batch *taskBatch) flush(ctx context.Context) {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+
+	if len(batch.tasks) == 0 {
+		return
+	}
+
+	// the tasks saved to the outbox keep the batch's key, so the batch is retried as it was sent
+	key := models.BatchIdempotencyKey(batch.tasks)
+	ctx, span := tracing.Start(ctx, "commit", trace.WithLinks(batch.links...))
+	_, err := models.CommitTasksWithKeyContext(ctx, batch.runID, batch.tasks, key)
+	tracing.End(span, err)
+	if err != nil {
+		logrus.Errorf("Failed to commit %d task(s): %s. The tasks are saved to the outbox.", len(batch.tasks), err)
+	} else {
+		logrus.Infof("Committed %d task(s).", len(batch.tasks))
+	}
+
+	for i, delivery := range batch.deliveries {
+		if err != nil {
+			if boxErr := batch.box.AddInBatch(batch.tasks[i], key); boxErr != nil {
+				logrus.Errorf("Failed to save the task to the outbox: %s. The task is requeued.", boxErr)
+				if nackErr := delivery.Nack(false, true); nackErr != nil {
+					logrus.Errorf("Failed to nack delivery: %s", nackErr)
+				}
+				continue
+			}
+		}
+
+		if ackErr := delivery.Ack(false); ackErr != nil {
+			logrus.Errorf("Failed to ack delivery: %s", ackErr)
+		}
+	}
+
+	batch.tasks, batch.deliveries, batch.links = nil, nil, nil
+}
+
+// close stops the background flush and flushes the remaining tasks till the context is done
+func (batch *taskBatch) close(ctx context.Context) {
+	close(batch.stop)
+	<-batch.done
+	batch.flush(ctx)
+}
+
+// commitTask commits the task of a v3 image right away, as its after_test expects the task's ID. The task's log is
+// named after the ID and saved once the task is committed, then after_test runs and the log paths are saved. A task
+// which fails to be committed is saved to the outbox with its log named after its key, and after_test isn't run for it.
+func commitTask(ctx context.Context, task *models.TaskResult, output []byte, delivery amqp.Delivery, box *outbox.Outbox,
+	artifacts *artifactStore) {
+	commitCtx, span := tracing.Start(ctx, "commit")
+	committed, err := task.CommitNewContext(commitCtx)
+	tracing.End(span, err)
+	if err != nil {
+		logrus.Errorf("Failed to commit the task: %s. The task is saved to the outbox.", err)
+		saveTaskLog(task, output)
+		artifacts.afterTask(ctx, task)
+
+		if boxErr := box.Add(task); boxErr != nil {
+			logrus.Errorf("Failed to save the task to the outbox: %s. The task is requeued.", boxErr)
+			if nackErr := delivery.Nack(false, true); nackErr != nil {
+				logrus.Errorf("Failed to nack delivery: %s", nackErr)
+			}
+			return
+		}
+	} else {
+		logrus.Info("Committed the task.")
+		saveTaskLog(committed, output)
+
+		if err := afterTask(ctx, committed); err != nil {
+			logrus.Errorf("Failed in after task: %s.", err.Error())
+		}
+
+		artifacts.afterTask(ctx, committed)
+
+		if len(logPathTemplate) > 0 {
+			if _, err := committed.CommitChangesContext(ctx); err != nil {
+				logrus.Errorf("Failed to save the log paths of the task: %s", err)
+			}
+		}
+	}
+
+	if ackErr := delivery.Ack(false); ackErr != nil {
+		logrus.Errorf("Failed to ack delivery: %s", ackErr)
+	}
+}
@@ -1,27 +1,45 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/health"
 	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/logging"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
 	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/outbox"
 	"github.com/Azure/adx-automation-agent/sdk/schedule"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	outboxFlushInterval = time.Minute
+
+	// shutdownTimeout bounds the time spent committing the remaining tasks after the droid is asked to shut down
+	shutdownTimeout = 20 * time.Second
+
+	// uploadTimeout bounds the time spent uploading the artifacts after all the tasks are completed
+	uploadTimeout = 10 * time.Minute
+)
+
+// the variables below which can fail to be set are set by main once the exit handler is registered
 var (
-	taskBroker      = schedule.CreateInClusterTaskBroker()
+	taskBroker      *schedule.TaskBroker
 	jobName         = os.Getenv(common.EnvJobName)
 	podName         = os.Getenv(common.EnvPodName)
-	runID           = strings.Split(jobName, "-")[1] // the job name MUST follows the <product>-<runID>-<random ID>
-	productName     = strings.Split(jobName, "-")[0] // the job name MUST follows the <product>-<runID>-<random ID>
+	runID           string
+	nRunID          int
+	productName     string
 	logPathTemplate = ""
 	version         = "Unknown"
 	sourceCommit    = "Unknown"
@@ -36,9 +54,24 @@ func ckEnvironment() {
 			logrus.Fatalf("Missing environment variable %s.\n", r)
 		}
 	}
+
+	// the job name MUST follows the <product>-<runID>-<random ID>
+	parts := strings.Split(jobName, "-")
+	if len(parts) < 3 {
+		logrus.Fatalf("Job name %s doesn't follow <product>-<run ID>-<random ID>.", jobName)
+	}
+	productName, runID = parts[0], parts[1]
+
+	var err error
+	if nRunID, err = strconv.Atoi(runID); err != nil {
+		logrus.Fatalf("Job name %s doesn't hold a run ID: %s", jobName, err)
+	}
 }
 
-func preparePod() {
+func preparePod(ctx context.Context) {
+	_, span := tracing.Start(ctx, "prepare")
+	defer span.End()
+
 	_, statErr := os.Stat(common.PathScriptPreparePod)
 	if statErr != nil && os.IsNotExist(statErr) {
 		logrus.Infof("Executable %s doesn't exist. Skip preparing the pod.\n", common.PathScriptPreparePod)
@@ -52,8 +85,11 @@ func preparePod() {
 	logrus.Infof("Preparing Pod: \n%s\n", string(output))
 }
 
-func afterTask(taskResult *models.TaskResult) error {
-	_, err := os.Stat(common.PathScriptAfterTest)
+func afterTask(ctx context.Context, taskResult *models.TaskResult) (err error) {
+	_, span := tracing.Start(ctx, "after_task")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = os.Stat(common.PathScriptAfterTest)
 	if err != nil && os.IsNotExist(err) {
 		// Missing after task executable is not considered an error.
 		return nil
@@ -80,36 +116,116 @@ func afterTask(taskResult *models.TaskResult) error {
 	return nil
 }
 
+// saveTaskLog saves the task's output to its log file and sets the paths of its files from the log path template
+func saveTaskLog(task *models.TaskResult, output []byte) {
+	if saved, err := task.SaveTaskLog(output); err != nil {
+		logrus.Error(err)
+	} else if saved && len(logPathTemplate) > 0 {
+		task.ApplyLogPathTemplate(logPathTemplate)
+	}
+}
+
 func main() {
-	logrus.Infof("A01 Droid Engine.\nVersion: %s.\nCommit: %s.\n", version, sourceCommit)
-	logrus.Infof("Run ID: %s", runID)
+	// the sidecars stop once the droid exits, including exits on fatal errors
+	logrus.RegisterExitHandler(markDone)
+	defer markDone()
 
 	ckEnvironment()
+	taskBroker = schedule.CreateInClusterTaskBroker()
+
+	logging.Setup(logrus.Fields{
+		logging.FieldRunID:   nRunID,
+		logging.FieldProduct: productName,
+		logging.FieldJobName: jobName,
+		logging.FieldPodName: podName,
+	})
+	logrus.WithFields(logrus.Fields{"version": version, "commit": sourceCommit}).Info("A01 Droid Engine.")
+
+	metrics.SetRun(productName, runID)
+	metrics.Serve(fmt.Sprintf(":%d", common.PortMetrics))
+
+	// the root context is canceled when the pod is asked to shut down
+	ctx, cancel := common.NewSignalContext()
+	defer cancel()
+
+	shutdownTracing, err := tracing.Init(
+		ctx,
+		"a01droid",
+		tracing.AttributeRunID.Int(nRunID),
+		tracing.AttributeProduct.String(productName),
+		tracing.AttributeJobName.String(jobName))
+	if err != nil {
+		logrus.Warn("Failed to initialize tracing: ", err)
+	}
+	defer func() {
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		shutdownTracing(flushCtx)
+	}()
 
 	queue, ch, err := taskBroker.QueueDeclare(jobName)
 	if err != nil {
 		logrus.Fatal("Failed to connect to the task broker.")
 	}
 
-	if bLogPathTemplate, exists := kubeutils.TryGetSecretInBytes(
+	if bLogPathTemplate, exists := kubeutils.TryGetSecretInBytesContext(
+		ctx,
 		productName,
 		common.ProductSecretKeyLogPathTemplate); exists {
 		logPathTemplate = string(bLogPathTemplate)
 	}
 
-	preparePod()
+	probes := health.NewServer()
+	probes.AddLivenessCheck("broker", func(context.Context) error { return taskBroker.Ping() })
+	probes.AddReadinessCheck("store", func(ctx context.Context) error {
+		_, err := models.QueryRunContext(ctx, nRunID)
+		return err
+	})
+	probes.Serve(fmt.Sprintf(":%d", common.PortHealth))
 
-	for {
+	box, err := outbox.OpenForPod(nRunID, podName)
+	if err != nil {
+		logrus.Fatal("Failed to open the outbox: ", err)
+	}
+	box.Start(outboxFlushInterval)
+
+	artifacts := newArtifactStore(ctx, box)
+
+	batch := newTaskBatch(nRunID, box)
+	batch.start(ctx)
+
+	if err := waitSidecars(ctx); err != nil {
+		logrus.Fatal("Failed to wait for the sidecars: ", err)
+	}
+
+	preparePod(ctx)
+
+	// the after_test of a v3 image runs once the task is committed and names the task's files after its ID
+	namesTasksByKey := false
+	if metadata, err := models.ReadDroidMetadata(common.PathMetadataYml); err == nil {
+		namesTasksByKey = metadata.NamesTasksByKey()
+	} else {
+		logrus.Warnf("The metadata is not available. The tasks are committed one by one: %s", err)
+	}
+
+	for ctx.Err() == nil {
+		_, fetchSpan := tracing.Start(ctx, "fetch")
+		begin := time.Now()
 		delivery, ok, err := ch.Get(queue.Name, false /* autoAck*/)
+		metrics.ObserveBrokerCall("get", begin, err)
+		tracing.End(fetchSpan, err)
 		if err != nil {
 			logrus.Fatal("Failed to get a delivery: ", err)
 		}
 
 		if !ok {
-			logrus.Info("No more task in the queue. Exiting successfully.")
+			logrus.Info("No more task in the queue.")
 			break
 		}
 
+		// the task's span continues the trace the dispatcher published the task in
+		taskCtx, taskSpan := tracing.Start(tracing.ExtractHeaders(ctx, delivery.Headers), "task")
+
 		var output []byte
 		var taskResult *models.TaskResult
 		var setting models.TaskSetting
@@ -120,52 +236,69 @@ func main() {
 
 			taskResult = setting.CreateUncompletedTask(podName, runID, errorMsg)
 		} else {
-			logrus.Infof("Run task %s", setting.GetIdentifier())
+			logging.SetField(logging.FieldTask, setting.GetIdentifier())
+			probes.SetTask(setting.GetIdentifier())
+			logrus.Info("Run task")
+			taskSpan.SetAttributes(tracing.AttributeTask.String(setting.GetIdentifier()))
+
+			_, executeSpan := tracing.Start(taskCtx, "execute")
+			result, duration, executeOutput := setting.ExecuteContext(ctx)
+			executeSpan.SetAttributes(tracing.AttributeResult.String(result))
+			executeSpan.End()
+			if ctx.Err() != nil {
+				// the task was interrupted by the shutdown. requeue it so it can be executed by another droid.
+				logrus.Warnf("Task %s is interrupted. The task is requeued.", setting.GetIdentifier())
+				if err := delivery.Nack(false, true); err != nil {
+					logrus.Errorf("Failed to nack delivery: %s", err.Error())
+				}
+				tracing.End(taskSpan, ctx.Err())
+				break
+			}
 
-			result, duration, executeOutput := setting.Execute()
+			metrics.ObserveTask(podName, result, time.Duration(duration)*time.Second)
 			taskResult = setting.CreateCompletedTask(result, duration, podName, runID)
 			output = executeOutput
 		}
 
-		taskResult, err = taskResult.CommitNew()
-		if err != nil {
-			logrus.Errorf("Failed to commit a new task: %s.", err.Error())
-		} else {
-			taskLogPath, err := taskResult.SaveTaskLog(output)
-			if err != nil {
-				logrus.Error(err)
-			}
+		if namesTasksByKey {
+			// the log paths are derived from the task's key so they are known before the task is committed
+			saveTaskLog(taskResult, output)
 
-			err = afterTask(taskResult)
+			err = afterTask(taskCtx, taskResult)
 			if err != nil {
 				logrus.Errorf("Failed in after task: %s.", err.Error())
 			}
 
-			if len(logPathTemplate) > 0 {
-				taskResult.ResultDetails[common.KeyTaskLogPath] = strings.Replace(
-					logPathTemplate,
-					"{}",
-					taskLogPath,
-					1)
-
-				taskResult.ResultDetails[common.KeyTaskRecordPath] = strings.Replace(
-					logPathTemplate,
-					"{}",
-					path.Join(strconv.Itoa(taskResult.RunID), fmt.Sprintf("recording_%d.yaml", taskResult.ID)),
-					1)
-
-				_, err := taskResult.CommitChanges()
-				if err != nil {
-					logrus.Error(err)
-				}
-			}
-		}
+			artifacts.afterTask(taskCtx, taskResult)
 
-		err = delivery.Ack(false)
-		if err != nil {
-			logrus.Errorf("Failed to ack delivery: %s", err.Error())
+			batch.add(taskCtx, taskResult, delivery)
 		} else {
-			logrus.Info("ACK")
+			commitTask(taskCtx, taskResult, output, delivery, box, artifacts)
 		}
+		taskSpan.End()
+		logging.RemoveField(logging.FieldTask)
+		probes.SetTask("")
+	}
+
+	// commit the remaining tasks and flush the outbox before exit. tasks left in an outbox on the file share will be
+	// reconciled by the dispatcher.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+
+	batch.close(shutdownCtx)
+	box.Stop()
+	if remaining, err := box.FlushContext(shutdownCtx); err != nil {
+		logrus.Errorf("%d task(s) remain in the outbox: %s", remaining, err.Error())
+	}
+
+	if ctx.Err() != nil {
+		logrus.Info("The droid is shut down.")
+		return
 	}
+
+	uploadCtx, cancelUpload := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancelUpload()
+	artifacts.afterRun(uploadCtx, nRunID)
+
+	logrus.Info("Exiting successfully.")
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sidecarReadyTimeout = 5 * time.Minute
+	sidecarPollInterval = 2 * time.Second
+)
+
+// waitSidecars blocks till all the sidecars declaring a readiness check in the metadata are ready
+func waitSidecars(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "wait_sidecars")
+	defer func() { tracing.End(span, err) }()
+
+	metadata, err := models.ReadDroidMetadata(common.PathMetadataYml)
+	if err != nil {
+		logrus.Warnf("The metadata is not available. Skip waiting for the sidecars: %s", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sidecarReadyTimeout)
+	defer cancel()
+
+	for _, sidecar := range metadata.Sidecars {
+		if sidecar.Readiness == nil {
+			continue
+		}
+
+		logrus.Infof("Waiting for sidecar %s.", sidecar.Name)
+		for {
+			probeErr := probeSidecar(ctx, sidecar.Readiness)
+			if probeErr == nil {
+				logrus.Infof("Sidecar %s is ready.", sidecar.Name)
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("sidecar %s is not ready: %s", sidecar.Name, probeErr.Error())
+			case <-time.After(sidecarPollInterval):
+			}
+		}
+	}
+
+	return nil
+}
+
+func probeSidecar(ctx context.Context, readiness *models.DroidMetadataReadinessDef) error {
+	address := fmt.Sprintf("localhost:%d", readiness.Port)
+	if len(readiness.Path) == 0 {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", address, readiness.Path), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("readiness check returns %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// markDone tells the sidecars the droid has exited so they stop and the pod completes. It is a no-op if the pod
+// has no sidecar.
+func markDone() {
+	if _, err := os.Stat(common.PathMountLifecycle); err != nil {
+		return
+	}
+
+	if err := ioutil.WriteFile(common.PathLifecycleDone, []byte(podName), 0644); err != nil {
+		logrus.Errorf("Failed to notify the sidecars: %s", err)
+	}
+}
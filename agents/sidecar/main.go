@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pollInterval = time.Second
+
+	// stopTimeout bounds the time the sidecar process is given to exit after it is asked to
+	stopTimeout = 10 * time.Second
+)
+
+var (
+	version      = "Unknown"
+	sourceCommit = "Unknown"
+)
+
+// main defines the logic of A01 sidecar
+// A sidecar container runs as long as its process does, so a Job whose pods have sidecars would never complete. The
+// sidecar agent wraps the sidecar's command and stops it once the droid in the main container exits, so the pod
+// terminates successfully.
+func main() {
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.WithFields(logrus.Fields{"version": version, "commit": sourceCommit}).Info("A01 Sidecar.")
+
+	if len(os.Args) < 2 {
+		logrus.Fatal("Missing the command of the sidecar.")
+	}
+
+	cmd := exec.Command(os.Args[1], os.Args[2:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		logrus.Fatalf("Failed to start the sidecar: %s", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			// the sidecar exited on its own. its exit code is the container's.
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+					os.Exit(status.ExitStatus())
+				}
+			}
+			if err != nil {
+				logrus.Fatalf("The sidecar failed: %s", err)
+			}
+			return
+		case sig := <-signals:
+			// the pod is shut down. forward the signal and keep waiting for the sidecar to exit.
+			cmd.Process.Signal(sig)
+		case <-ticker.C:
+			if _, err := os.Stat(common.PathLifecycleDone); err == nil {
+				logrus.Info("The droid exited. Stopping the sidecar.")
+				stop(cmd, exited)
+				return
+			}
+		}
+	}
+}
+
+// stop terminates the sidecar process. The exit code of the process is ignored because the sidecar is stopped on
+// purpose.
+func stop(cmd *exec.Cmd, exited <-chan error) {
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		logrus.Warn("The sidecar didn't exit in time. Killing it.")
+		cmd.Process.Kill()
+		<-exited
+	}
+}
@@ -0,0 +1,221 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A01RunImage is one of the images tested by a multi-image run
+type A01RunImage struct {
+	// Name identifies the image in the run. It is appended to the names of the image's Job and task queue.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=20
+	Name string `json:"name"`
+
+	// Image is the test image
+	Image string `json:"image"`
+
+	// ImagePullSecret is the secret used to pull the image. It defaults to the run's.
+	// +optional
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
+}
+
+// A01RunSpec defines the run. The fields mirror the reserved settings of a run.
+//
+// +kubebuilder:validation:XValidation:rule="has(self.image) || has(self.images)",message="either image or images is required"
+type A01RunSpec struct {
+	// Product is the product whose tests are run. It selects the droid metadata.
+	Product string `json:"product"`
+
+	// Image is the test image of the droids
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Images are the test images of a multi-image run. Each image has its own Job and task queue, and the results are
+	// reported by image.
+	// +optional
+	Images []A01RunImage `json:"images,omitempty"`
+
+	// ImagePullSecret is the secret used to pull the test image
+	ImagePullSecret string `json:"imagePullSecret"`
+
+	// Secret is the secret of the product. It defaults to the product's name.
+	// +optional
+	Secret string `json:"secret,omitempty"`
+
+	// StorageShare is the file share the droids store their logs in
+	// +optional
+	StorageShare string `json:"storageShare,omitempty"`
+
+	// TestQuery is a regular expression selecting the tests to run
+	// +optional
+	TestQuery string `json:"testQuery,omitempty"`
+
+	// TestExcludeQuery is a regular expression selecting the tests not to run
+	// +optional
+	TestExcludeQuery string `json:"testExcludeQuery,omitempty"`
+
+	// UserEmail receives the report of the run
+	// +optional
+	UserEmail string `json:"userEmail,omitempty"`
+
+	// Remark is the remark of the run. The report of an official run is sent to the product's owners.
+	// +optional
+	Remark string `json:"remark,omitempty"`
+
+	// InitParallelism is the number of droids running the tests at the same time
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	InitParallelism int32 `json:"initParallelism,omitempty"`
+
+	// LiveMode runs the tests against live services
+	// +optional
+	LiveMode bool `json:"liveMode,omitempty"`
+
+	// TestMode is passed to the droids of products defining an argument-value-mode environment variable
+	// +optional
+	TestMode string `json:"testMode,omitempty"`
+
+	// FromRunFailure runs the failed tests of the given run only
+	// +optional
+	FromRunFailure int `json:"fromRunFailure,omitempty"`
+
+	// Priority is the priority of the run. It selects the PriorityClass of the droid pods and the priority of the
+	// tasks.
+	// +kubebuilder:validation:Enum=low;normal;high
+	// +optional
+	Priority string `json:"priority,omitempty"`
+
+	// AgentVersion is the version of the A01 agents the droids use
+	// +kubebuilder:default=latest
+	// +optional
+	AgentVersion string `json:"agentVersion,omitempty"`
+
+	// Settings are additional settings of the run by key. Object settings, such as resources and scheduling, are
+	// given in JSON.
+	// +optional
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// A01RunStatus is the observed state of the run. It mirrors the run in the store.
+type A01RunStatus struct {
+	// RunID is the ID of the run in the store
+	// +optional
+	RunID int `json:"runId,omitempty"`
+
+	// Phase is the status of the run in the store
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// JobName is the name of the run's Job and task queue. The Jobs and queues of a multi-image run are named after it
+	// and their images.
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// PublishedTasks is the number of tasks published to the queue
+	// +optional
+	PublishedTasks int `json:"publishedTasks,omitempty"`
+
+	// RemainingTasks is the number of tasks left in the queue
+	// +optional
+	RemainingTasks int `json:"remainingTasks,omitempty"`
+
+	// ActiveDroids, SucceededDroids and FailedDroids count the pods of the run's Jobs
+	// +optional
+	ActiveDroids int32 `json:"activeDroids,omitempty"`
+	// +optional
+	SucceededDroids int32 `json:"succeededDroids,omitempty"`
+	// +optional
+	FailedDroids int32 `json:"failedDroids,omitempty"`
+
+	// Message describes the last error driving the run
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// ObservedGeneration is the generation of the spec the run was created from
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// A01Run is a run of the tests of a product
+//
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Product",type=string,JSONPath=`.spec.product`
+// +kubebuilder:printcolumn:name="Run",type=integer,JSONPath=`.status.runId`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Published",type=integer,JSONPath=`.status.publishedTasks`
+// +kubebuilder:printcolumn:name="Remaining",type=integer,JSONPath=`.status.remainingTasks`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type A01Run struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   A01RunSpec   `json:"spec,omitempty"`
+	Status A01RunStatus `json:"status,omitempty"`
+}
+
+// A01RunList is a list of A01Run
+//
+// +kubebuilder:object:root=true
+type A01RunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []A01Run `json:"items"`
+}
+
+// ToSettings returns the settings of the run in the store. The values have the types the store returns them in.
+func (spec *A01RunSpec) ToSettings() map[string]interface{} {
+	settings := make(map[string]interface{}, len(spec.Settings)+8)
+	for key, value := range spec.Settings {
+		settings[key] = value
+	}
+
+	setString := func(key string, value string) {
+		if len(value) > 0 {
+			settings[key] = value
+		}
+	}
+
+	setString(common.KeyImageName, spec.Image)
+	setString(common.KeyImagePullSecret, spec.ImagePullSecret)
+	setString(common.KeySecretName, spec.Secret)
+	setString(common.KeyStorageShare, spec.StorageShare)
+	setString(common.KeyTestQuery, spec.TestQuery)
+	setString(common.KeyTestExcludeQuery, spec.TestExcludeQuery)
+	setString(common.KeyUserEmail, spec.UserEmail)
+	setString(common.KeyRemark, spec.Remark)
+	setString(common.KeyTestModel, spec.TestMode)
+	setString(common.KeyPriority, spec.Priority)
+	settings[common.KeyAgentVersion] = "latest"
+	setString(common.KeyAgentVersion, spec.AgentVersion)
+
+	if len(spec.Images) > 0 {
+		images, _ := json.Marshal(spec.Images)
+		settings[common.KeyImages] = string(images)
+		if len(spec.Image) == 0 {
+			settings[common.KeyImageName] = spec.Images[0].Image
+		}
+	}
+
+	parallelism := spec.InitParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	settings[common.KeyInitParallelism] = float64(parallelism)
+
+	if spec.LiveMode {
+		settings[common.KeyLiveMode] = "True"
+	} else {
+		settings[common.KeyLiveMode] = "False"
+	}
+
+	if spec.FromRunFailure > 0 {
+		settings[common.KeyFromFailure] = float64(spec.FromRunFailure)
+	}
+
+	return settings
+}
@@ -0,0 +1,6 @@
+// Package v1alpha1 defines the A01Run custom resource. An A01Run is a run created with kubectl and driven by the
+// dispatcher's operator mode.
+//
+// +kubebuilder:object:generate=true
+// +groupName=a01.azure.com
+package v1alpha1
@@ -0,0 +1,21 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group and version of the A01 resources
+	GroupVersion = schema.GroupVersion{Group: "a01.azure.com", Version: "v1alpha1"}
+
+	// SchemeBuilder registers the A01 resources in a scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the A01 resources to the scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&A01Run{}, &A01RunList{})
+}
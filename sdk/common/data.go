@@ -18,6 +18,16 @@ const (
 	KeyAgentVersion     = "a01.reserved.agentver"
 	KeyRunID            = "a01.reserved.runid"
 	KeyJobName          = "a01.reserved.jobname"
+	KeyPublishedTasks   = "a01.reserved.publishedtasks"
 	KeyTaskLogPath      = "a01.reserved.tasklogpath"
 	KeyTaskRecordPath   = "a01.reserved.taskrecordpath"
+	KeyTaskKey          = "a01.reserved.taskkey"
+	KeyResources        = "a01.reserved.resources"
+	KeyScheduling       = "a01.reserved.scheduling"
+	KeySchedule         = "a01.reserved.schedule"
+	KeyPriority         = "a01.reserved.priority"
+	KeyScheduledAt      = "a01.reserved.scheduledat"
+	KeyImages           = "a01.reserved.images"
+	KeyImage            = "a01.reserved.image"
+	KeyImageResults     = "a01.reserved.imageresults"
 )
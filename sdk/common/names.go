@@ -9,13 +9,24 @@ const (
 	StorageVolumeNameArtifacts = "artifacts-storage"
 	StorageVolumeNameSecrets   = "secrets-storage"
 	StorageVolumeNameTools     = "tools-storage"
+	StorageVolumeNameLifecycle = "lifecycle-storage"
 	DNSNameTaskStore           = "data-store-svc"
 	DNSNameEmailService        = "email-report-svc"
 	DNSNameReportService       = "report-internal-svc"
 	SecretNameAgents           = "agent-secrets"
+	SecretNameStore            = "store-secrets"
 	SystemConfigMapName        = "a01-system-config"
 )
 
+// Defines the well-known ports of the A01 agents
+const (
+	// PortMetrics is the port the agents expose the Prometheus metrics endpoint on
+	PortMetrics = 9100
+
+	// PortHealth is the port the droid exposes the health endpoints on
+	PortHealth = 9101
+)
+
 const (
 	// RunStatusInitialized is set when a run is just created
 	RunStatusInitialized = "Initialized"
@@ -28,6 +39,9 @@ const (
 
 	// RunStatusCompleted is set when all tasks are accomplished
 	RunStatusCompleted = "Completed"
+
+	// RunStatusCanceled is set when a run is canceled before it completes
+	RunStatusCanceled = "Canceled"
 )
 
 // Defines well-known keys in the a01 system config
@@ -36,11 +50,41 @@ const (
 	ConfigKeyUsernameTaskBroker    = "username.taskbroker"
 	ConfigKeyPasswordKeyTaskBroker = "password.taskbroker"
 	ConfigKeySecretTaskBroker      = "secret.taskbroker"
+	ConfigKeySecretStore           = "secret.store"
+	ConfigKeyComKeyStore           = "comkey.store"
+	ConfigKeyDroidBatchSize        = "droid.batch.size"
+	ConfigKeyDroidBatchInterval    = "droid.batch.interval"
+	ConfigKeyDroidBudget           = "droid.budget"
+	ConfigKeyEndpointOTLP          = "endpoint.otlp"
+	ConfigKeyLogLevel              = "log.level"
+	ConfigKeyStorageBackend        = "storage.backend"
+	ConfigKeyStorageClaim          = "storage.pvc.claim"
+	ConfigKeyStorageHostPath       = "storage.hostpath"
+	ConfigKeyStorageS3Endpoint     = "storage.s3.endpoint"
+	ConfigKeyStorageS3Bucket       = "storage.s3.bucket"
+	ConfigKeyStorageS3Region       = "storage.s3.region"
+	ConfigKeyStorageS3Secret       = "storage.s3.secret"
+	ConfigKeyToolsBackend          = "tools.backend"
+	ConfigKeyToolsClaim            = "tools.pvc.claim"
+	ConfigKeyToolsHostPath         = "tools.hostpath"
+)
+
+// StoreSecretKeyComKey is the default key of the internal communication key in the secret of the store
+const StoreSecretKeyComKey = "comkey"
+
+// Defines well-known keys in the secret of the S3-compatible artifacts storage
+const (
+	StorageSecretKeyAccessKey = "accesskey"
+	StorageSecretKeySecretKey = "secretkey"
 )
 
 // Defines well-known keys in a product specific secret
 const (
 	ProductSecretKeyLogPathTemplate = "log.path.template"
+
+	// ProductSecretKeySchedules holds the run schedules of the product. The key of the product's ConfigMap is the
+	// same.
+	ProductSecretKeySchedules = "schedules"
 )
 
 // GetCurrentNamespace returns the namespace this Pod belongs to. If it fails
@@ -5,12 +5,17 @@ const (
 	PathMountArtifacts   = "/mnt/storage"
 	PathMountSecrets     = "/mnt/secrets"
 	PathMountTools       = "/mnt/tools"
+	PathMountLifecycle   = "/mnt/lifecycle"
 	PathScriptPreparePod = "/app/prepare_pod"
 	PathScriptAfterTest  = "/app/after_test"
 	PathScriptGetIndex   = "/app/get_index"
 	PathMetadataYml      = "/app/metadata.yml"
+	PathLocalOutbox      = "/tmp/a01/outbox"
 )
 
+// PathLifecycleDone is the file the droid creates when it exits. The sidecars exit once it appears.
+const PathLifecycleDone = PathMountLifecycle + "/done"
+
 // Defines the Kubernetes specific paths
 const (
 	PathKubeNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
@@ -19,6 +24,22 @@ const (
 // Defines the path template for logs
 const (
 	// PathTemplateTaskLog defines the relative path of a task's log file in a file share.
+	// It is <run_id>/task_<task_key>.log
+	PathTemplateTaskLog = "%d/task_%s.log"
+
+	// PathTemplateTaskRecording defines the relative path of a task's recording file in a file share.
+	// It is <run_id>/recording_<task_key>.yaml
+	PathTemplateTaskRecording = "%d/recording_%s.yaml"
+
+	// PathTemplateCommittedTaskLog defines the relative path of a committed task's log file in a file share.
 	// It is <run_id>/task_<task_id>.log
-	PathTemplateTaskLog = "%d/task_%d.log"
+	PathTemplateCommittedTaskLog = "%d/task_%d.log"
+
+	// PathTemplateCommittedTaskRecording defines the relative path of a committed task's recording file in a file
+	// share. It is <run_id>/recording_<task_id>.yaml
+	PathTemplateCommittedTaskRecording = "%d/recording_%d.yaml"
+
+	// PathTemplateOutbox defines the relative path of a run's outbox folder in a file share.
+	// It is <run_id>/outbox
+	PathTemplateOutbox = "%d/outbox"
 )
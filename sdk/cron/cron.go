@@ -0,0 +1,182 @@
+// Package cron parses the five-field cron expressions of the run schedules and computes their activation times.
+//
+// The fields are minute, hour, day of month, month and day of week. Each field is a list of values, ranges and steps,
+// e.g. `*/15`, `1-5` or `0,30`. Months and days of week can be given by their three-letter names. When both the day
+// of month and the day of week are restricted, a day matching either of them is activated. The macros @yearly,
+// @monthly, @weekly, @daily and @hourly are supported.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny are set when the day of month or the day of week is *
+	domAny, dowAny bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expect 5 fields but found %d", expr, len(fields))
+	}
+
+	var schedule Schedule
+	var err error
+	for i, def := range []struct {
+		field  field
+		target *uint64
+	}{
+		{minuteField, &schedule.minute},
+		{hourField, &schedule.hour},
+		{domField, &schedule.dom},
+		{monthField, &schedule.month},
+		{dowField, &schedule.dow},
+	} {
+		if *def.target, err = def.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s", expr, err.Error())
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domAny = fields[2] == "*"
+	schedule.dowAny = fields[4] == "*"
+
+	return &schedule, nil
+}
+
+// parse returns the bits of the values of the field
+func (f field) parse(expr string) (bits uint64, err error) {
+	for _, item := range strings.Split(expr, ",") {
+		step := 1
+		if parts := strings.SplitN(item, "/", 2); len(parts) == 2 {
+			if step, err = strconv.Atoi(parts[1]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q of the %s", parts[1], f.name)
+			}
+			item = parts[0]
+		}
+
+		low, high := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			if low, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// a single value with a step runs till the end of the range, e.g. 5/15
+				high = f.max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q of the %s", item, f.name)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// value returns the value of a number or a name of the field
+func (f field) value(expr string) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(expr)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, expr)
+	}
+	return v, nil
+}
+
+// Next returns the first activation time after the given time. It returns the zero time if the schedule is never
+// activated, e.g. on February 30th.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	loc := t.Location()
+
+	// every activation time recurs within five years
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
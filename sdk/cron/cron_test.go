@@ -0,0 +1,60 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2026, time.March, 4, 10, 17, 30, 0, time.UTC)
+
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.March, 4, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, time.March, 4, 10, 30, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2026, time.March, 5, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, time.March, 5, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, time.March, 4, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * sat,sun", time.Date(2026, time.March, 7, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, time.March, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 22 * * 1-5", time.Date(2026, time.March, 4, 22, 0, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2026, time.March, 4, 10, 25, 0, 0, time.UTC)},
+		// either the day of month or the day of week
+		{"0 0 15 * fri", time.Date(2026, time.March, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		schedule, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err)
+			continue
+		}
+		if next := schedule.Next(from); !next.Equal(tc.next) {
+			t.Errorf("%s: expect %s but found %s", tc.expr, tc.next, next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@reboot",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expect %q to be invalid", expr)
+		}
+	}
+}
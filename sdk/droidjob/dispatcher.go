@@ -0,0 +1,97 @@
+package droidjob
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DispatcherServiceAccount is the service account of the dispatcher pods. It needs the permissions to create the
+// droid Jobs and to hold the runs' leases.
+const DispatcherServiceAccount = "a01-dispatcher"
+
+// RenderDispatcher returns the Job running the dispatcher of the run. The dispatcher runs in the run's image, which
+// holds the product's metadata.yml and get_index, from the agents mounted at /mnt/tools. A failed dispatcher is
+// restarted and resumes the run. The artifacts storage is mounted if the droids share it, so that the dispatcher
+// reconciles the outboxes they left. The storage configuration defaults to storage.DefaultConfig() and the store's
+// secret to DefaultStoreSecret() if they are nil.
+func RenderDispatcher(
+	run *models.Run,
+	metadata *models.DroidMetadata,
+	storageConfig *storage.Config,
+	storeSecret *StoreSecret,
+	jobName string) (*batchv1.Job, error) {
+	r := newRenderer(run, metadata, storageConfig, storeSecret, jobName)
+
+	image, err := r.getStringSetting(common.KeyImageName)
+	if err != nil {
+		return nil, err
+	} else if len(image) == 0 {
+		return nil, fmt.Errorf("run %d doesn't have an image", run.ID)
+	}
+
+	toolsSource, _ := r.storage.ToolsVolume(fmt.Sprint(run.Settings[common.KeyAgentVersion]))
+	volumes := []corev1.Volume{
+		{
+			Name:         common.StorageVolumeNameTools,
+			VolumeSource: toolsSource,
+		},
+	}
+	volumeMounts := []corev1.VolumeMount{r.getToolsVolumeMount()}
+
+	if metadata.Storage && r.storage.SharesArtifacts() {
+		artifactsSource, subPath := r.storage.ArtifactsVolume(r.getStorageShare(), run.GetSecretName(metadata))
+		volumes = append(volumes, corev1.Volume{
+			Name:         common.StorageVolumeNameArtifacts,
+			VolumeSource: artifactsSource,
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			MountPath: common.PathMountArtifacts,
+			Name:      common.StorageVolumeNameArtifacts,
+			SubPath:   subPath,
+		})
+	}
+
+	var backoff int32 = 3
+	labels := map[string]string{"run_id": strconv.Itoa(run.ID), "component": "dispatcher"}
+	return &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   jobName,
+			Labels: labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoff,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: getPodAnnotations(),
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: DispatcherServiceAccount,
+					Containers: []corev1.Container{
+						{
+							Name:         "dispatcher",
+							Image:        image,
+							Command:      []string{common.PathMountTools + "/a01dispatcher", "--run", strconv.Itoa(run.ID)},
+							Env:          append(getPodEnvironmentVariables(), r.getStoreSecretEnvironmentVariable()),
+							VolumeMounts: volumeMounts,
+						},
+					},
+					ImagePullSecrets: r.getImagePullSource(),
+					Volumes:          volumes,
+					RestartPolicy:    corev1.RestartPolicyOnFailure,
+				},
+			},
+		},
+	}, nil
+}
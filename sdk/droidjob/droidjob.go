@@ -0,0 +1,649 @@
+// Package droidjob renders the Kubernetes Job running the droids of a run. Rendering is free of side effects, so the
+// manifest can be reviewed or exported without creating the Job.
+package droidjob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/health"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// LabelProduct is the label of the droid Jobs and pods holding the product
+const LabelProduct = "product"
+
+// LabelImage is the label of the droid Jobs and pods of a multi-image run holding the name of their image
+const LabelImage = "image"
+
+// StoreSecret references the key of the secret holding the internal communication key of the store
+type StoreSecret struct {
+	Name string
+	Key  string
+}
+
+// DefaultStoreSecret returns the reference to the comkey of the store-secrets secret
+func DefaultStoreSecret() *StoreSecret {
+	return &StoreSecret{Name: common.SecretNameStore, Key: common.StoreSecretKeyComKey}
+}
+
+// LoadStoreSecret reads the reference to the store's secret from the A01 system config. Missing values default to
+// DefaultStoreSecret().
+func LoadStoreSecret(ctx context.Context) *StoreSecret {
+	secret := DefaultStoreSecret()
+	if name, _ := kubeutils.TryGetSystemConfigContext(ctx, common.ConfigKeySecretStore); len(strings.TrimSpace(name)) > 0 {
+		secret.Name = strings.TrimSpace(name)
+	}
+	if key, _ := kubeutils.TryGetSystemConfigContext(ctx, common.ConfigKeyComKeyStore); len(strings.TrimSpace(key)) > 0 {
+		secret.Key = strings.TrimSpace(key)
+	}
+
+	return secret
+}
+
+// renderer holds the inputs of a Job rendering
+type renderer struct {
+	run         *models.Run
+	metadata    *models.DroidMetadata
+	storage     *storage.Config
+	storeSecret *StoreSecret
+	jobName     string
+}
+
+func newRenderer(
+	run *models.Run,
+	metadata *models.DroidMetadata,
+	storageConfig *storage.Config,
+	storeSecret *StoreSecret,
+	jobName string) *renderer {
+	if storageConfig == nil {
+		storageConfig = storage.DefaultConfig()
+	}
+	if storeSecret == nil {
+		storeSecret = DefaultStoreSecret()
+	}
+
+	return &renderer{run: run, metadata: metadata, storage: storageConfig, storeSecret: storeSecret, jobName: jobName}
+}
+
+// Render returns the Job running the droids of the run. The storage configuration defaults to
+// storage.DefaultConfig() and the store's secret to DefaultStoreSecret() if they are nil.
+func Render(
+	run *models.Run,
+	metadata *models.DroidMetadata,
+	storageConfig *storage.Config,
+	storeSecret *StoreSecret,
+	jobName string) (*batchv1.Job, error) {
+	r := newRenderer(run, metadata, storageConfig, storeSecret, jobName)
+	initParallelism, err := r.getNumberSetting(common.KeyInitParallelism)
+	if err != nil {
+		return nil, err
+	}
+	parallelism := int32(initParallelism)
+	var backoff int32 = 5
+
+	labels, err := r.getLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := r.getContainerSpecs()
+	if err != nil {
+		return nil, err
+	}
+
+	sidecars, err := r.getSidecarSpecs()
+	if err != nil {
+		return nil, err
+	}
+	containers = append(containers, sidecars...)
+
+	initContainers, err := r.getInitContainerSpecs()
+	if err != nil {
+		return nil, err
+	}
+
+	scheduling, err := r.run.GetScheduling(r.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	definition := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   r.jobName,
+			Labels: labels,
+		},
+		Spec: batchv1.JobSpec{
+			Parallelism:  &parallelism,
+			BackoffLimit: &backoff,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        r.jobName,
+					Labels:      labels,
+					Annotations: getPodAnnotations(),
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: "test-runner-robot",
+					InitContainers:     initContainers,
+					Containers:         containers,
+					ImagePullSecrets:   r.getImagePullSource(),
+					Volumes:            r.getVolumes(),
+					RestartPolicy:      corev1.RestartPolicyNever,
+					NodeSelector:       scheduling.NodeSelector,
+					Tolerations:        scheduling.Tolerations,
+					Affinity:           scheduling.Affinity,
+					PriorityClassName:  scheduling.PriorityClass,
+				},
+			},
+		},
+	}
+
+	return definition, nil
+}
+
+func (r *renderer) getLabels() (map[string]string, error) {
+	liveMode, err := r.getStringSetting(common.KeyLiveMode)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	labels["run_id"] = strconv.Itoa(r.run.ID)
+	labels["run_live"] = liveMode
+	labels[LabelProduct] = r.metadata.Product
+	if image, ok := r.run.Details[common.KeyImage]; ok {
+		labels[LabelImage] = image
+	}
+
+	return labels, nil
+}
+
+// getStringSetting returns the run's setting of the given key. It fails if the setting is missing or isn't a string.
+func (r *renderer) getStringSetting(key string) (string, error) {
+	value, ok := r.run.Settings[key]
+	if !ok {
+		return "", fmt.Errorf("run %d doesn't have setting %s", r.run.ID, key)
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("setting %s of run %d is a %T rather than a string", key, r.run.ID, value)
+	}
+	return s, nil
+}
+
+// getNumberSetting returns the run's setting of the given key, which is a number decoded from JSON. It fails if the
+// setting is missing or isn't a number.
+func (r *renderer) getNumberSetting(key string) (float64, error) {
+	value, ok := r.run.Settings[key]
+	if !ok {
+		return 0, fmt.Errorf("run %d doesn't have setting %s", r.run.ID, key)
+	}
+
+	n, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("setting %s of run %d is a %T rather than a number", key, r.run.ID, value)
+	}
+	return n, nil
+}
+
+func getPodAnnotations() map[string]string {
+	return map[string]string{
+		"prometheus.io/scrape": "true",
+		"prometheus.io/port":   strconv.Itoa(common.PortMetrics),
+		"prometheus.io/path":   "/metrics",
+	}
+}
+
+func (r *renderer) getVolumes() (volumes []corev1.Volume) {
+	toolsSource, _ := r.storage.ToolsVolume(fmt.Sprint(r.run.Settings[common.KeyAgentVersion]))
+	volumes = []corev1.Volume{
+		{
+			Name:         common.StorageVolumeNameTools,
+			VolumeSource: toolsSource,
+		},
+	}
+
+	for _, shared := range r.metadata.SharedVolumes {
+		volumes = append(volumes, corev1.Volume{
+			Name:         shared.Name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+
+	if len(r.metadata.Sidecars) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name:         common.StorageVolumeNameLifecycle,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+
+	if len(r.metadata.SecretFiles) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name:         common.StorageVolumeNameSecrets,
+			VolumeSource: corev1.VolumeSource{Projected: r.getSecretFilesSource()},
+		})
+	}
+
+	if !r.metadata.Storage {
+		return
+	}
+
+	artifactsSource, _ := r.storage.ArtifactsVolume(r.getStorageShare(), r.run.GetSecretName(r.metadata))
+	volumes = append(volumes,
+		corev1.Volume{
+			Name:         common.StorageVolumeNameArtifacts,
+			VolumeSource: artifactsSource,
+		})
+
+	return
+}
+
+// getSecretFilesSource projects the secret files from all their secrets and ConfigMaps into a single volume. Each
+// secret or ConfigMap is one source listing all the files it provides.
+func (r *renderer) getSecretFilesSource() *corev1.ProjectedVolumeSource {
+	projected := &corev1.ProjectedVolumeSource{}
+	secrets := make(map[string]*corev1.SecretProjection)
+	configMaps := make(map[string]*corev1.ConfigMapProjection)
+
+	for _, file := range r.metadata.SecretFiles {
+		if len(file.ConfigMapKey) > 0 {
+			if _, ok := configMaps[file.ConfigMap]; !ok {
+				projected.Sources = append(projected.Sources, corev1.VolumeProjection{
+					ConfigMap: &corev1.ConfigMapProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: file.ConfigMap},
+					},
+				})
+				configMaps[file.ConfigMap] = projected.Sources[len(projected.Sources)-1].ConfigMap
+			}
+
+			source := configMaps[file.ConfigMap]
+			source.Items = append(source.Items, corev1.KeyToPath{Key: file.ConfigMapKey, Path: file.Path, Mode: file.Mode})
+			continue
+		}
+
+		secretName := file.Secret
+		if len(secretName) == 0 {
+			secretName = r.run.GetSecretName(r.metadata)
+		}
+
+		if _, ok := secrets[secretName]; !ok {
+			projected.Sources = append(projected.Sources, corev1.VolumeProjection{
+				Secret: &corev1.SecretProjection{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				},
+			})
+			secrets[secretName] = projected.Sources[len(projected.Sources)-1].Secret
+		}
+
+		source := secrets[secretName]
+		source.Items = append(source.Items, corev1.KeyToPath{Key: file.SecretKey, Path: file.Path, Mode: file.Mode})
+	}
+
+	return projected
+}
+
+// getStorageShare returns the name of the run's artifacts share. It defaults to the product name.
+func (r *renderer) getStorageShare() string {
+	if share, ok := r.run.Settings[common.KeyStorageShare].(string); ok && len(share) > 0 {
+		return share
+	}
+
+	return r.metadata.Product
+}
+
+func (r *renderer) getToolsVolumeMount() corev1.VolumeMount {
+	_, subPath := r.storage.ToolsVolume(fmt.Sprint(r.run.Settings[common.KeyAgentVersion]))
+	return corev1.VolumeMount{
+		MountPath: common.PathMountTools,
+		Name:      common.StorageVolumeNameTools,
+		SubPath:   subPath,
+	}
+}
+
+// getImagePullSource returns the run's image pull secret. It is empty if the run doesn't have one.
+func (r *renderer) getImagePullSource() []corev1.LocalObjectReference {
+	if secret, ok := r.run.Settings[common.KeyImagePullSecret].(string); ok && len(secret) > 0 {
+		return []corev1.LocalObjectReference{{Name: secret}}
+	}
+
+	return nil
+}
+
+func (r *renderer) getContainerSpecs() (containers []corev1.Container, err error) {
+	resources, err := r.run.GetResources(r.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	requirements, err := resources.Requirements()
+	if err != nil {
+		return nil, err
+	}
+
+	envVars, err := r.getEnvironmentVariableDef()
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := r.getStringSetting(common.KeyImageName)
+	if err != nil {
+		return nil, err
+	}
+
+	c := corev1.Container{
+		Name:    "main",
+		Image:   image,
+		Env:     envVars,
+		Command: []string{common.PathMountTools + "/a01droid"},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "metrics",
+				ContainerPort: common.PortMetrics,
+			},
+			{
+				Name:          "health",
+				ContainerPort: common.PortHealth,
+			},
+		},
+		Resources:      requirements,
+		LivenessProbe:  getProbe(health.PathLiveness, 30),
+		ReadinessProbe: getProbe(health.PathReadiness, 10),
+	}
+
+	volumeMounts := []corev1.VolumeMount{r.getToolsVolumeMount()}
+
+	if r.metadata.Storage {
+		_, subPath := r.storage.ArtifactsVolume(r.getStorageShare(), r.run.GetSecretName(r.metadata))
+		mount := corev1.VolumeMount{
+			MountPath: common.PathMountArtifacts,
+			Name:      common.StorageVolumeNameArtifacts,
+			SubPath:   subPath,
+		}
+		if r.storage.SeparatesPods() {
+			// the directory is named after the pod
+			mount.SubPathExpr = fmt.Sprintf("$(%s)", common.EnvPodName)
+		}
+		volumeMounts = append(volumeMounts, mount)
+	}
+
+	if len(r.metadata.SecretFiles) > 0 {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			MountPath: common.PathMountSecrets,
+			Name:      common.StorageVolumeNameSecrets,
+		})
+	}
+
+	for _, shared := range r.metadata.SharedVolumes {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			MountPath: shared.Path,
+			Name:      shared.Name,
+		})
+	}
+
+	if len(r.metadata.Sidecars) > 0 {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			MountPath: common.PathMountLifecycle,
+			Name:      common.StorageVolumeNameLifecycle,
+		})
+	}
+
+	c.VolumeMounts = volumeMounts
+
+	return []corev1.Container{c}, nil
+}
+
+// getSidecarSpecs returns the sidecar containers defined in the metadata. The sidecar's command is wrapped by the
+// a01sidecar agent which stops the sidecar once the droid exits, so the Job completes.
+func (r *renderer) getSidecarSpecs() (containers []corev1.Container, err error) {
+	for _, def := range r.metadata.Sidecars {
+		if len(def.Command) == 0 {
+			return nil, fmt.Errorf("sidecar %s doesn't define the command", def.Name)
+		}
+
+		c, err := r.getMetadataContainerSpec(def)
+		if err != nil {
+			return nil, err
+		}
+		c.Command = append([]string{common.PathMountTools + "/a01sidecar"}, def.Command...)
+		c.VolumeMounts = append(c.VolumeMounts,
+			r.getToolsVolumeMount(),
+			corev1.VolumeMount{
+				MountPath: common.PathMountLifecycle,
+				Name:      common.StorageVolumeNameLifecycle,
+			})
+
+		if def.Readiness != nil {
+			c.ReadinessProbe = &corev1.Probe{
+				ProbeHandler:  getReadinessHandler(def.Readiness),
+				PeriodSeconds: 10,
+			}
+		}
+
+		containers = append(containers, c)
+	}
+
+	return
+}
+
+// getInitContainerSpecs returns the init containers defined in the metadata
+func (r *renderer) getInitContainerSpecs() (containers []corev1.Container, err error) {
+	for _, def := range r.metadata.InitContainers {
+		c, err := r.getMetadataContainerSpec(def)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, c)
+	}
+
+	return
+}
+
+func (r *renderer) getMetadataContainerSpec(def models.DroidMetadataContainerDef) (corev1.Container, error) {
+	envVars, err := r.getMetadataEnvironmentVariables(def.Environments)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	c := corev1.Container{
+		Name:    def.Name,
+		Image:   def.Image,
+		Command: def.Command,
+		Args:    def.Args,
+		Env:     append(getPodEnvironmentVariables(), envVars...),
+	}
+
+	for _, port := range def.Ports {
+		c.Ports = append(c.Ports, corev1.ContainerPort{Name: port.Name, ContainerPort: port.Port})
+	}
+
+	for _, mount := range def.VolumeMounts {
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{MountPath: mount.Path, Name: mount.Name})
+	}
+
+	return c, nil
+}
+
+func getReadinessHandler(readiness *models.DroidMetadataReadinessDef) corev1.ProbeHandler {
+	if len(readiness.Path) == 0 {
+		return corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(int(readiness.Port))}}
+	}
+
+	return corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{
+			Path: readiness.Path,
+			Port: intstr.FromInt(int(readiness.Port)),
+		},
+	}
+}
+
+// getProbe returns a probe of the droid's health endpoint at the given path. The droid may spend a while preparing
+// the pod before it fetches the first task, so the probe tolerates a few minutes of failures.
+func getProbe(path string, initialDelaySeconds int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: path,
+				Port: intstr.FromInt(common.PortHealth),
+			},
+		},
+		InitialDelaySeconds: initialDelaySeconds,
+		PeriodSeconds:       30,
+		TimeoutSeconds:      10,
+		FailureThreshold:    5,
+	}
+}
+
+func (r *renderer) getEnvironmentVariableDef() ([]corev1.EnvVar, error) {
+	result := append(getPodEnvironmentVariables(), []corev1.EnvVar{
+		{
+			Name:  common.EnvJobName,
+			Value: r.jobName,
+		},
+		r.getStoreSecretEnvironmentVariable(),
+	}...)
+
+	envVars, err := r.getMetadataEnvironmentVariables(r.metadata.Environments)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, envVars...), nil
+}
+
+// getStoreSecretEnvironmentVariable returns the environment variable of the internal communication key of the store
+func (r *renderer) getStoreSecretEnvironmentVariable() corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: common.EnvKeyInternalCommunicationKey,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.storeSecret.Name},
+				Key:                  r.storeSecret.Key,
+			},
+		},
+	}
+}
+
+// getPodEnvironmentVariables returns the environment variables of the pod's name and node. They are defined before
+// the metadata's variables so the templates can reference them.
+func getPodEnvironmentVariables() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{
+			Name: common.EnvPodName,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		},
+		{
+			Name: common.EnvNodeName,
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{
+				FieldPath: "spec.nodeName"},
+			},
+		},
+	}
+}
+
+// getMetadataEnvironmentVariables translates the environment variables defined in the metadata
+func (r *renderer) getMetadataEnvironmentVariables(defs []models.DroidMetadataEnvDef) (result []corev1.EnvVar, err error) {
+	for _, def := range defs {
+		var envVar *corev1.EnvVar
+		switch def.Type {
+		case models.EnvTypeSecret:
+			envVar = &corev1.EnvVar{
+				Name: def.Name,
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: r.run.GetSecretName(r.metadata)},
+						Key:                  def.Value,
+					},
+				},
+			}
+		case models.EnvTypeArgumentSwitchLive:
+			if r.run.Settings[common.KeyLiveMode] == "True" {
+				envVar = &corev1.EnvVar{Name: def.Name, Value: def.Value}
+			}
+		case models.EnvTypeArgumentValueMode:
+			if _, ok := r.run.Settings[common.KeyTestModel]; ok {
+				mode, err := r.getStringSetting(common.KeyTestModel)
+				if err != nil {
+					return nil, err
+				}
+				envVar = &corev1.EnvVar{Name: def.Name, Value: mode}
+			}
+		case models.EnvTypeConfigMap:
+			envVar = &corev1.EnvVar{
+				Name: def.Name,
+				ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: def.ConfigMap},
+						Key:                  def.Value,
+					},
+				},
+			}
+		case models.EnvTypeLiteral:
+			envVar = &corev1.EnvVar{Name: def.Name, Value: def.Value}
+		case models.EnvTypeRunSetting:
+			if v, ok := r.run.Settings[def.Value]; ok {
+				value, err := formatSetting(v)
+				if err != nil {
+					return nil, fmt.Errorf("fail to format run setting %s: %s", def.Value, err.Error())
+				}
+				envVar = &corev1.EnvVar{Name: def.Name, Value: value}
+			}
+		case models.EnvTypeRunDetail:
+			if v, ok := r.run.Details[def.Value]; ok {
+				envVar = &corev1.EnvVar{Name: def.Name, Value: v}
+			}
+		case models.EnvTypeFieldRef:
+			envVar = &corev1.EnvVar{
+				Name: def.Name,
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: def.Value},
+				},
+			}
+		case models.EnvTypeTemplate:
+			value, err := def.RenderTemplate(models.NewEnvTemplateData(r.run, r.metadata.Product, r.jobName))
+			if err != nil {
+				return nil, err
+			}
+			envVar = &corev1.EnvVar{Name: def.Name, Value: value}
+		default:
+			return nil, fmt.Errorf("environment variable %s has unknown type %s", def.Name, def.Type)
+		}
+
+		if envVar != nil {
+			result = append(result, *envVar)
+		}
+	}
+
+	return result, nil
+}
+
+// formatSetting returns a run setting as an environment variable value. Strings are used as is. Other values are
+// encoded in JSON.
+func formatSetting(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
@@ -0,0 +1,336 @@
+package droidjob
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newTestRun() *models.Run {
+	return &models.Run{
+		ID:   42,
+		Name: "test run",
+		Settings: map[string]interface{}{
+			common.KeyImageName:       "a01test.azurecr.io/azurecli:latest",
+			common.KeyImagePullSecret: "azureclidev-registry",
+			common.KeyInitParallelism: float64(4),
+			common.KeyLiveMode:        "False",
+			common.KeyAgentVersion:    "latest",
+			common.KeyStorageShare:    "azurecli-share",
+		},
+		Details: map[string]string{},
+	}
+}
+
+func int32Ptr(v int32) *int32 {
+	return &v
+}
+
+func TestJobDefinitionSecretFiles(t *testing.T) {
+	for _, withStorage := range []bool{false, true} {
+		metadata := &models.DroidMetadata{
+			Kind:    models.DroidMetadataKind,
+			Version: models.DroidMetadataV4,
+			Product: "azurecli",
+			Storage: withStorage,
+			SecretFiles: []models.DroidMetadataFileDef{
+				{Path: "sp.pem", SecretKey: "sp.cert", Mode: int32Ptr(0400)},
+				{Path: "sp.key", SecretKey: "sp.key"},
+				{Path: "shared/kubeconfig", SecretKey: "kubeconfig", Secret: "shared-secrets"},
+				{Path: "settings.json", ConfigMap: "azurecli-config", ConfigMapKey: "settings"},
+			},
+		}
+
+		job, err := Render(newTestRun(), metadata, storage.DefaultConfig(), nil, "azurecli-42-abc")
+		if err != nil {
+			t.Fatalf("storage=%v: unexpected error: %s", withStorage, err)
+		}
+
+		spec := job.Spec.Template.Spec
+		assertValidPodSpec(t, spec)
+
+		var secrets *corev1.Volume
+		for i := range spec.Volumes {
+			if spec.Volumes[i].Name == common.StorageVolumeNameSecrets {
+				secrets = &spec.Volumes[i]
+			}
+		}
+		if secrets == nil || secrets.Projected == nil {
+			t.Fatalf("storage=%v: expect a projected secrets volume", withStorage)
+		}
+
+		sources := secrets.Projected.Sources
+		if len(sources) != 3 {
+			t.Fatalf("storage=%v: expect 3 projected sources but found %d", withStorage, len(sources))
+		}
+		if sources[0].Secret == nil || sources[0].Secret.Name != "azurecli" || len(sources[0].Secret.Items) != 2 {
+			t.Errorf("storage=%v: expect 2 files from the run's secret but found %+v", withStorage, sources[0])
+		} else if mode := sources[0].Secret.Items[0].Mode; mode == nil || *mode != 0400 {
+			t.Errorf("storage=%v: expect mode 0400 of sp.pem but found %v", withStorage, mode)
+		}
+		if sources[1].Secret == nil || sources[1].Secret.Name != "shared-secrets" {
+			t.Errorf("storage=%v: expect a file from shared-secrets but found %+v", withStorage, sources[1])
+		}
+		if sources[2].ConfigMap == nil || sources[2].ConfigMap.Name != "azurecli-config" {
+			t.Errorf("storage=%v: expect a file from azurecli-config but found %+v", withStorage, sources[2])
+		}
+
+		if !hasMount(spec.Containers[0], common.StorageVolumeNameSecrets, common.PathMountSecrets) {
+			t.Errorf("storage=%v: expect the secrets volume mounted at %s", withStorage, common.PathMountSecrets)
+		}
+		if hasMount(spec.Containers[0], common.StorageVolumeNameArtifacts, common.PathMountArtifacts) != withStorage {
+			t.Errorf("storage=%v: unexpected artifacts mount", withStorage)
+		}
+	}
+}
+
+func TestJobDefinitionWithoutSecretFiles(t *testing.T) {
+	metadata := &models.DroidMetadata{
+		Kind:    models.DroidMetadataKind,
+		Version: models.DroidMetadataV3,
+		Product: "azurecli",
+		Storage: true,
+	}
+
+	job, err := Render(newTestRun(), metadata, storage.DefaultConfig(), nil, "azurecli-42-abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	spec := job.Spec.Template.Spec
+	assertValidPodSpec(t, spec)
+
+	if hasMount(spec.Containers[0], common.StorageVolumeNameSecrets, common.PathMountSecrets) {
+		t.Error("expect no secrets volume mounted")
+	}
+}
+
+func hasMount(container corev1.Container, name string, mountPath string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == name && mount.MountPath == mountPath {
+			return true
+		}
+	}
+	return false
+}
+
+// assertValidPodSpec checks the rules of the Kubernetes API server's pod validation the generated spec could break
+func assertValidPodSpec(t *testing.T, spec corev1.PodSpec) {
+	t.Helper()
+
+	volumes := make(map[string]bool)
+	for _, volume := range spec.Volumes {
+		if volumes[volume.Name] {
+			t.Errorf("duplicate volume %s", volume.Name)
+		}
+		volumes[volume.Name] = true
+
+		sources := 0
+		for _, defined := range []bool{
+			volume.AzureFile != nil,
+			volume.Secret != nil,
+			volume.ConfigMap != nil,
+			volume.EmptyDir != nil,
+			volume.Projected != nil,
+			volume.PersistentVolumeClaim != nil,
+			volume.HostPath != nil,
+		} {
+			if defined {
+				sources++
+			}
+		}
+		if sources != 1 {
+			t.Errorf("volume %s defines %d sources", volume.Name, sources)
+		}
+
+		if volume.Projected != nil {
+			paths := make(map[string]bool)
+			for _, source := range volume.Projected.Sources {
+				var items []corev1.KeyToPath
+				if source.Secret != nil {
+					items = source.Secret.Items
+				} else if source.ConfigMap != nil {
+					items = source.ConfigMap.Items
+				}
+				for _, item := range items {
+					if paths[item.Path] {
+						t.Errorf("volume %s projects %s twice", volume.Name, item.Path)
+					}
+					paths[item.Path] = true
+				}
+			}
+		}
+	}
+
+	containers := make(map[string]bool)
+	for _, container := range append(spec.InitContainers, spec.Containers...) {
+		if containers[container.Name] {
+			t.Errorf("duplicate container %s", container.Name)
+		}
+		containers[container.Name] = true
+
+		mountPaths := make(map[string]bool)
+		for _, mount := range container.VolumeMounts {
+			if !volumes[mount.Name] {
+				t.Errorf("container %s mounts undefined volume %s", container.Name, mount.Name)
+			}
+			if mountPaths[mount.MountPath] {
+				t.Errorf("container %s mounts %s twice", container.Name, mount.MountPath)
+			}
+			mountPaths[mount.MountPath] = true
+			if len(mount.SubPath) > 0 && len(mount.SubPathExpr) > 0 {
+				t.Errorf("container %s mounts %s with both a sub path and a sub path expression", container.Name, mount.Name)
+			}
+		}
+	}
+}
+
+func TestJobDefinitionHostPath(t *testing.T) {
+	metadata := &models.DroidMetadata{
+		Kind:    models.DroidMetadataKind,
+		Version: models.DroidMetadataV3,
+		Product: "azurecli",
+		Storage: true,
+	}
+	config := &storage.Config{Backend: storage.BackendHostPath, HostPath: "/data", ToolsBackend: storage.BackendAzureFile}
+
+	job, err := Render(newTestRun(), metadata, config, nil, "azurecli-42-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := job.Spec.Template.Spec
+	assertValidPodSpec(t, spec)
+	if !hasMount(spec.Containers[0], common.StorageVolumeNameArtifacts, common.PathMountArtifacts) {
+		t.Fatal("expect the artifacts storage to be mounted")
+	}
+	for _, mount := range spec.Containers[0].VolumeMounts {
+		if mount.Name == common.StorageVolumeNameArtifacts && mount.SubPathExpr != "$("+common.EnvPodName+")" {
+			t.Errorf("expect each pod to mount its own directory of the node but found %+v", mount)
+		}
+	}
+}
+
+func TestRenderInvalidSettings(t *testing.T) {
+	metadata := &models.DroidMetadata{
+		Kind:         models.DroidMetadataKind,
+		Version:      models.DroidMetadataV3,
+		Product:      "azurecli",
+		Environments: []models.DroidMetadataEnvDef{{Name: "A01_TEST_MODE", Type: models.EnvTypeArgumentValueMode}},
+	}
+
+	for _, c := range []struct {
+		key   string
+		value interface{}
+		err   string
+	}{
+		{common.KeyInitParallelism, nil, "doesn't have setting " + common.KeyInitParallelism},
+		{common.KeyInitParallelism, "4", "setting " + common.KeyInitParallelism + " of run 42 is a string rather than a number"},
+		{common.KeyLiveMode, nil, "doesn't have setting " + common.KeyLiveMode},
+		{common.KeyLiveMode, true, "setting " + common.KeyLiveMode + " of run 42 is a bool rather than a string"},
+		{common.KeyImageName, nil, "doesn't have setting " + common.KeyImageName},
+		{common.KeyImageName, 42.0, "setting " + common.KeyImageName + " of run 42 is a float64 rather than a string"},
+		{common.KeyTestModel, 1.0, "setting " + common.KeyTestModel + " of run 42 is a float64 rather than a string"},
+	} {
+		run := newTestRun()
+		if c.value == nil {
+			delete(run.Settings, c.key)
+		} else {
+			run.Settings[c.key] = c.value
+		}
+
+		if _, err := Render(run, metadata, nil, nil, "azurecli-42-abc"); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s=%v: expect the error %q but found %v", c.key, c.value, c.err, err)
+		}
+	}
+}
+
+func TestRenderDispatcher(t *testing.T) {
+	metadata := &models.DroidMetadata{Kind: models.DroidMetadataKind, Version: models.DroidMetadataV3, Product: "azurecli"}
+	job, err := RenderDispatcher(newTestRun(), metadata, nil, &StoreSecret{Name: "a01-store", Key: "key"}, "a01dispatcher-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := job.Spec.Template.Spec
+	assertValidPodSpec(t, spec)
+
+	if job.Name != "a01dispatcher-42" || spec.ServiceAccountName != DispatcherServiceAccount {
+		t.Errorf("unexpected job %s run by %s", job.Name, spec.ServiceAccountName)
+	}
+	if spec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		t.Errorf("expect a failed dispatcher to be restarted but found %s", spec.RestartPolicy)
+	}
+
+	container := spec.Containers[0]
+	if container.Image != "a01test.azurecr.io/azurecli:latest" {
+		t.Errorf("expect the dispatcher to run in the run's image but found %s", container.Image)
+	}
+	if command := container.Command; len(command) != 3 || command[0] != "/mnt/tools/a01dispatcher" || command[2] != "42" {
+		t.Errorf("unexpected command %v", command)
+	}
+	if !hasMount(container, common.StorageVolumeNameTools, common.PathMountTools) {
+		t.Error("expect the agents to be mounted")
+	}
+	if hasMount(container, common.StorageVolumeNameArtifacts, common.PathMountArtifacts) {
+		t.Error("expect the artifacts storage not to be mounted when the product doesn't use it")
+	}
+
+	var secretRef *corev1.SecretKeySelector
+	for _, env := range container.Env {
+		if env.Name == common.EnvKeyInternalCommunicationKey {
+			secretRef = env.ValueFrom.SecretKeyRef
+		}
+	}
+	if secretRef == nil || secretRef.Name != "a01-store" || secretRef.Key != "key" {
+		t.Errorf("expect the configured secret of the store but found %v", secretRef)
+	}
+}
+
+func TestRenderDispatcherArtifacts(t *testing.T) {
+	metadata := &models.DroidMetadata{
+		Kind:    models.DroidMetadataKind,
+		Version: models.DroidMetadataV3,
+		Product: "azurecli",
+		Storage: true,
+	}
+
+	for backend, shared := range map[string]bool{
+		storage.BackendAzureFile: true,
+		storage.BackendPVC:       true,
+		storage.BackendHostPath:  false,
+		storage.BackendS3:        false,
+	} {
+		config := &storage.Config{
+			Backend:      backend,
+			ClaimName:    "artifacts",
+			HostPath:     "/data",
+			S3:           &storage.S3Config{Bucket: "artifacts"},
+			ToolsBackend: storage.BackendAzureFile,
+		}
+		job, err := RenderDispatcher(newTestRun(), metadata, config, nil, "a01dispatcher-42")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spec := job.Spec.Template.Spec
+		assertValidPodSpec(t, spec)
+		if mounted := hasMount(spec.Containers[0], common.StorageVolumeNameArtifacts, common.PathMountArtifacts); mounted != shared {
+			t.Errorf("%s: expect the artifacts storage to be mounted only when it is shared but found %v", backend, mounted)
+		}
+	}
+}
+
+func TestRenderDispatcherWithoutImage(t *testing.T) {
+	metadata := &models.DroidMetadata{Kind: models.DroidMetadataKind, Version: models.DroidMetadataV3, Product: "azurecli"}
+	run := newTestRun()
+	run.Settings[common.KeyImageName] = 42.0
+
+	if _, err := RenderDispatcher(run, metadata, nil, nil, "a01dispatcher-42"); err == nil {
+		t.Error("expect a run without image to fail to render")
+	}
+}
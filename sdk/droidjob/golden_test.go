@@ -0,0 +1,78 @@
+package droidjob
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/ghodss/yaml"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestRenderGolden compares the rendered Jobs with the manifests in testdata. Run the tests with -update after an
+// intended change of the Job spec and review the difference of the golden files.
+func TestRenderGolden(t *testing.T) {
+	cases := []struct {
+		golden   string
+		metadata string
+		storage  *storage.Config
+	}{
+		{golden: "azurecli.job.yaml", metadata: "azurecli.metadata.yml", storage: storage.DefaultConfig()},
+		{golden: "full.job.yaml", metadata: "full.metadata.yml", storage: storage.DefaultConfig()},
+		{
+			golden:   "full-s3.job.yaml",
+			metadata: "full.metadata.yml",
+			storage: &storage.Config{
+				Backend:        storage.BackendS3,
+				S3:             &storage.S3Config{Endpoint: "http://minio:9000", Bucket: "artifacts"},
+				ToolsBackend:   storage.BackendPVC,
+				ToolsClaimName: "a01-tools",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.golden, func(t *testing.T) {
+			metadata, err := models.ReadDroidMetadata(filepath.Join("testdata", c.metadata))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			run := newTestRun()
+			run.Details[common.KeyProduct] = metadata.Product
+
+			job, err := Render(run, metadata, c.storage, nil, "azurecli-42-abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertValidPodSpec(t, job.Spec.Template.Spec)
+
+			actual, err := yaml.Marshal(job)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			goldenPath := filepath.Join("testdata", c.golden)
+			if *update {
+				if err := ioutil.WriteFile(goldenPath, actual, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("the rendered job differs from %s. Run the tests with -update if the change is intended.\n%s",
+					goldenPath, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defines the paths of the health endpoints
+const (
+	PathLiveness  = "/healthz"
+	PathReadiness = "/readyz"
+)
+
+// Defines the status reported by the health endpoints
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// checkTimeout bounds the time spent on all the checks of a probe
+const checkTimeout = 5 * time.Second
+
+// Check returns an error if a dependency is unhealthy
+type Check func(ctx context.Context) error
+
+// TaskStatus describes the task being executed
+type TaskStatus struct {
+	Identifier string    `json:"identifier"`
+	Started    time.Time `json:"started"`
+}
+
+// Report is the body returned by the health endpoints
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+	Task   *TaskStatus       `json:"task,omitempty"`
+}
+
+// Server reports the health of an agent over HTTP. The liveness endpoint runs the liveness checks. The readiness
+// endpoint runs both the liveness and the readiness checks. Both return 503 if any check fails.
+type Server struct {
+	lock      sync.RWMutex
+	liveness  map[string]Check
+	readiness map[string]Check
+	task      *TaskStatus
+}
+
+// NewServer returns a health server without any check
+func NewServer() *Server {
+	return &Server{
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+	}
+}
+
+// AddLivenessCheck adds a check whose failure means the agent should be restarted
+func (server *Server) AddLivenessCheck(name string, check Check) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.liveness[name] = check
+}
+
+// AddReadinessCheck adds a check whose failure means the agent can't make progress for now
+func (server *Server) AddReadinessCheck(name string, check Check) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.readiness[name] = check
+}
+
+// SetTask records the task being executed. An empty identifier clears it.
+func (server *Server) SetTask(identifier string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if len(identifier) == 0 {
+		server.task = nil
+		return
+	}
+
+	server.task = &TaskStatus{Identifier: identifier, Started: time.Now().UTC()}
+}
+
+// Handler returns the HTTP handler serving the health endpoints
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathLiveness, func(w http.ResponseWriter, r *http.Request) {
+		server.respond(w, r, false)
+	})
+	mux.HandleFunc(PathReadiness, func(w http.ResponseWriter, r *http.Request) {
+		server.respond(w, r, true)
+	})
+
+	return mux
+}
+
+// Serve exposes the health endpoints on the given address in the background
+func (server *Server) Serve(address string) {
+	go func() {
+		if err := http.ListenAndServe(address, server.Handler()); err != nil {
+			logrus.Errorf("Health endpoint stopped: %s", err)
+		}
+	}()
+}
+
+func (server *Server) respond(w http.ResponseWriter, r *http.Request, readiness bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	report := server.check(ctx, readiness)
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logrus.Warnf("Failed to write the health report: %s", err)
+	}
+}
+
+func (server *Server) check(ctx context.Context, readiness bool) Report {
+	server.lock.RLock()
+	checks := make(map[string]Check, len(server.liveness)+len(server.readiness))
+	for name, check := range server.liveness {
+		checks[name] = check
+	}
+	if readiness {
+		for name, check := range server.readiness {
+			checks[name] = check
+		}
+	}
+	var task *TaskStatus
+	if server.task != nil {
+		copied := *server.task
+		task = &copied
+	}
+	server.lock.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]string, len(checks)), Task: task}
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			report.Status = StatusFailed
+			report.Checks[name] = err.Error()
+		} else {
+			report.Checks[name] = StatusOK
+		}
+	}
+
+	return report
+}
@@ -2,15 +2,56 @@ package httputils
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
 )
 
+// Client sends requests to the store
+type Client struct {
+	// Endpoint is the base URL of the store API
+	Endpoint string
+
+	// Authorization is the value of the Authorization header sent with every request
+	Authorization string
+
+	// HTTPClient is the client used to send requests
+	HTTPClient *http.Client
+
+	// Retry is the retry policy of every request
+	Retry RetryPolicy
+}
+
+// DefaultClient is the client used by CreateRequest and SendRequest. It is configured from the environment.
+var DefaultClient = NewClientFromEnv()
+
+// NewClient returns a client of the store at the given endpoint using the DefaultRetryPolicy. A HTTP client with a
+// default timeout is used if httpClient is nil.
+func NewClient(endpoint string, authorization string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 60 * time.Second}
+	}
+
+	return &Client{
+		Endpoint:      endpoint,
+		Authorization: authorization,
+		HTTPClient:    httpClient,
+		Retry:         DefaultRetryPolicy,
+	}
+}
+
+// NewClientFromEnv returns a client whose endpoint and authorization are read from the environment
+func NewClientFromEnv() *Client {
+	return NewClient(getEndpointFromEnv(), os.Getenv(common.EnvKeyInternalCommunicationKey), nil)
+}
+
 // getEndpointFromEnv returns the endpoint defined in the environment
 func getEndpointFromEnv() string {
 	if endpoint, ok := os.LookupEnv(common.EnvKeyStoreName); ok {
@@ -20,46 +61,90 @@ func getEndpointFromEnv() string {
 	return fmt.Sprintf("http://%s/api", common.DNSNameTaskStore)
 }
 
-// CreateRequest returns a new HTTP request
-func CreateRequest(method string, path string, body []byte) (request *http.Request, err error) {
-	authorizationHeader := os.Getenv(common.EnvKeyInternalCommunicationKey)
-	endpoint := getEndpointFromEnv()
-
+// NewRequest returns a new HTTP request to the given path of the store
+func (client *Client) NewRequest(ctx context.Context, method string, path string, body []byte) (*http.Request, error) {
 	var buffer io.Reader
 	if body != nil {
 		buffer = bytes.NewBuffer(body)
 	}
 
-	request, err = http.NewRequest(method, fmt.Sprintf("%s/%s", endpoint, path), buffer)
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/%s", client.Endpoint, path), buffer)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create request: %s", err.Error())
 	}
 
-	request.Header.Set("Authorization", authorizationHeader)
+	request.Header.Set("Authorization", client.Authorization)
 	if body != nil {
 		request.Header.Set("Content-Type", "application/json")
 	}
 
-	return
+	return request.WithContext(ctx), nil
 }
 
-// SendRequest sends the given request and verify the response's status code
-func SendRequest(request *http.Request) ([]byte, error) {
-	httpClient := http.Client{CheckRedirect: nil}
-	resp, err := httpClient.Do(request)
-	if err != nil {
-		return nil, fmt.Errorf("http error: %s", err.Error())
+// NewJSONRequest returns a new HTTP request whose body is the given value encoded in JSON. The body is empty if the
+// value is nil.
+func (client *Client) NewJSONRequest(ctx context.Context, method string, path string, in interface{}) (*http.Request, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, fmt.Errorf("unable to marshal JSON: %s", err.Error())
+		}
 	}
 
-	defer resp.Body.Close()
-	respContent, err := ioutil.ReadAll(resp.Body)
+	return client.NewRequest(ctx, method, path, body)
+}
+
+// Send sends the given request and verify the response's status code. Connection errors and server side errors are
+// retried according to the client's retry policy.
+func (client *Client) Send(request *http.Request) ([]byte, error) {
+	begin := time.Now()
+	content, err := client.Retry.Send(client.HTTPClient, request)
+	metrics.ObserveStoreRequestContext(request.Context(), request.Method, begin, err)
+
+	return content, err
+}
+
+// SendJSON sends the given request and decodes the JSON response into out
+func (client *Client) SendJSON(request *http.Request, out interface{}) error {
+	respContent, err := client.Send(request)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read response body: %s", err.Error())
+		return err
+	}
+
+	if out == nil {
+		return nil
 	}
 
-	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("HTTP Status %d: %s", resp.StatusCode, string(respContent))
+	if err := json.Unmarshal(respContent, out); err != nil {
+		return fmt.Errorf("unable to unmarshal JSON: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Do sends a request whose body is encoded in JSON to the given path and decodes the JSON response into out
+func (client *Client) Do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	request, err := client.NewJSONRequest(ctx, method, path, in)
+	if err != nil {
+		return err
 	}
 
-	return respContent, nil
+	return client.SendJSON(request, out)
+}
+
+// CreateRequest returns a new HTTP request
+func CreateRequest(method string, path string, body []byte) (request *http.Request, err error) {
+	return CreateRequestContext(context.Background(), method, path, body)
+}
+
+// CreateRequestContext returns a new HTTP request bound to the given context
+func CreateRequestContext(ctx context.Context, method string, path string, body []byte) (*http.Request, error) {
+	return DefaultClient.NewRequest(ctx, method, path, body)
+}
+
+// SendRequest sends the given request and verify the response's status code. Connection errors and server side
+// errors are retried according to the DefaultRetryPolicy.
+func SendRequest(request *http.Request) ([]byte, error) {
+	return DefaultClient.Send(request)
 }
@@ -0,0 +1,120 @@
+package httputils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+type echoRequest struct {
+	Method        string
+	Path          string
+	Query         string
+	Authorization string
+	ContentType   string
+	Body          map[string]string
+}
+
+// newEchoServer responds to each request with the request it received encoded in JSON. The requests to /missing are
+// answered with 404.
+func newEchoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/missing" {
+			http.NotFound(w, r)
+			return
+		}
+
+		echo := echoRequest{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Query:         r.URL.RawQuery,
+			Authorization: r.Header.Get("Authorization"),
+			ContentType:   r.Header.Get("Content-Type"),
+		}
+		json.NewDecoder(r.Body).Decode(&echo.Body)
+		json.NewEncoder(w).Encode(echo)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClientDo(t *testing.T) {
+	server := newEchoServer(t)
+	client := NewClient(server.URL+"/api", "secret", server.Client())
+
+	var echo echoRequest
+	in := map[string]string{"name": "a"}
+	if err := client.Do(context.Background(), http.MethodPost, "run/42?tag=b", in, &echo); err != nil {
+		t.Fatal(err)
+	}
+
+	if echo.Method != http.MethodPost || echo.Path != "/api/run/42" || echo.Query != "tag=b" {
+		t.Errorf("expect the request to be sent to the path of the store but found %s %s?%s",
+			echo.Method, echo.Path, echo.Query)
+	}
+	if echo.Authorization != "secret" {
+		t.Errorf("expect the authorization of the client but found %q", echo.Authorization)
+	}
+	if echo.ContentType != "application/json" || echo.Body["name"] != "a" {
+		t.Errorf("expect the body to be encoded in JSON but found %q %v", echo.ContentType, echo.Body)
+	}
+}
+
+func TestClientDoWithoutBody(t *testing.T) {
+	server := newEchoServer(t)
+	client := NewClient(server.URL+"/api", "", server.Client())
+
+	var echo echoRequest
+	if err := client.Do(context.Background(), http.MethodGet, "runs", nil, &echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo.ContentType != "" || echo.Body != nil {
+		t.Errorf("expect a request without body but found %q %v", echo.ContentType, echo.Body)
+	}
+
+	// the response is ignored without output
+	if err := client.Do(context.Background(), http.MethodGet, "runs", nil, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientDoFails(t *testing.T) {
+	server := newEchoServer(t)
+	client := NewClient(server.URL+"/api", "", server.Client())
+
+	if err := client.Do(context.Background(), http.MethodGet, "missing", nil, nil); !IsStatus(err, http.StatusNotFound) {
+		t.Errorf("expect the status of the response but found %v", err)
+	}
+
+	var out []string
+	if err := client.Do(context.Background(), http.MethodGet, "runs", nil, &out); err == nil {
+		t.Error("expect a response which can't be decoded to fail")
+	}
+
+	if err := client.Do(context.Background(), http.MethodPost, "runs", make(chan int), nil); err == nil {
+		t.Error("expect a body which can't be encoded to fail")
+	}
+}
+
+func TestNewClientFromEnv(t *testing.T) {
+	t.Setenv(common.EnvKeyInternalCommunicationKey, "secret")
+
+	// the variable is restored when the test ends
+	t.Setenv(common.EnvKeyStoreName, "")
+	os.Unsetenv(common.EnvKeyStoreName)
+	if client := NewClientFromEnv(); client.Endpoint != "http://"+common.DNSNameTaskStore+"/api" {
+		t.Errorf("expect the endpoint of the store service but found %s", client.Endpoint)
+	}
+
+	t.Setenv(common.EnvKeyStoreName, "http://localhost:8080/api")
+	client := NewClientFromEnv()
+	if client.Endpoint != "http://localhost:8080/api" || client.Authorization != "secret" {
+		t.Errorf("expect the client to be configured from the environment but found %s %q",
+			client.Endpoint, client.Authorization)
+	}
+}
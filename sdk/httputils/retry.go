@@ -0,0 +1,143 @@
+package httputils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HeaderIdempotencyKey is the header the store uses to deduplicate retried requests which create resources
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// HeaderIfMatch is the header carrying the version a request to change a resource expects the store to hold
+const HeaderIfMatch = "If-Match"
+
+// RetryPolicy defines how a request to the store is retried when it fails with a connection error or a server side
+// error.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. It doubles after each attempt.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by SendRequest
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// StatusError is returned when the store responds with an unsuccessful status code
+type StatusError struct {
+	Code    int
+	Content []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP Status %d: %s", e.Code, string(e.Content))
+}
+
+// retryable returns true if a request failed with this error is worth retrying
+func (e *StatusError) retryable() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests || e.Code == http.StatusRequestTimeout
+}
+
+// IsStatus returns true if the error is a StatusError of the given status code
+func IsStatus(err error, code int) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.Code == code
+}
+
+// Send sends the request with the given client. The request is retried according to the policy till the request's
+// context is done. The request's body is rewound before each retry, therefore requests with a body must be created by
+// CreateRequest or Client.NewRequest.
+func (policy RetryPolicy) Send(client *http.Client, request *http.Request) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := policy.delay(attempt)
+			logrus.Warnf("Request %s %s failed: %s. Retry in %s.", request.Method, request.URL, lastErr, delay)
+			select {
+			case <-time.After(delay):
+			case <-request.Context().Done():
+				return nil, fmt.Errorf("request canceled: %s", lastErr)
+			}
+
+			if request.Body != nil {
+				if request.GetBody == nil {
+					return nil, fmt.Errorf("unable to rewind request body: %s", lastErr)
+				}
+
+				body, err := request.GetBody()
+				if err != nil {
+					return nil, fmt.Errorf("unable to rewind request body: %s", err.Error())
+				}
+				request.Body = body
+			}
+		}
+
+		content, err := sendOnce(client, request)
+		if err == nil {
+			return content, nil
+		}
+
+		lastErr = err
+		if se, ok := err.(*StatusError); ok && !se.retryable() {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("request failed after %d attempts: %s", policy.MaxAttempts, lastErr)
+}
+
+// delay returns a full jittered delay for the given attempt
+func (policy RetryPolicy) delay(attempt int) time.Duration {
+	ceiling := policy.BaseDelay << uint(attempt-1)
+	if ceiling <= 0 || ceiling > policy.MaxDelay {
+		ceiling = policy.MaxDelay
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(ceiling)))
+	if err != nil {
+		return ceiling
+	}
+
+	return time.Duration(n.Int64())
+}
+
+func sendOnce(client *http.Client, request *http.Request) ([]byte, error) {
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("http error: %s", err.Error())
+	}
+
+	defer resp.Body.Close()
+	respContent, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %s", err.Error())
+	}
+
+	if resp.StatusCode >= 300 {
+		return nil, &StatusError{Code: resp.StatusCode, Content: respContent}
+	}
+
+	return respContent, nil
+}
+
+// NewIdempotencyKey returns a random key to be sent in the HeaderIdempotencyKey header
+func NewIdempotencyKey() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
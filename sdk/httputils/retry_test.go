@@ -0,0 +1,185 @@
+package httputils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+// scriptedServer responds to each attempt with the next status of its script, then with 200. An attempt whose status
+// is 0 is dropped without response. The bodies of the requests are recorded.
+type scriptedServer struct {
+	sync.Mutex
+	script []int
+	bodies []string
+}
+
+func (server *scriptedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.Lock()
+	defer server.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	server.bodies = append(server.bodies, string(body))
+
+	status := http.StatusOK
+	if len(server.bodies) <= len(server.script) {
+		status = server.script[len(server.bodies)-1]
+	}
+
+	if status == 0 {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write([]byte(http.StatusText(status)))
+}
+
+func (server *scriptedServer) attempts() int {
+	server.Lock()
+	defer server.Unlock()
+	return len(server.bodies)
+}
+
+func newScriptedServer(t *testing.T, script ...int) (*scriptedServer, *httptest.Server) {
+	server := &scriptedServer{script: script}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+func TestSendRetries(t *testing.T) {
+	for _, status := range []int{
+		http.StatusInternalServerError,
+		http.StatusServiceUnavailable,
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		0, // connection error
+	} {
+		server, httpServer := newScriptedServer(t, status, status)
+
+		request, _ := http.NewRequest(http.MethodGet, httpServer.URL, nil)
+		content, err := testRetryPolicy.Send(httpServer.Client(), request)
+		if err != nil || string(content) != "OK" {
+			t.Errorf("%d: expect the request to succeed after the retries but found %v", status, err)
+		}
+		if attempts := server.attempts(); attempts != 3 {
+			t.Errorf("%d: expect 3 attempts but found %d", status, attempts)
+		}
+	}
+}
+
+func TestSendNotRetried(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusPreconditionFailed} {
+		server, httpServer := newScriptedServer(t, status)
+
+		request, _ := http.NewRequest(http.MethodGet, httpServer.URL, nil)
+		if _, err := testRetryPolicy.Send(httpServer.Client(), request); !IsStatus(err, status) {
+			t.Errorf("%d: expect the status error but found %v", status, err)
+		}
+		if attempts := server.attempts(); attempts != 1 {
+			t.Errorf("%d: expect a single attempt but found %d", status, attempts)
+		}
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	server, httpServer := newScriptedServer(t, 502, 502, 502, 502, 502)
+
+	request, _ := http.NewRequest(http.MethodGet, httpServer.URL, nil)
+	_, err := testRetryPolicy.Send(httpServer.Client(), request)
+	if err == nil || !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Errorf("expect the request to fail after 4 attempts but found %v", err)
+	}
+	if attempts := server.attempts(); attempts != testRetryPolicy.MaxAttempts {
+		t.Errorf("expect %d attempts but found %d", testRetryPolicy.MaxAttempts, attempts)
+	}
+}
+
+func TestSendRewindsBody(t *testing.T) {
+	server, httpServer := newScriptedServer(t, http.StatusServiceUnavailable, 0)
+
+	// the request of a bytes.Reader body can get its body again
+	request, _ := http.NewRequest(http.MethodPost, httpServer.URL, bytes.NewReader([]byte(`{"name":"a"}`)))
+	if _, err := testRetryPolicy.Send(httpServer.Client(), request); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.bodies) != 3 {
+		t.Fatalf("expect 3 attempts but found %d", len(server.bodies))
+	}
+	for i, body := range server.bodies {
+		if body != `{"name":"a"}` {
+			t.Errorf("expect the body to be sent again at attempt %d but found %q", i, body)
+		}
+	}
+}
+
+func TestSendWithoutGetBody(t *testing.T) {
+	server, httpServer := newScriptedServer(t, http.StatusServiceUnavailable)
+
+	request, _ := http.NewRequest(http.MethodPost, httpServer.URL, ioutil.NopCloser(strings.NewReader("a")))
+	request.GetBody = nil
+	_, err := testRetryPolicy.Send(httpServer.Client(), request)
+	if err == nil || !strings.Contains(err.Error(), "unable to rewind request body") {
+		t.Errorf("expect a body which can't be rewound to stop the retries but found %v", err)
+	}
+	if attempts := server.attempts(); attempts != 1 {
+		t.Errorf("expect a single attempt but found %d", attempts)
+	}
+}
+
+func TestSendCanceled(t *testing.T) {
+	_, httpServer := newScriptedServer(t, 503, 503, 503, 503)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	request, _ := http.NewRequest(http.MethodGet, httpServer.URL, nil)
+	request = request.WithContext(ctx)
+	if _, err := policy.Send(httpServer.Client(), request); err == nil {
+		t.Error("expect a canceled request to stop retrying")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, ceiling := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+		// the doubled delay overflows
+		80: time.Second,
+	} {
+		var max time.Duration
+		for i := 0; i < 200; i++ {
+			delay := policy.delay(attempt)
+			if delay < 0 || delay >= ceiling {
+				t.Fatalf("attempt %d: expect a delay in [0, %s) but found %s", attempt, ceiling, delay)
+			}
+			if delay > max {
+				max = delay
+			}
+		}
+
+		// the delays are jittered over the whole range
+		if max < ceiling/2 {
+			t.Errorf("attempt %d: expect jittered delays up to %s but found at most %s", attempt, ceiling, max)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package kubeutils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os/user"
@@ -14,11 +15,9 @@ import (
 )
 
 // CreateKubeClientset creates a new kubernetes clientset
-func CreateKubeClientset() (clientset *kubernetes.Clientset, err error) {
-	var config *rest.Config
-
+func CreateKubeClientset() (clientset kubernetes.Interface, err error) {
 	// Always try to get in-cluster config first
-	config, err = rest.InClusterConfig()
+	config, err := rest.InClusterConfig()
 	if err != nil {
 		currentUser, err := user.Current()
 		if err != nil {
@@ -41,7 +40,7 @@ func CreateKubeClientset() (clientset *kubernetes.Clientset, err error) {
 }
 
 // TryCreateKubeClientset creates a new kubernetes clientset. If it fails return nil
-func TryCreateKubeClientset() *kubernetes.Clientset {
+func TryCreateKubeClientset() kubernetes.Interface {
 	if client, err := CreateKubeClientset(); err == nil {
 		return client
 	}
@@ -50,12 +49,18 @@ func TryCreateKubeClientset() *kubernetes.Clientset {
 
 // TryGetSystemConfig retrieves the value of given key in a01 system config.
 func TryGetSystemConfig(key string) (value string, exists bool) {
+	return TryGetSystemConfigContext(context.Background(), key)
+}
+
+// TryGetSystemConfigContext retrieves the value of given key in a01 system config. It gives up when the context is
+// done.
+func TryGetSystemConfigContext(ctx context.Context, key string) (value string, exists bool) {
 	clientset := TryCreateKubeClientset()
 	if clientset == nil {
 		return "", false
 	}
 
-	configmap, err := clientset.CoreV1().ConfigMaps(common.GetCurrentNamespace("default")).Get(common.SystemConfigMapName, metav1.GetOptions{})
+	configmap, err := clientset.CoreV1().ConfigMaps(common.GetCurrentNamespace("default")).Get(ctx, common.SystemConfigMapName, metav1.GetOptions{})
 	if err != nil {
 		return "", false
 	}
@@ -66,12 +71,18 @@ func TryGetSystemConfig(key string) (value string, exists bool) {
 
 // TryGetSecretInBytes retrieves the value of given key in the given secret in current namespace.
 func TryGetSecretInBytes(secret string, key string) (value []byte, exists bool) {
+	return TryGetSecretInBytesContext(context.Background(), secret, key)
+}
+
+// TryGetSecretInBytesContext retrieves the value of given key in the given secret in current namespace. It gives up
+// when the context is done.
+func TryGetSecretInBytesContext(ctx context.Context, secret string, key string) (value []byte, exists bool) {
 	clientset := TryCreateKubeClientset()
 	if clientset == nil {
 		return nil, false
 	}
 
-	sec, err := clientset.CoreV1().Secrets(common.GetCurrentNamespace("default")).Get(secret, metav1.GetOptions{})
+	sec, err := clientset.CoreV1().Secrets(common.GetCurrentNamespace("default")).Get(ctx, secret, metav1.GetOptions{})
 	if err != nil {
 		return nil, false
 	}
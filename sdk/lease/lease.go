@@ -0,0 +1,281 @@
+// Package lease implements a lock held through a coordination.k8s.io/v1 Lease. Only one holder holds the lease
+// at a time. A holder which stops renewing the lease loses it once the lease duration passes.
+//
+// The service account needs the get, create and update permissions on leases in the coordination.k8s.io group.
+package lease
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Defines the default timing of a lease
+const (
+	DefaultDuration      = 60 * time.Second
+	DefaultRenewDeadline = 40 * time.Second
+	DefaultRetryPeriod   = 10 * time.Second
+)
+
+// Lease is a lock held through a Kubernetes Lease object
+type Lease struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+	Identity  string
+
+	// Duration is how long other candidates wait before they take over a lease which is no longer renewed
+	Duration time.Duration
+
+	// RenewDeadline is how long the holder keeps trying to renew the lease before it considers the lease lost. It
+	// must be shorter than Duration, so the holder stops before another candidate takes over.
+	RenewDeadline time.Duration
+
+	// RetryPeriod is the time between two attempts to acquire or renew the lease
+	RetryPeriod time.Duration
+
+	now func() time.Time
+
+	// the record of the Lease object last observed and the time it was renewed at. It is the lease's renew time, or the
+	// local time the record was first observed at if that is earlier, so a clock running behind the holder's doesn't
+	// delay the expiration. A candidate created after the holder stopped renewing sees the lease expire on time.
+	observedRecord string
+	observedAt     time.Time
+
+	lost int32
+}
+
+// New returns a lease of the given name in the namespace with the default timing
+func New(client kubernetes.Interface, namespace string, name string, identity string) *Lease {
+	return &Lease{
+		Client:        client,
+		Namespace:     namespace,
+		Name:          name,
+		Identity:      identity,
+		Duration:      DefaultDuration,
+		RenewDeadline: DefaultRenewDeadline,
+		RetryPeriod:   DefaultRetryPeriod,
+		now:           time.Now,
+	}
+}
+
+// Acquire blocks till the lease is acquired or the context is done
+func (lease *Lease) Acquire(ctx context.Context) error {
+	logrus.Infof("Acquiring lease %s/%s as %s ...", lease.Namespace, lease.Name, lease.Identity)
+	for {
+		acquired, err := lease.tryAcquireOrRenew(ctx)
+		if err != nil {
+			logrus.Warnf("Fail to acquire lease %s: %s", lease.Name, err)
+		} else if acquired {
+			logrus.Infof("Acquired lease %s.", lease.Name)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lease.RetryPeriod):
+		}
+	}
+}
+
+// TryAcquire acquires the lease if it is free or expired, and returns false without waiting if another holder holds it
+func (lease *Lease) TryAcquire(ctx context.Context) (bool, error) {
+	return lease.tryAcquireOrRenew(ctx)
+}
+
+// Hold renews the lease in the background till the context is done. The returned context is canceled once the lease
+// is lost, which happens when another candidate takes it over or the lease isn't renewed before the renew deadline.
+func (lease *Lease) Hold(ctx context.Context) context.Context {
+	held, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer cancel()
+
+		renewed := lease.now()
+		for {
+			select {
+			case <-held.Done():
+				return
+			case <-time.After(lease.RetryPeriod):
+			}
+
+			acquired, err := lease.tryAcquireOrRenew(held)
+			if held.Err() != nil {
+				return
+			}
+
+			if acquired {
+				renewed = lease.now()
+				continue
+			}
+
+			if err != nil && lease.now().Sub(renewed) < lease.RenewDeadline {
+				logrus.Warnf("Fail to renew lease %s: %s", lease.Name, err)
+				continue
+			}
+
+			atomic.StoreInt32(&lease.lost, 1)
+			logrus.Warnf("Lost lease %s.", lease.Name)
+			return
+		}
+	}()
+
+	return held
+}
+
+// Lost returns true if the lease was lost while it was held
+func (lease *Lease) Lost() bool {
+	return atomic.LoadInt32(&lease.lost) == 1
+}
+
+// Release gives up the lease, so another candidate can acquire it without waiting for it to expire
+func (lease *Lease) Release(ctx context.Context) error {
+	if lease.Lost() {
+		return nil
+	}
+
+	current, err := lease.get(ctx)
+	if err != nil {
+		return err
+	} else if current == nil || current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != lease.Identity {
+		return nil
+	}
+
+	released := current.DeepCopy()
+	released.Spec.HolderIdentity = nil
+	_, err = lease.Client.CoordinationV1().Leases(lease.Namespace).Update(ctx, released, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("fail to release lease %s: %s", lease.Name, err.Error())
+	}
+
+	logrus.Infof("Released lease %s.", lease.Name)
+	return nil
+}
+
+// tryAcquireOrRenew acquires the lease if it is free or expired, or renews it if it is held by this holder. It returns
+// false if the lease is held by another holder. The Lease object is updated with its resource version, so only one of
+// the candidates acquiring the lease at the same time succeeds.
+func (lease *Lease) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	current, err := lease.get(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	now := lease.now()
+	durationSeconds := int32(lease.Duration / time.Second)
+	renewTime := metav1.NewMicroTime(now)
+
+	if current == nil {
+		var transitions int32
+		created := &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: lease.Name, Namespace: lease.Namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &lease.Identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+				LeaseTransitions:     &transitions,
+			},
+		}
+
+		created, err = lease.Client.CoordinationV1().Leases(lease.Namespace).Create(ctx, created, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("fail to create lease %s: %s", lease.Name, err.Error())
+		}
+
+		lease.observe(created, now)
+		return true, nil
+	}
+
+	if record(current) != lease.observedRecord || lease.observedAt.IsZero() {
+		lease.observe(current, renewedAt(current, now))
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+
+	if len(holder) > 0 && holder != lease.Identity && now.Before(lease.observedAt.Add(leaseDuration(current, lease.Duration))) {
+		return false, nil
+	}
+
+	updated := current.DeepCopy()
+	if holder != lease.Identity {
+		var transitions int32
+		if current.Spec.LeaseTransitions != nil {
+			transitions = *current.Spec.LeaseTransitions + 1
+		}
+		updated.Spec.HolderIdentity = &lease.Identity
+		updated.Spec.AcquireTime = &renewTime
+		updated.Spec.LeaseTransitions = &transitions
+	}
+	updated.Spec.RenewTime = &renewTime
+	updated.Spec.LeaseDurationSeconds = &durationSeconds
+
+	updated, err = lease.Client.CoordinationV1().Leases(lease.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	if errors.IsConflict(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("fail to update lease %s: %s", lease.Name, err.Error())
+	}
+
+	lease.observe(updated, now)
+	return true, nil
+}
+
+// get returns the Lease object, or nil if it doesn't exist
+func (lease *Lease) get(ctx context.Context) (*coordinationv1.Lease, error) {
+	current, err := lease.Client.CoordinationV1().Leases(lease.Namespace).Get(ctx, lease.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to get lease %s: %s", lease.Name, err.Error())
+	}
+
+	return current, nil
+}
+
+func (lease *Lease) observe(current *coordinationv1.Lease, now time.Time) {
+	lease.observedRecord = record(current)
+	lease.observedAt = now
+}
+
+// record identifies the state of the Lease object. It changes whenever the lease is acquired, renewed or released.
+func record(current *coordinationv1.Lease) string {
+	holder, renewTime := "", ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if current.Spec.RenewTime != nil {
+		renewTime = current.Spec.RenewTime.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%s/%s/%s", current.ResourceVersion, holder, renewTime)
+}
+
+// renewedAt returns the renew time of the Lease object, or now if the lease isn't renewed yet or its renew time is later
+// than now
+func renewedAt(current *coordinationv1.Lease, now time.Time) time.Time {
+	if current.Spec.RenewTime == nil || current.Spec.RenewTime.After(now) {
+		return now
+	}
+	return current.Spec.RenewTime.Time
+}
+
+// leaseDuration returns the duration the holder of the Lease object set, or the default if it isn't set
+func leaseDuration(current *coordinationv1.Lease, defaultDuration time.Duration) time.Duration {
+	if current.Spec.LeaseDurationSeconds == nil {
+		return defaultDuration
+	}
+	return time.Duration(*current.Spec.LeaseDurationSeconds) * time.Second
+}
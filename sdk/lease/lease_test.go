@@ -0,0 +1,278 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testNamespace = "a01-test"
+	testName      = "a01dispatcher-42"
+)
+
+// clock is a fake clock shared by the candidates of a test
+type clock struct {
+	sync.Mutex
+	current time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.current
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.current = c.current.Add(d)
+}
+
+func newTestLease(client *fake.Clientset, c *clock, identity string) *Lease {
+	lease := New(client, testNamespace, testName, identity)
+	lease.RetryPeriod = 10 * time.Millisecond
+	lease.RenewDeadline = 50 * time.Millisecond
+	lease.now = c.now
+	return lease
+}
+
+func acquireShortly(lease *Lease) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	return lease.Acquire(ctx)
+}
+
+func getHolder(t *testing.T, client *fake.Clientset) string {
+	t.Helper()
+
+	current, err := client.CoordinationV1().Leases(testNamespace).Get(context.Background(), testName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *current.Spec.HolderIdentity
+}
+
+func TestAcquire(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	if err := acquireShortly(newTestLease(client, c, "dispatcher-a")); err != nil {
+		t.Fatal(err)
+	}
+	if holder := getHolder(t, client); holder != "dispatcher-a" {
+		t.Errorf("expect dispatcher-a to hold the lease but found %q", holder)
+	}
+
+	if err := acquireShortly(newTestLease(client, c, "dispatcher-b")); err != context.DeadlineExceeded {
+		t.Errorf("expect dispatcher-b to wait for the lease but found %v", err)
+	}
+	if holder := getHolder(t, client); holder != "dispatcher-a" {
+		t.Errorf("expect dispatcher-a to keep the lease but found %q", holder)
+	}
+}
+
+func TestAcquireAfterRelease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	first := newTestLease(client, c, "dispatcher-a")
+	if err := acquireShortly(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := acquireShortly(newTestLease(client, c, "dispatcher-b")); err != nil {
+		t.Fatalf("expect a released lease to be acquired but found %s", err)
+	}
+	if holder := getHolder(t, client); holder != "dispatcher-b" {
+		t.Errorf("expect dispatcher-b to hold the lease but found %q", holder)
+	}
+}
+
+func TestAcquireExpired(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	if err := acquireShortly(newTestLease(client, c, "dispatcher-a")); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestLease(client, c, "dispatcher-b")
+	if err := acquireShortly(second); err != context.DeadlineExceeded {
+		t.Fatalf("expect dispatcher-b to wait for the lease but found %v", err)
+	}
+
+	// the expiration is measured from the time dispatcher-a last renewed the lease
+	c.advance(DefaultDuration + time.Second)
+	if err := acquireShortly(second); err != nil {
+		t.Fatalf("expect an expired lease to be taken over but found %s", err)
+	}
+
+	current, err := client.CoordinationV1().Leases(testNamespace).Get(context.Background(), testName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *current.Spec.HolderIdentity != "dispatcher-b" || *current.Spec.LeaseTransitions != 1 {
+		t.Errorf("expect dispatcher-b to take over the lease but found %+v", current.Spec)
+	}
+}
+
+func TestTryAcquireAbandoned(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	if err := acquireShortly(newTestLease(client, c, "dispatcher-a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// dispatcher-a stops renewing, and each attempt of dispatcher-b uses a new lease, as the controller does
+	for i := 0; i < 3; i++ {
+		c.advance(DefaultDuration / 4)
+		acquired, err := newTestLease(client, c, "dispatcher-b").TryAcquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if acquired {
+			t.Fatalf("expect dispatcher-b not to acquire the lease before it expires at attempt %d", i)
+		}
+	}
+
+	c.advance(DefaultDuration/4 + time.Second)
+	acquired, err := newTestLease(client, c, "dispatcher-b").TryAcquire(context.Background())
+	if err != nil || !acquired {
+		t.Fatalf("expect an abandoned lease to be taken over but found %v", err)
+	}
+	if holder := getHolder(t, client); holder != "dispatcher-b" {
+		t.Errorf("expect dispatcher-b to hold the lease but found %q", holder)
+	}
+}
+
+func TestAcquireRenewedByHolder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	first := newTestLease(client, c, "dispatcher-a")
+	if err := acquireShortly(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestLease(client, c, "dispatcher-b")
+	if err := acquireShortly(second); err != context.DeadlineExceeded {
+		t.Fatalf("expect dispatcher-b to wait for the lease but found %v", err)
+	}
+
+	// a lease renewed by its holder doesn't expire
+	c.advance(DefaultDuration / 2)
+	if acquired, err := first.tryAcquireOrRenew(context.Background()); !acquired || err != nil {
+		t.Fatalf("expect dispatcher-a to renew the lease but found %v", err)
+	}
+	c.advance(DefaultDuration/2 + time.Second)
+	if err := acquireShortly(second); err != context.DeadlineExceeded {
+		t.Errorf("expect dispatcher-b to wait for the renewed lease but found %v", err)
+	}
+}
+
+func TestHoldLost(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	first := newTestLease(client, c, "dispatcher-a")
+	if err := acquireShortly(first); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	held := first.Hold(ctx)
+
+	current, err := client.CoordinationV1().Leases(testNamespace).Get(context.Background(), testName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := "dispatcher-b"
+	current.Spec.HolderIdentity = &holder
+	if _, err := client.CoordinationV1().Leases(testNamespace).Update(context.Background(), current, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-held.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect the context to be canceled once the lease is lost")
+	}
+	if !first.Lost() {
+		t.Error("expect the lease to be lost")
+	}
+	if err := first.Release(context.Background()); err != nil || getHolder(t, client) != "dispatcher-b" {
+		t.Error("expect a lost lease not to be released")
+	}
+}
+
+func TestHoldRenewFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	first := newTestLease(client, c, "dispatcher-a")
+	if err := acquireShortly(first); err != nil {
+		t.Fatal(err)
+	}
+
+	client.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("the server is unavailable")
+	})
+	held := first.Hold(context.Background())
+
+	// the holder keeps trying till the renew deadline passes
+	time.Sleep(30 * time.Millisecond)
+	if first.Lost() {
+		t.Fatal("expect the lease to be held before the renew deadline")
+	}
+	c.advance(first.RenewDeadline)
+
+	select {
+	case <-held.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect the context to be canceled once the renew deadline passes")
+	}
+	if !first.Lost() {
+		t.Error("expect the lease to be lost")
+	}
+}
+
+func TestHoldCanceled(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := &clock{current: time.Now()}
+
+	first := newTestLease(client, c, "dispatcher-a")
+	if err := acquireShortly(first); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	held := first.Hold(ctx)
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+
+	<-held.Done()
+	if first.Lost() {
+		t.Error("expect the lease not to be lost when the holder stops")
+	}
+	if err := first.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if holder := getHolder(t, client); holder != "" {
+		t.Errorf("expect the lease to be released but found %q", holder)
+	}
+}
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/sirupsen/logrus"
+)
+
+// Defines the correlation fields attached to the log entries
+const (
+	FieldRunID   = "run_id"
+	FieldProduct = "product"
+	FieldJobName = "job_name"
+	FieldPodName = "pod_name"
+	FieldTask    = "task"
+)
+
+// contextHook attaches the current correlation fields to every log entry. Fields set explicitly on an entry take
+// precedence.
+type contextHook struct {
+	lock   sync.RWMutex
+	fields logrus.Fields
+}
+
+var hook = &contextHook{fields: logrus.Fields{}}
+
+func (h *contextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *contextHook) Fire(entry *logrus.Entry) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for key, value := range h.fields {
+		if _, exists := entry.Data[key]; !exists {
+			entry.Data[key] = value
+		}
+	}
+
+	return nil
+}
+
+// Setup configures the standard logger to output JSON with the given correlation fields attached to every entry.
+// The log level is read from the A01 system config. It defaults to info.
+func Setup(fields logrus.Fields) {
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.AddHook(hook)
+
+	for key, value := range fields {
+		SetField(key, value)
+	}
+
+	if value, exists := kubeutils.TryGetSystemConfig(common.ConfigKeyLogLevel); exists {
+		level, err := logrus.ParseLevel(value)
+		if err != nil {
+			logrus.Warnf("Invalid log level %q in system config: %s", value, err)
+		} else {
+			logrus.SetLevel(level)
+		}
+	}
+}
+
+// SetField attaches a correlation field to all the log entries written afterwards
+func SetField(key string, value interface{}) {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+
+	hook.fields[key] = value
+}
+
+// RemoveField stops attaching the correlation field to the log entries
+func RemoveField(key string) {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+
+	delete(hook.fields, key)
+}
@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const namespace = "a01"
+
+var (
+	tasksPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_published_total",
+		Help:      "Number of tasks published to the task broker.",
+	}, []string{"product", "run_id"})
+
+	tasksConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_consumed_total",
+		Help:      "Number of tasks consumed by a droid.",
+	}, []string{"product", "run_id", "pod"})
+
+	taskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_duration_seconds",
+		Help:      "Execution time of tasks by result.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14), // 1s to ~2h
+	}, []string{"product", "run_id", "result"})
+
+	storeRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_request_duration_seconds",
+		Help:      "Latency of requests to the task store, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"product", "run_id", "method"})
+
+	storeRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_request_errors_total",
+		Help:      "Number of requests to the task store which failed after all retries.",
+	}, []string{"product", "run_id", "method"})
+
+	brokerCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broker_call_duration_seconds",
+		Help:      "Latency of calls to the task broker.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"product", "run_id", "operation"})
+
+	brokerCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "broker_call_errors_total",
+		Help:      "Number of failed calls to the task broker.",
+	}, []string{"product", "run_id", "operation"})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_messages",
+		Help:      "Number of tasks in the run's queue observed by the dispatcher.",
+	}, []string{"product", "run_id"})
+
+	runStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "run_status",
+		Help:      "Current status of the run. The series of the current status is 1, others are 0.",
+	}, []string{"product", "run_id", "status"})
+)
+
+var runStatuses = []string{
+	common.RunStatusInitialized,
+	common.RunStatusPublished,
+	common.RunStatusRunning,
+	common.RunStatusCompleted,
+	common.RunStatusCanceled,
+}
+
+// the product and run labels attached to the metrics whose context doesn't carry a run
+var (
+	labelLock sync.RWMutex
+	product   = "unknown"
+	runID     = "unknown"
+)
+
+func init() {
+	prometheus.MustRegister(
+		tasksPublished,
+		tasksConsumed,
+		taskDuration,
+		storeRequestDuration,
+		storeRequestErrors,
+		brokerCallDuration,
+		brokerCallErrors,
+		queueDepth,
+		runStatus)
+}
+
+// SetRun sets the product and run ID labelled on all the metrics reported afterwards
+func SetRun(productName string, id string) {
+	labelLock.Lock()
+	defer labelLock.Unlock()
+
+	product = productName
+	runID = id
+}
+
+// runKey is the key of the run's labels in a context
+type runKey struct{}
+
+type runValue struct {
+	product string
+	runID   string
+}
+
+// WithRun returns a context carrying the product and run ID labelled on the metrics reported with it. A process which
+// drives several runs at once labels the metrics of each run this way rather than with SetRun.
+func WithRun(ctx context.Context, productName string, id string) context.Context {
+	return context.WithValue(ctx, runKey{}, runValue{product: productName, runID: id})
+}
+
+// runLabels returns the product and run ID carried by the context, or the ones set by SetRun otherwise
+func runLabels(ctx context.Context) (string, string) {
+	if run, ok := ctx.Value(runKey{}).(runValue); ok {
+		return run.product, run.runID
+	}
+
+	labelLock.RLock()
+	defer labelLock.RUnlock()
+
+	return product, runID
+}
+
+// Serve exposes the metrics at /metrics on the given address in the background
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logrus.Errorf("Metrics endpoint stopped: %s", err)
+		}
+	}()
+}
+
+// AddTasksPublished counts the tasks published to the task broker
+func AddTasksPublished(count int) {
+	AddTasksPublishedContext(context.Background(), count)
+}
+
+// AddTasksPublishedContext counts the tasks published to the task broker for the run of the context
+func AddTasksPublishedContext(ctx context.Context, count int) {
+	p, r := runLabels(ctx)
+	tasksPublished.WithLabelValues(p, r).Add(float64(count))
+}
+
+// ObserveTask counts a task consumed by the given pod and records its duration by result
+func ObserveTask(pod string, result string, duration time.Duration) {
+	p, r := runLabels(context.Background())
+	tasksConsumed.WithLabelValues(p, r, pod).Inc()
+	taskDuration.WithLabelValues(p, r, result).Observe(duration.Seconds())
+}
+
+// ObserveStoreRequest records the latency of a request to the store which began at the given time
+func ObserveStoreRequest(method string, begin time.Time, err error) {
+	ObserveStoreRequestContext(context.Background(), method, begin, err)
+}
+
+// ObserveStoreRequestContext records the latency of a request to the store for the run of the context
+func ObserveStoreRequestContext(ctx context.Context, method string, begin time.Time, err error) {
+	p, r := runLabels(ctx)
+	storeRequestDuration.WithLabelValues(p, r, method).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		storeRequestErrors.WithLabelValues(p, r, method).Inc()
+	}
+}
+
+// ObserveBrokerCall records the latency of a call to the task broker which began at the given time
+func ObserveBrokerCall(operation string, begin time.Time, err error) {
+	ObserveBrokerCallContext(context.Background(), operation, begin, err)
+}
+
+// ObserveBrokerCallContext records the latency of a call to the task broker for the run of the context
+func ObserveBrokerCallContext(ctx context.Context, operation string, begin time.Time, err error) {
+	p, r := runLabels(ctx)
+	brokerCallDuration.WithLabelValues(p, r, operation).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		brokerCallErrors.WithLabelValues(p, r, operation).Inc()
+	}
+}
+
+// SetQueueDepth records the number of tasks in the run's queue
+func SetQueueDepth(messages int) {
+	SetQueueDepthContext(context.Background(), messages)
+}
+
+// SetQueueDepthContext records the number of tasks in the queue of the run of the context
+func SetQueueDepthContext(ctx context.Context, messages int) {
+	p, r := runLabels(ctx)
+	queueDepth.WithLabelValues(p, r).Set(float64(messages))
+}
+
+// SetRunStatus records the current status of the run
+func SetRunStatus(status string) {
+	SetRunStatusContext(context.Background(), status)
+}
+
+// SetRunStatusContext records the current status of the run of the context
+func SetRunStatusContext(ctx context.Context, status string) {
+	p, r := runLabels(ctx)
+	for _, s := range runStatuses {
+		value := 0.0
+		if s == status {
+			value = 1.0
+		}
+		runStatus.WithLabelValues(p, r, s).Set(value)
+	}
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// getRunStatus returns the value of the run_status series of the given labels
+func getRunStatus(t *testing.T, labels ...string) float64 {
+	var metric dto.Metric
+	if err := runStatus.WithLabelValues(labels...).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestWithRun(t *testing.T) {
+	SetRun("azurecli", "1")
+	defer SetRun("unknown", "unknown")
+
+	// the runs driven at once by a dispatcher are labelled apart
+	SetRunStatusContext(WithRun(context.Background(), "azurecli", "42"), common.RunStatusRunning)
+	SetRunStatusContext(WithRun(context.Background(), "azurestorage", "43"), common.RunStatusPublished)
+	SetRunStatus(common.RunStatusCompleted)
+
+	for _, expected := range []struct {
+		product string
+		runID   string
+		status  string
+	}{
+		{"azurecli", "42", common.RunStatusRunning},
+		{"azurestorage", "43", common.RunStatusPublished},
+		{"azurecli", "1", common.RunStatusCompleted},
+	} {
+		if value := getRunStatus(t, expected.product, expected.runID, expected.status); value != 1 {
+			t.Errorf("expect run %s of %s to be %s but found %v", expected.runID, expected.product, expected.status, value)
+		}
+	}
+
+	if value := getRunStatus(t, "azurecli", "1", common.RunStatusRunning); value != 0 {
+		t.Errorf("expect the run set for the process not to take the status of the others but found %v", value)
+	}
+}
@@ -0,0 +1,41 @@
+package models
+
+// DroidMetadataContainerDef defines the data model of a sidecar or an init container in metadata.yml
+type DroidMetadataContainerDef struct {
+	Name         string                        `yaml:"name"`
+	Image        string                        `yaml:"image"`
+	Command      []string                      `yaml:"command"`
+	Args         []string                      `yaml:"args"`
+	Environments []DroidMetadataEnvDef         `yaml:"environments"`
+	Ports        []DroidMetadataPortDef        `yaml:"ports"`
+	VolumeMounts []DroidMetadataVolumeMountDef `yaml:"volumeMounts"`
+
+	// Readiness defines how the droid determines the sidecar is ready. It is ignored in init containers.
+	Readiness *DroidMetadataReadinessDef `yaml:"readiness"`
+}
+
+// DroidMetadataPortDef defines the data model of a container port in metadata.yml
+type DroidMetadataPortDef struct {
+	Name string `yaml:"name"`
+	Port int32  `yaml:"port"`
+}
+
+// DroidMetadataVolumeDef defines the data model of a volume shared by the containers in the droid pod. The volume is
+// mounted at the path in the test container.
+type DroidMetadataVolumeDef struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+// DroidMetadataVolumeMountDef defines the data model of a shared volume mounted in a sidecar or an init container
+type DroidMetadataVolumeMountDef struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+// DroidMetadataReadinessDef defines the data model of a sidecar's readiness check. The sidecar is ready when the
+// path on the port returns a successful HTTP status, or when the port accepts TCP connections if the path is empty.
+type DroidMetadataReadinessDef struct {
+	Port int32  `yaml:"port"`
+	Path string `yaml:"path"`
+}
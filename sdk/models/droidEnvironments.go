@@ -0,0 +1,159 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+// Defines the types of the environment variables in metadata.yml
+const (
+	// EnvTypeSecret reads the value from the key in the run's secret
+	EnvTypeSecret = "secret"
+
+	// EnvTypeArgumentSwitchLive defines the variable with the value if the run is live
+	EnvTypeArgumentSwitchLive = "argument-switch-live"
+
+	// EnvTypeArgumentValueMode sets the variable to the run's test mode
+	EnvTypeArgumentValueMode = "argument-value-mode"
+
+	// EnvTypeConfigMap reads the value from the key in a ConfigMap
+	EnvTypeConfigMap = "configmap"
+
+	// EnvTypeLiteral sets the variable to the value as is
+	EnvTypeLiteral = "literal"
+
+	// EnvTypeRunSetting sets the variable to the run setting of the key
+	EnvTypeRunSetting = "run-setting"
+
+	// EnvTypeRunDetail sets the variable to the run detail of the key
+	EnvTypeRunDetail = "run-detail"
+
+	// EnvTypeFieldRef sets the variable to a field of the pod through the downward API
+	EnvTypeFieldRef = "field-ref"
+
+	// EnvTypeTemplate sets the variable to the value rendered as a Go template over EnvTemplateData
+	EnvTypeTemplate = "template"
+)
+
+// envTypes are the environment variable types supported in metadata.yml
+var envTypes = []string{
+	EnvTypeSecret,
+	EnvTypeArgumentSwitchLive,
+	EnvTypeArgumentValueMode,
+	EnvTypeConfigMap,
+	EnvTypeLiteral,
+	EnvTypeRunSetting,
+	EnvTypeRunDetail,
+	EnvTypeFieldRef,
+	EnvTypeTemplate,
+}
+
+// fieldRefPattern matches the pod fields the downward API exposes to environment variables
+var fieldRefPattern = regexp.MustCompile(
+	`^(metadata\.(name|namespace|uid)|metadata\.(labels|annotations)\['[^']+'\]|spec\.(nodeName|serviceAccountName)|status\.(hostIP|podIP))$`)
+
+// EnvTemplateData is the data the template type environment variables are rendered with
+type EnvTemplateData struct {
+	Run     *Run
+	Product string
+	Job     EnvTemplateJob
+	Pod     EnvTemplatePod
+}
+
+// EnvTemplateJob describes the droid job in EnvTemplateData
+type EnvTemplateJob struct {
+	Name string
+}
+
+// EnvTemplatePod describes the droid pod in EnvTemplateData. The pod doesn't exist when the template is rendered, so
+// the values are references to the pod's environment variables which Kubernetes expands when the container starts.
+type EnvTemplatePod struct {
+	Name string
+	Node string
+}
+
+// NewEnvTemplateData returns the template data of the given run and job
+func NewEnvTemplateData(run *Run, product string, jobName string) EnvTemplateData {
+	return EnvTemplateData{
+		Run:     run,
+		Product: product,
+		Job:     EnvTemplateJob{Name: jobName},
+		Pod: EnvTemplatePod{
+			Name: fmt.Sprintf("$(%s)", common.EnvPodName),
+			Node: fmt.Sprintf("$(%s)", common.EnvNodeName),
+		},
+	}
+}
+
+// RenderTemplate renders the value of a template type environment variable
+func (def DroidMetadataEnvDef) RenderTemplate(data EnvTemplateData) (string, error) {
+	tmpl, err := template.New(def.Name).Option("missingkey=error").Parse(def.Value)
+	if err != nil {
+		return "", fmt.Errorf("invalid template of environment variable %s: %s", def.Name, err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("fail to render environment variable %s: %s", def.Name, err.Error())
+	}
+
+	return buf.String(), nil
+}
+
+// validate returns the problems of the environment variable definition
+func (def DroidMetadataEnvDef) validate(envPath string) (problems []string) {
+	if !isEnvType(def.Type) {
+		return []string{fmt.Sprintf("%s.type: unknown type %q. Supported types are %s.",
+			envPath, def.Type, strings.Join(envTypes, ", "))}
+	}
+
+	switch def.Type {
+	case EnvTypeSecret, EnvTypeConfigMap, EnvTypeRunSetting, EnvTypeRunDetail, EnvTypeFieldRef, EnvTypeTemplate:
+		if len(def.Value) == 0 {
+			return []string{fmt.Sprintf("%s.value: is required by type %s", envPath, def.Type)}
+		}
+	}
+
+	if def.Type == EnvTypeConfigMap && len(def.ConfigMap) == 0 {
+		problems = append(problems, fmt.Sprintf("%s.configMap: is required by type %s", envPath, def.Type))
+	} else if def.Type != EnvTypeConfigMap && len(def.ConfigMap) > 0 {
+		problems = append(problems, fmt.Sprintf("%s.configMap: is only allowed in type %s", envPath, EnvTypeConfigMap))
+	}
+
+	switch def.Type {
+	case EnvTypeFieldRef:
+		if !fieldRefPattern.MatchString(def.Value) {
+			problems = append(problems, fmt.Sprintf("%s.value: %q is not a pod field supported by the downward API",
+				envPath, def.Value))
+		}
+	case EnvTypeTemplate:
+		if _, err := template.New(def.Name).Parse(def.Value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.value: invalid template: %s", envPath, err.Error()))
+		}
+	}
+
+	return
+}
+
+// isV3EnvType returns true if the environment variable type is supported in v3
+func isV3EnvType(envType string) bool {
+	switch envType {
+	case EnvTypeSecret, EnvTypeArgumentSwitchLive, EnvTypeArgumentValueMode:
+		return true
+	}
+	return false
+}
+
+func isEnvType(envType string) bool {
+	for _, t := range envTypes {
+		if t == envType {
+			return true
+		}
+	}
+	return false
+}
@@ -1,26 +1,41 @@
 package models
 
 import (
+	"fmt"
 	"io/ioutil"
-	"log"
+	"reflect"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 // DroidMetadata defines the data model used in metadata.yml
 type DroidMetadata struct {
-	Kind         string                 `yaml:"kind"`
-	Version      string                 `yaml:"version"`
-	Product      string                 `yaml:"product"`
-	Storage      bool                   `yaml:"storage"`
-	Environments []DroidMetadataEnvDef  `yaml:"environments"`
-	SecretFiles  []DroidMetadataFileDef `yaml:"secretFiles"`
+	Kind         string                  `yaml:"kind"`
+	Version      string                  `yaml:"version"`
+	Product      string                  `yaml:"product"`
+	Storage      bool                    `yaml:"storage"`
+	Environments []DroidMetadataEnvDef   `yaml:"environments"`
+	SecretFiles  []DroidMetadataFileDef  `yaml:"secretFiles"`
+	Resources    DroidMetadataResources  `yaml:"resources"`
+	Scheduling   DroidMetadataScheduling `yaml:"scheduling"`
+
+	SharedVolumes  []DroidMetadataVolumeDef    `yaml:"sharedVolumes"`
+	Sidecars       []DroidMetadataContainerDef `yaml:"sidecars"`
+	InitContainers []DroidMetadataContainerDef `yaml:"initContainers"`
 }
 
-// DroidMetadataFileDef defines the data model of the secret files definition in metadata.yml
+// DroidMetadataFileDef defines the data model of the secret files definition in metadata.yml. A file comes from
+// either a key in a secret or a key in a ConfigMap. The secret defaults to the run's secret.
 type DroidMetadataFileDef struct {
-	Path      string `yaml:"path"`
-	SecretKey string `yaml:"secretKey"`
+	Path         string `yaml:"path"`
+	SecretKey    string `yaml:"secretKey"`
+	Secret       string `yaml:"secret"`
+	ConfigMap    string `yaml:"configMap"`
+	ConfigMapKey string `yaml:"configMapKey"`
+
+	// Mode is the permission bits of the file. It defaults to 0644.
+	Mode *int32 `yaml:"mode"`
 }
 
 // DroidMetadataEnvDef defines the data model of the environment variable definition in metadata.yml
@@ -28,23 +43,70 @@ type DroidMetadataEnvDef struct {
 	Name  string `yaml:"name"`
 	Type  string `yaml:"type"`
 	Value string `yaml:"value"`
+
+	// ConfigMap is the name of the ConfigMap the value of a configmap type variable comes from
+	ConfigMap string `yaml:"configMap"`
+}
+
+// Defines the kind and the supported versions of metadata.yml
+const (
+	DroidMetadataKind = "DroidMetadata"
+	DroidMetadataV3   = "v3"
+	DroidMetadataV4   = "v4"
+)
+
+// NamesTasksByKey returns true if the droid commits the tasks in batches and names their files after their keys. The
+// after_test of a v3 image runs once the task is committed, and the files of its tasks are named after their IDs.
+func (metadata *DroidMetadata) NamesTasksByKey() bool {
+	return metadata.Version != DroidMetadataV3
 }
 
-// ReadDroidMetadata reads the droid metadata from the metadata.yml file. Returns nil if the file is missing or the
-// JSON unmarshal failed.
-func ReadDroidMetadata(filePath string) *DroidMetadata {
+// DroidMetadataError lists all the problems found in a metadata.yml. Each problem is prefixed by its YAML path.
+type DroidMetadataError struct {
+	FilePath string
+	Problems []string
+}
+
+func (err *DroidMetadataError) Error() string {
+	return fmt.Sprintf("invalid droid metadata %s:\n  %s", err.FilePath, strings.Join(err.Problems, "\n  "))
+}
+
+// ReadDroidMetadata reads and validates the droid metadata in the metadata.yml file. Unknown fields are rejected. If
+// the file is invalid, the returned error is a *DroidMetadataError listing every problem.
+func ReadDroidMetadata(filePath string) (*DroidMetadata, error) {
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Printf("Fail to read %s.\n", filePath)
-		return nil
+		return nil, fmt.Errorf("fail to read %s: %s", filePath, err.Error())
+	}
+
+	return ParseDroidMetadata(filePath, content)
+}
+
+// ParseDroidMetadata parses and validates the content of a metadata.yml. The file path is only used in the error.
+func ParseDroidMetadata(filePath string, content []byte) (*DroidMetadata, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, &DroidMetadataError{FilePath: filePath, Problems: []string{err.Error()}}
 	}
 
+	problems := checkFields(raw, reflect.TypeOf(DroidMetadata{}), "")
+
 	var metadata DroidMetadata
-	err = yaml.Unmarshal(content, &metadata)
-	if err != nil {
-		log.Printf("Fail to JSON unmarshal content from %s.\n", filePath)
-		return nil
+	if err := yaml.Unmarshal(content, &metadata); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			// the mismatched types are already reported with their paths. the decoder's errors only carry the lines.
+			if len(problems) == 0 {
+				problems = append(problems, typeErr.Errors...)
+			}
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	problems = append(problems, metadata.validate()...)
+	if len(problems) > 0 {
+		return nil, &DroidMetadataError{FilePath: filePath, Problems: problems}
 	}
 
-	return &metadata
+	return &metadata, nil
 }
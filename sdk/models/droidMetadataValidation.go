@@ -0,0 +1,291 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the product is the prefix of the job names and the droid splits the job name by dashes
+var productPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// checkFields walks the decoded YAML along the type it is decoded into and reports the fields which don't exist in
+// the type as well as the values of mismatched types. Types decoding themselves are responsible for validating their
+// content.
+func checkFields(node interface{}, t reflect.Type, nodePath string) (problems []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if node == nil || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+
+	mismatch := func(expected string) []string {
+		return []string{fmt.Sprintf("%s: expect %s but found %v", nodePath, expected, node)}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if _, ok := node.(bool); !ok {
+			return mismatch("a boolean")
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if _, ok := node.(int); !ok {
+			return mismatch("an integer")
+		}
+	case reflect.String:
+		switch node.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return mismatch("a string")
+		}
+	case reflect.Map:
+		mapping, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return mismatch("a mapping")
+		}
+		for key, value := range mapping {
+			problems = append(problems, checkFields(value, t.Elem(), joinPath(nodePath, fmt.Sprint(key)))...)
+		}
+		sort.Strings(problems)
+	case reflect.Struct:
+		mapping, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return mismatch("a mapping")
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if len(name) > 0 && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+
+		keys := make([]string, 0, len(mapping))
+		for key := range mapping {
+			keys = append(keys, fmt.Sprint(key))
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown field", joinPath(nodePath, key)))
+				continue
+			}
+			problems = append(problems, checkFields(mapping[key], fieldType, joinPath(nodePath, key))...)
+		}
+	case reflect.Slice:
+		list, ok := node.([]interface{})
+		if !ok {
+			return mismatch("a sequence")
+		}
+		for i, item := range list {
+			problems = append(problems, checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", nodePath, i))...)
+		}
+	}
+
+	return
+}
+
+// validate returns the semantic problems of the metadata
+func (metadata *DroidMetadata) validate() (problems []string) {
+	report := func(nodePath string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", nodePath, fmt.Sprintf(format, args...)))
+	}
+
+	if len(metadata.Kind) == 0 {
+		report("kind", "is required")
+	} else if metadata.Kind != DroidMetadataKind {
+		report("kind", "must be %s", DroidMetadataKind)
+	}
+
+	switch metadata.Version {
+	case "":
+		report("version", "is required")
+	case DroidMetadataV3:
+		for _, field := range metadata.v4Fields() {
+			report(field, "requires version %s", DroidMetadataV4)
+		}
+	case DroidMetadataV4:
+	default:
+		report("version", "unsupported version %q. Supported versions are %s and %s.",
+			metadata.Version, DroidMetadataV3, DroidMetadataV4)
+	}
+
+	if len(metadata.Product) == 0 {
+		report("product", "is required")
+	} else if !productPattern.MatchString(metadata.Product) {
+		report("product", "%q must consist of lower case letters and digits", metadata.Product)
+	}
+
+	problems = append(problems, validateEnvironments("environments", metadata.Environments)...)
+
+	filePaths := make(map[string]bool)
+	for i, file := range metadata.SecretFiles {
+		filePath := fmt.Sprintf("secretFiles[%d]", i)
+		if len(file.Path) == 0 {
+			report(filePath+".path", "is required")
+		} else if path.IsAbs(file.Path) || strings.HasPrefix(path.Clean(file.Path), "..") {
+			report(filePath+".path", "must be a relative path under %s", common.PathMountSecrets)
+		} else if filePaths[path.Clean(file.Path)] {
+			report(filePath+".path", "duplicate path %q", file.Path)
+		}
+		filePaths[path.Clean(file.Path)] = true
+
+		switch {
+		case len(file.SecretKey) > 0 && len(file.ConfigMapKey) > 0:
+			report(filePath, "only one of secretKey and configMapKey is allowed")
+		case len(file.SecretKey) > 0:
+			if len(file.ConfigMap) > 0 {
+				report(filePath+".configMap", "is only allowed with configMapKey")
+			}
+		case len(file.ConfigMapKey) > 0:
+			if len(file.ConfigMap) == 0 {
+				report(filePath+".configMap", "is required by configMapKey")
+			}
+			if len(file.Secret) > 0 {
+				report(filePath+".secret", "is only allowed with secretKey")
+			}
+		default:
+			report(filePath, "one of secretKey and configMapKey is required")
+		}
+
+		if file.Mode != nil && (*file.Mode < 0 || *file.Mode > 0777) {
+			report(filePath+".mode", "%#o is not a valid file mode", *file.Mode)
+		}
+	}
+
+	_, resourceProblems := metadata.Resources.requirements()
+	problems = append(problems, resourceProblems...)
+
+	sharedVolumes := make(map[string]bool)
+	for i, volume := range metadata.SharedVolumes {
+		volumePath := fmt.Sprintf("sharedVolumes[%d]", i)
+		if len(volume.Name) == 0 {
+			report(volumePath+".name", "is required")
+		} else if sharedVolumes[volume.Name] {
+			report(volumePath+".name", "duplicate name %q", volume.Name)
+		}
+		sharedVolumes[volume.Name] = true
+
+		if !path.IsAbs(volume.Path) {
+			report(volumePath+".path", "must be an absolute path")
+		}
+	}
+
+	// the test container is named main
+	containerNames := map[string]bool{"main": true}
+	validateContainers := func(block string, defs []DroidMetadataContainerDef, sidecar bool) {
+		for i, def := range defs {
+			containerPath := fmt.Sprintf("%s[%d]", block, i)
+			if len(def.Name) == 0 {
+				report(containerPath+".name", "is required")
+			} else if containerNames[def.Name] {
+				report(containerPath+".name", "duplicate name %q", def.Name)
+			}
+			containerNames[def.Name] = true
+
+			if len(def.Image) == 0 {
+				report(containerPath+".image", "is required")
+			}
+			if sidecar && len(def.Command) == 0 {
+				report(containerPath+".command", "is required")
+			}
+
+			problems = append(problems, validateEnvironments(containerPath+".environments", def.Environments)...)
+
+			for j, port := range def.Ports {
+				if port.Port < 1 || port.Port > 65535 {
+					report(fmt.Sprintf("%s.ports[%d].port", containerPath, j), "%d is out of range", port.Port)
+				}
+			}
+
+			for j, mount := range def.VolumeMounts {
+				mountPath := fmt.Sprintf("%s.volumeMounts[%d]", containerPath, j)
+				if !sharedVolumes[mount.Name] {
+					report(mountPath+".name", "%q is not a shared volume", mount.Name)
+				}
+				if !path.IsAbs(mount.Path) {
+					report(mountPath+".path", "must be an absolute path")
+				}
+			}
+
+			if def.Readiness != nil {
+				if !sidecar {
+					report(containerPath+".readiness", "is not supported in init containers")
+				} else if def.Readiness.Port < 1 || def.Readiness.Port > 65535 {
+					report(containerPath+".readiness.port", "%d is out of range", def.Readiness.Port)
+				}
+			}
+		}
+	}
+	validateContainers("sidecars", metadata.Sidecars, true)
+	validateContainers("initContainers", metadata.InitContainers, false)
+
+	return
+}
+
+// v4Fields returns the fields defined in the metadata which are introduced in v4
+func (metadata *DroidMetadata) v4Fields() (fields []string) {
+	if len(metadata.Resources.Requests) > 0 || len(metadata.Resources.Limits) > 0 {
+		fields = append(fields, "resources")
+	}
+	if !reflect.DeepEqual(metadata.Scheduling, DroidMetadataScheduling{}) {
+		fields = append(fields, "scheduling")
+	}
+	if len(metadata.SharedVolumes) > 0 {
+		fields = append(fields, "sharedVolumes")
+	}
+	for i, def := range metadata.Environments {
+		if isEnvType(def.Type) && !isV3EnvType(def.Type) {
+			fields = append(fields, fmt.Sprintf("environments[%d].type", i))
+		}
+	}
+	for i, file := range metadata.SecretFiles {
+		if len(file.Secret) > 0 || len(file.ConfigMap) > 0 || len(file.ConfigMapKey) > 0 || file.Mode != nil {
+			fields = append(fields, fmt.Sprintf("secretFiles[%d]", i))
+		}
+	}
+	if len(metadata.Sidecars) > 0 {
+		fields = append(fields, "sidecars")
+	}
+	if len(metadata.InitContainers) > 0 {
+		fields = append(fields, "initContainers")
+	}
+
+	return
+}
+
+func validateEnvironments(nodePath string, defs []DroidMetadataEnvDef) (problems []string) {
+	names := make(map[string]bool)
+	for i, def := range defs {
+		envPath := fmt.Sprintf("%s[%d]", nodePath, i)
+		if len(def.Name) == 0 {
+			problems = append(problems, fmt.Sprintf("%s.name: is required", envPath))
+		} else if names[def.Name] {
+			problems = append(problems, fmt.Sprintf("%s.name: duplicate name %q", envPath, def.Name))
+		}
+		names[def.Name] = true
+
+		problems = append(problems, def.validate(envPath)...)
+	}
+
+	return
+}
+
+func joinPath(parent string, key string) string {
+	if len(parent) == 0 {
+		return key
+	}
+	return parent + "." + key
+}
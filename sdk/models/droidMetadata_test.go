@@ -0,0 +1,124 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDroidMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		problems []string
+	}{
+		{
+			name:    "valid",
+			content: "kind: DroidMetadata\nversion: v3\nproduct: azurecli\nstorage: true\n",
+		},
+		{
+			name:     "unknown field",
+			content:  "kind: DroidMetadata\nversion: v3\nproduct: azurecli\nstorag: true\n",
+			problems: []string{"storag: unknown field"},
+		},
+		{
+			name:     "unknown nested field",
+			content:  "kind: DroidMetadata\nversion: v3\nproduct: azurecli\nenvironments:\n  - name: A\n    type: secret\n    value: a\n    key: a\n",
+			problems: []string{"environments[0].key: unknown field"},
+		},
+		{
+			name:     "mismatched type",
+			content:  "kind: DroidMetadata\nversion: v3\nproduct: azurecli\nstorage: [true]\n",
+			problems: []string{"storage: expect a boolean but found [true]"},
+		},
+		{
+			name:     "missing version",
+			content:  "kind: DroidMetadata\nproduct: azurecli\n",
+			problems: []string{"version: is required"},
+		},
+		{
+			name:     "bad version",
+			content:  "kind: DroidMetadata\nversion: v2\nproduct: azurecli\n",
+			problems: []string{`version: unsupported version "v2". Supported versions are v3 and v4.`},
+		},
+		{
+			name:     "bad kind",
+			content:  "kind: Droid\nversion: v3\nproduct: azurecli\n",
+			problems: []string{"kind: must be DroidMetadata"},
+		},
+		{
+			name:     "bad product name",
+			content:  "kind: DroidMetadata\nversion: v3\nproduct: azure-cli\n",
+			problems: []string{`product: "azure-cli" must consist of lower case letters and digits`},
+		},
+		{
+			name:     "missing product",
+			content:  "kind: DroidMetadata\nversion: v3\n",
+			problems: []string{"product: is required"},
+		},
+		{
+			name:    "unknown environment type",
+			content: "kind: DroidMetadata\nversion: v3\nproduct: azurecli\nenvironments:\n  - name: A\n    type: secrets\n    value: a\n",
+			problems: []string{`environments[0].type: unknown type "secrets". Supported types are secret, argument-switch-live, ` +
+				`argument-value-mode, configmap, literal, run-setting, run-detail, field-ref, template.`},
+		},
+		{
+			name: "v4 environment types",
+			content: "kind: DroidMetadata\nversion: v4\nproduct: azurecli\nenvironments:\n" +
+				"  - {name: A, type: configmap, value: a, configMap: azurecli-config}\n" +
+				"  - {name: B, type: literal, value: b}\n" +
+				"  - {name: C, type: run-setting, value: a01.reserved.testmode}\n" +
+				"  - {name: D, type: run-detail, value: a01.reserved.jobname}\n" +
+				"  - {name: E, type: field-ref, value: spec.nodeName}\n" +
+				"  - {name: F, type: template, value: '{{.Product}}'}\n",
+		},
+		{
+			name: "v4 environment types in v3",
+			content: "kind: DroidMetadata\nversion: v3\nproduct: azurecli\nenvironments:\n" +
+				"  - {name: A, type: secret, value: a}\n" +
+				"  - {name: B, type: configmap, value: a, configMap: azurecli-config}\n" +
+				"  - {name: C, type: literal, value: b}\n" +
+				"  - {name: D, type: run-setting, value: a01.reserved.testmode}\n" +
+				"  - {name: E, type: run-detail, value: a01.reserved.jobname}\n" +
+				"  - {name: F, type: field-ref, value: spec.nodeName}\n" +
+				"  - {name: G, type: template, value: '{{.Product}}'}\n",
+			problems: []string{
+				"environments[1].type: requires version v4",
+				"environments[2].type: requires version v4",
+				"environments[3].type: requires version v4",
+				"environments[4].type: requires version v4",
+				"environments[5].type: requires version v4",
+				"environments[6].type: requires version v4",
+			},
+		},
+		{
+			name:    "every problem",
+			content: "kind: DroidMetadata\nversion: v2\nproduct: Azure\nstorag: true\n",
+			problems: []string{
+				"storag: unknown field",
+				`version: unsupported version "v2". Supported versions are v3 and v4.`,
+				`product: "Azure" must consist of lower case letters and digits`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		metadata, err := ParseDroidMetadata("metadata.yml", []byte(test.content))
+		if len(test.problems) == 0 {
+			if err != nil || metadata == nil {
+				t.Errorf("%s: expect the metadata to be valid but found %v", test.name, err)
+			}
+			continue
+		}
+
+		metadataErr, ok := err.(*DroidMetadataError)
+		if !ok {
+			t.Errorf("%s: expect a DroidMetadataError but found %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(metadataErr.Problems, test.problems) {
+			t.Errorf("%s: expect problems\n  %s\nbut found\n  %s", test.name,
+				strings.Join(test.problems, "\n  "), strings.Join(metadataErr.Problems, "\n  "))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	ghodssyaml "github.com/ghodss/yaml"
+	yaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// DroidMetadataResources defines the compute resources of the droid container in metadata.yml. The keys are the
+// resource names, e.g. cpu and memory, and the values are Kubernetes quantities, e.g. 500m and 2Gi.
+type DroidMetadataResources struct {
+	Requests map[string]string `yaml:"requests" json:"requests,omitempty"`
+	Limits   map[string]string `yaml:"limits" json:"limits,omitempty"`
+}
+
+// DroidMetadataScheduling defines the node placement of the droid pods in metadata.yml. The tolerations and the
+// affinity follow the schema of the Kubernetes PodSpec.
+type DroidMetadataScheduling struct {
+	NodeSelector  map[string]string   `json:"nodeSelector,omitempty"`
+	Tolerations   []corev1.Toleration `json:"tolerations,omitempty"`
+	Affinity      *corev1.Affinity    `json:"affinity,omitempty"`
+	PriorityClass string              `json:"priorityClass,omitempty"`
+}
+
+// UnmarshalYAML decodes the scheduling block through its JSON form so the Kubernetes types keep their field names.
+func (scheduling *DroidMetadataScheduling) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	content, err := yaml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	content, err = ghodssyaml.YAMLToJSON(content)
+	if err != nil {
+		return err
+	}
+
+	// the alias type drops this method so the JSON decoder doesn't recurse
+	type plain DroidMetadataScheduling
+	var decoded plain
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&decoded); err != nil {
+		return fmt.Errorf("scheduling: %s", err.Error())
+	}
+
+	*scheduling = DroidMetadataScheduling(decoded)
+	return nil
+}
+
+// Requirements translates the resources to the container's resource requirements. It returns an error listing all
+// the malformed quantities.
+func (resources DroidMetadataResources) Requirements() (corev1.ResourceRequirements, error) {
+	requirements, problems := resources.requirements()
+	if len(problems) > 0 {
+		return corev1.ResourceRequirements{}, fmt.Errorf("invalid resources: %s", strings.Join(problems, "; "))
+	}
+
+	return requirements, nil
+}
+
+func (resources DroidMetadataResources) requirements() (corev1.ResourceRequirements, []string) {
+	var problems []string
+	parse := func(block string, values map[string]string) corev1.ResourceList {
+		if len(values) == 0 {
+			return nil
+		}
+
+		list := corev1.ResourceList{}
+		for _, name := range sortedKeys(values) {
+			quantity, err := resource.ParseQuantity(values[name])
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("resources.%s.%s: invalid quantity %q", block, name, values[name]))
+				continue
+			}
+			list[corev1.ResourceName(name)] = quantity
+		}
+		return list
+	}
+
+	requirements := corev1.ResourceRequirements{
+		Requests: parse("requests", resources.Requests),
+		Limits:   parse("limits", resources.Limits),
+	}
+
+	for name, request := range requirements.Requests {
+		if limit, ok := requirements.Limits[name]; ok && request.Cmp(limit) > 0 {
+			problems = append(problems, fmt.Sprintf("resources.requests.%s: %s exceeds the limit %s", name, request.String(), limit.String()))
+		}
+	}
+
+	sort.Strings(problems)
+	return requirements, problems
+}
+
+// GetResources returns the compute resources of the droid container. The resources in the run's settings override
+// the ones in the metadata by resource name.
+func (run *Run) GetResources(metadata *DroidMetadata) (DroidMetadataResources, error) {
+	result := DroidMetadataResources{
+		Requests: merge(nil, metadata.Resources.Requests),
+		Limits:   merge(nil, metadata.Resources.Limits),
+	}
+
+	var override DroidMetadataResources
+	if ok, err := run.decodeSetting(common.KeyResources, &override); err != nil || !ok {
+		return result, err
+	}
+
+	result.Requests = merge(result.Requests, override.Requests)
+	result.Limits = merge(result.Limits, override.Limits)
+
+	return result, nil
+}
+
+// GetScheduling returns the node placement of the droid pods. Each field defined in the run's settings overrides the
+// one in the metadata. The priority class of the run's priority, if set, overrides the metadata's, and is overridden
+// by the one in the run's scheduling setting.
+func (run *Run) GetScheduling(metadata *DroidMetadata) (DroidMetadataScheduling, error) {
+	result := metadata.Scheduling
+
+	if _, ok := run.Settings[common.KeyPriority]; ok {
+		priority, err := run.GetPriority()
+		if err != nil {
+			return result, err
+		}
+		result.PriorityClass = PriorityClassName(priority)
+	}
+
+	var override DroidMetadataScheduling
+	if ok, err := run.decodeSetting(common.KeyScheduling, &override); err != nil || !ok {
+		return result, err
+	}
+
+	if override.NodeSelector != nil {
+		result.NodeSelector = override.NodeSelector
+	}
+	if override.Tolerations != nil {
+		result.Tolerations = override.Tolerations
+	}
+	if override.Affinity != nil {
+		result.Affinity = override.Affinity
+	}
+	if len(override.PriorityClass) > 0 {
+		result.PriorityClass = override.PriorityClass
+	}
+
+	return result, nil
+}
+
+// decodeSetting decodes the run setting of the given key into out. The setting is either a JSON object or a string
+// containing one. Returns false if the setting doesn't exist.
+func (run *Run) decodeSetting(key string, out interface{}) (bool, error) {
+	value, ok := run.Settings[key]
+	if !ok || value == nil {
+		return false, nil
+	}
+
+	var content []byte
+	if s, isString := value.(string); isString {
+		content = []byte(s)
+	} else {
+		var err error
+		if content, err = json.Marshal(value); err != nil {
+			return false, fmt.Errorf("invalid run setting %s: %s", key, err.Error())
+		}
+	}
+
+	if err := json.Unmarshal(content, out); err != nil {
+		return false, fmt.Errorf("invalid run setting %s: %s", key, err.Error())
+	}
+
+	return true, nil
+}
+
+func merge(base map[string]string, override map[string]string) map[string]string {
+	if base == nil && override == nil {
+		return nil
+	}
+
+	result := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range override {
+		result[k] = v
+	}
+
+	return result
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
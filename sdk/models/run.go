@@ -2,6 +2,7 @@ package models
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -21,6 +22,112 @@ type Run struct {
 	Settings map[string]interface{} `json:"settings"`
 	Details  map[string]string      `json:"details"`
 	Status   string                 `json:"status"`
+
+	// Version identifies the revision of the run in the store. It changes whenever the run is saved. Runs read from
+	// stores which don't version runs have no version.
+	Version string `json:"version,omitempty"`
+}
+
+// maxUpdateAttempts is the number of times UpdateRun applies the changes before it gives up on conflicts
+const maxUpdateAttempts = 5
+
+// ConflictError is returned when a run is saved with a version the store no longer holds, because the run was changed
+// after it was read
+type ConflictError struct {
+	RunID   int
+	Version string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("run %d was changed after version %s", e.RunID, e.Version)
+}
+
+// IsConflict returns true if the error is a ConflictError
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// RunStore reads and saves runs. It is implemented by store.Client.
+type RunStore interface {
+	GetRun(ctx context.Context, runID int) (*Run, error)
+	UpdateRun(ctx context.Context, run *Run) (*Run, error)
+}
+
+// defaultRunStore is the store reached through httputils.DefaultClient
+type defaultRunStore struct{}
+
+func (defaultRunStore) GetRun(ctx context.Context, runID int) (*Run, error) {
+	return QueryRunContext(ctx, runID)
+}
+
+func (defaultRunStore) UpdateRun(ctx context.Context, run *Run) (*Run, error) {
+	return run.SubmitChangeContext(ctx)
+}
+
+// UpdateRun applies the changes to a copy of the run and saves it. If the run was changed in the store in the
+// meantime, the run is read again and the changes are applied to the latest version. The changes may therefore be
+// applied several times. An error returned by the changes stops the update and is returned as is.
+func UpdateRun(ctx context.Context, store RunStore, run *Run, changes func(*Run) error) (*Run, error) {
+	runID := run.ID
+
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			if run, err = store.GetRun(ctx, runID); err != nil {
+				return nil, fmt.Errorf("fail to read run %d again: %s", runID, err.Error())
+			}
+		}
+
+		changed := run.Copy()
+		if err := changes(changed); err != nil {
+			return nil, err
+		}
+
+		var updated *Run
+		if updated, err = store.UpdateRun(ctx, changed); err == nil {
+			return updated, nil
+		} else if !IsConflict(err) {
+			return nil, err
+		}
+
+		logrus.Warnf("Run %d was changed concurrently. Apply the changes again: %s", runID, err)
+	}
+
+	return nil, err
+}
+
+// SetPrecondition makes the request to save the run fail with a conflict if the run was changed in the store after it
+// was read
+func (run *Run) SetPrecondition(request *http.Request) {
+	if len(run.Version) > 0 {
+		request.Header.Set(httputils.HeaderIfMatch, run.Version)
+	}
+}
+
+// CheckConflict returns a ConflictError if the store refused to save the run because its precondition failed.
+// Otherwise the error is returned as is.
+func (run *Run) CheckConflict(err error) error {
+	if httputils.IsStatus(err, http.StatusPreconditionFailed) || httputils.IsStatus(err, http.StatusConflict) {
+		return &ConflictError{RunID: run.ID, Version: run.Version}
+	}
+	return err
+}
+
+// Copy returns a copy of the run whose details and settings can be changed without changing the run
+func (run *Run) Copy() *Run {
+	copied := *run
+	copied.Details = make(map[string]string, len(run.Details))
+	for key, value := range run.Details {
+		copied.Details[key] = value
+	}
+	if run.Settings != nil {
+		copied.Settings = make(map[string]interface{}, len(run.Settings))
+		for key, value := range run.Settings {
+			copied.Settings[key] = value
+		}
+	}
+	return &copied
 }
 
 // GetSecretName returns the secret mapping to this run.
@@ -34,36 +141,79 @@ func (run *Run) GetSecretName(metadata *DroidMetadata) string {
 	return metadata.Product
 }
 
-// SubmitChange POST the changes in current Run instance to task store
-func (run *Run) SubmitChange() (*Run, error) {
-	body, err := json.Marshal(run)
-	if err != nil {
-		return nil, fmt.Errorf("unable to marshal in JSON: %s", err.Error())
+// GetProduct returns the product of the run. It is the run's product detail, which is set once the run is published or
+// by the scheduler, or else the repository name of the run's image, e.g. azurecli for
+// azureclidev.azurecr.io/azurecli:python3.6, as the images are named after their product. The first image of a
+// multi-image run is used. It returns empty if the product is unknown.
+func (run *Run) GetProduct() string {
+	if product := run.Details[common.KeyProduct]; len(product) > 0 {
+		return product
 	}
 
-	req, err := httputils.CreateRequest(http.MethodPost, fmt.Sprintf("run/%d", run.ID), body)
-	if err != nil {
-		return nil, err
+	image, _ := run.Settings[common.KeyImageName].(string)
+	if images, err := run.GetImages(); err == nil && len(images) > 0 {
+		image = images[0].Image
+	}
+
+	// drop the digest and the tag, then the registry and the namespaces
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
 	}
+	return image[strings.LastIndex(image, "/")+1:]
+}
+
+// SubmitChange POST the changes in current Run instance to task store
+func (run *Run) SubmitChange() (*Run, error) {
+	return run.SubmitChangeContext(context.Background())
+}
+
+// SubmitChangeContext POST the changes in current Run instance to task store. The request is canceled when the
+// context is done. If the run has a version, a ConflictError is returned when the run was changed in the store after
+// this version.
+func (run *Run) SubmitChangeContext(ctx context.Context) (*Run, error) {
+	return run.SubmitChangeWithClient(ctx, httputils.DefaultClient)
+}
 
-	respContent, err := httputils.SendRequest(req)
+// SubmitChangeWithClient POST the changes in current Run instance to the store of the given client
+func (run *Run) SubmitChangeWithClient(ctx context.Context, client *httputils.Client) (*Run, error) {
+	request, err := client.NewJSONRequest(ctx, http.MethodPost, fmt.Sprintf("run/%d", run.ID), run)
 	if err != nil {
 		return nil, err
 	}
+	run.SetPrecondition(request)
 
 	var updated Run
-	err = json.Unmarshal(respContent, &updated)
-	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal JSON: %s", err.Error())
+	if err := client.SendJSON(request, &updated); err != nil {
+		return nil, run.CheckConflict(err)
 	}
 
 	return &updated, nil
 }
 
+// Update applies the changes to the run and saves it. The run is read again and the changes are applied again when
+// the run was changed concurrently.
+func (run *Run) Update(changes func(*Run) error) (*Run, error) {
+	return run.UpdateContext(context.Background(), changes)
+}
+
+// UpdateContext applies the changes to the run and saves it. The run is read again and the changes are applied again
+// when the run was changed concurrently. The requests are canceled when the context is done.
+func (run *Run) UpdateContext(ctx context.Context, changes func(*Run) error) (*Run, error) {
+	return UpdateRun(ctx, defaultRunStore{}, run, changes)
+}
+
 // QueryTests returns the list of test tasks based on the query string
 func (run *Run) QueryTests() []TaskSetting {
-	logrus.Infof("Expecting script %s.", common.PathScriptGetIndex)
-	content, err := exec.Command(common.PathScriptGetIndex).Output()
+	return run.QueryTestsFrom(common.PathScriptGetIndex)
+}
+
+// QueryTestsFrom returns the list of test tasks listed by the given get_index script based on the query string
+func (run *Run) QueryTestsFrom(script string) []TaskSetting {
+	logrus.Infof("Expecting script %s.", script)
+	content, err := exec.Command(script).Output()
 	if err != nil {
 		panic(err.Error())
 	}
@@ -74,6 +224,11 @@ func (run *Run) QueryTests() []TaskSetting {
 		panic(err.Error())
 	}
 
+	return run.FilterTests(input)
+}
+
+// FilterTests returns the tasks selected by the run's query and exclude query
+func (run *Run) FilterTests(input []TaskSetting) []TaskSetting {
 	if query, ok := run.Settings[common.KeyTestQuery]; ok {
 		logrus.Info(fmt.Sprintf("Query string is '%s'", query))
 		result := make([]TaskSetting, 0, len(input))
@@ -128,20 +283,20 @@ func (run Run) String() string {
 
 // QueryRun returns the run of the runID
 func QueryRun(runID int) (*Run, error) {
-	req, err := httputils.CreateRequest(http.MethodGet, fmt.Sprintf("run/%d", runID), nil)
-	if err != nil {
-		return nil, err
-	}
+	return QueryRunContext(context.Background(), runID)
+}
 
-	respContent, err := httputils.SendRequest(req)
-	if err != nil {
-		return nil, err
-	}
+// QueryRunContext returns the run of the runID. The request is canceled when the context is done.
+func QueryRunContext(ctx context.Context, runID int) (*Run, error) {
+	return QueryRunWithClient(ctx, httputils.DefaultClient, runID)
+}
 
+// QueryRunWithClient returns the run of the runID from the store of the given client
+func QueryRunWithClient(ctx context.Context, client *httputils.Client, runID int) (*Run, error) {
 	var run Run
-	err = json.Unmarshal(respContent, &run)
+	err := client.Do(ctx, http.MethodGet, fmt.Sprintf("run/%d", runID), nil, &run)
 	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal JSON: %s", err.Error())
+		return nil, err
 	}
 
 	return &run, nil
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+// ClassifierKeyImage is the key of the task classifier naming the image a task of a multi-image run is executed in
+const ClassifierKeyImage = "image"
+
+// RunImage is one of the images tested by a multi-image run, declared in the a01.reserved.images setting. Each image
+// holds the product's metadata.yml and get_index, e.g. the product built on another Python version or OS base.
+type RunImage struct {
+	// Name identifies the image in the run. It is appended to the names of the image's queue and Job.
+	Name string `json:"name" yaml:"name"`
+
+	Image string `json:"image" yaml:"image"`
+
+	// ImagePullSecret defaults to the run's a01.reserved.imagepullsecret
+	ImagePullSecret string `json:"imagePullSecret,omitempty" yaml:"imagePullSecret"`
+}
+
+// imageNamePattern restricts the image names to the characters allowed in the names of Jobs
+var imageNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// maxImageNameLength keeps the names of the images' Jobs within the limits of Kubernetes names
+const maxImageNameLength = 20
+
+// GetImages returns the images of a multi-image run, or nil if the run tests a single image
+func (run *Run) GetImages() ([]RunImage, error) {
+	var images []RunImage
+	if ok, err := run.decodeSetting(common.KeyImages, &images); err != nil || !ok {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(images))
+	for i, image := range images {
+		if !imageNamePattern.MatchString(image.Name) || len(image.Name) > maxImageNameLength {
+			return nil, fmt.Errorf("invalid run setting %s: [%d].name %q must be at most %d lowercase letters, digits and dashes",
+				common.KeyImages, i, image.Name, maxImageNameLength)
+		} else if names[image.Name] {
+			return nil, fmt.Errorf("invalid run setting %s: [%d].name: duplicate name %q", common.KeyImages, i, image.Name)
+		} else if len(image.Image) == 0 {
+			return nil, fmt.Errorf("invalid run setting %s: [%d].image: missing", common.KeyImages, i)
+		}
+		names[image.Name] = true
+	}
+
+	return images, nil
+}
+
+// ForImage returns a copy of the run as seen by the droids of one of its images. The copy's image settings are the
+// image's, and its details name the image.
+func (run *Run) ForImage(image RunImage) *Run {
+	copied := run.Copy()
+	if copied.Settings == nil {
+		copied.Settings = make(map[string]interface{})
+	}
+
+	copied.Settings[common.KeyImageName] = image.Image
+	if len(image.ImagePullSecret) > 0 {
+		copied.Settings[common.KeyImagePullSecret] = image.ImagePullSecret
+	}
+	copied.Details[common.KeyImage] = image.Name
+
+	return copied
+}
+
+// GetImageJobName returns the name of the Job and the queue of an image of the run whose job name is given
+func GetImageJobName(jobName string, image string) string {
+	return jobName + "-" + image
+}
+
+// GetJobNames returns the names of the run's Jobs, which are also the names of its queues. A multi-image run has one
+// Job per image. It returns nil if the run has no job name yet.
+func (run *Run) GetJobNames() []string {
+	jobName := run.Details[common.KeyJobName]
+	if len(jobName) == 0 {
+		return nil
+	}
+
+	images, err := run.GetImages()
+	if err != nil || len(images) == 0 {
+		return []string{jobName}
+	}
+
+	names := make([]string, 0, len(images))
+	for _, image := range images {
+		names = append(names, GetImageJobName(jobName, image.Name))
+	}
+	return names
+}
+
+// TagImage returns copies of the tasks whose classifier names the image they are executed in, so their results can be
+// told apart by image
+func TagImage(tests []TaskSetting, image string) []TaskSetting {
+	result := make([]TaskSetting, 0, len(tests))
+	for _, test := range tests {
+		classifier := make(map[string]string, len(test.Classifier)+1)
+		for key, value := range test.Classifier {
+			classifier[key] = value
+		}
+		classifier[ClassifierKeyImage] = image
+
+		test.Classifier = classifier
+		result = append(result, test)
+	}
+	return result
+}
+
+// ImageResults counts the results of the tasks of a multi-image run by image and result, e.g.
+// {"py36": {"Passed": 120, "Failed": 3}}
+type ImageResults map[string]map[string]int
+
+// CountImageResults counts the results of the given tasks by the image named in their classifiers. Tasks not tagged
+// with an image are ignored.
+func CountImageResults(tasks []TaskResult) ImageResults {
+	results := make(ImageResults)
+	for _, task := range tasks {
+		image, ok := task.Settings.Classifier[ClassifierKeyImage]
+		if !ok {
+			continue
+		}
+
+		if results[image] == nil {
+			results[image] = make(map[string]int)
+		}
+		results[image][task.Result]++
+	}
+	return results
+}
+
+// Images returns the names of the counted images in order
+func (results ImageResults) Images() []string {
+	images := make([]string, 0, len(results))
+	for image := range results {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// String returns the JSON form of the results, which is how they are kept in the run's details
+func (results ImageResults) String() string {
+	content, _ := json.Marshal(map[string]map[string]int(results))
+	return string(content)
+}
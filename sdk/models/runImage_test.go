@@ -0,0 +1,129 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+const testImages = `[
+	{"name": "py36", "image": "azurecli:py36"},
+	{"name": "py39", "image": "azurecli:py39", "imagePullSecret": "py39-registry"}
+]`
+
+func newMultiImageRun(images interface{}) *Run {
+	return &Run{
+		ID: 42,
+		Settings: map[string]interface{}{
+			common.KeyImageName:       "azurecli:latest",
+			common.KeyImagePullSecret: "azureclidev-registry",
+			common.KeyImages:          images,
+		},
+		Details: map[string]string{common.KeyJobName: "azurecli-42"},
+	}
+}
+
+func TestGetImages(t *testing.T) {
+	images, err := newMultiImageRun(testImages).GetImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[1].Name != "py39" || images[1].ImagePullSecret != "py39-registry" {
+		t.Errorf("unexpected images %v", images)
+	}
+
+	// the setting is decoded from JSON objects as well
+	images, err = newMultiImageRun([]interface{}{map[string]interface{}{"name": "py36", "image": "azurecli:py36"}}).GetImages()
+	if err != nil || len(images) != 1 {
+		t.Errorf("expect one image but found %v: %v", images, err)
+	}
+
+	run := newMultiImageRun(nil)
+	delete(run.Settings, common.KeyImages)
+	if images, err := run.GetImages(); err != nil || images != nil {
+		t.Errorf("expect no image for a single image run but found %v: %v", images, err)
+	}
+}
+
+func TestGetImagesInvalid(t *testing.T) {
+	for _, images := range []string{
+		`{"name": "py36"}`,
+		`[{"name": "Py36", "image": "azurecli:py36"}]`,
+		`[{"name": "python-3-6-on-ubuntu-18-04", "image": "azurecli:py36"}]`,
+		`[{"image": "azurecli:py36"}]`,
+		`[{"name": "py36"}]`,
+		`[{"name": "py36", "image": "a"}, {"name": "py36", "image": "b"}]`,
+	} {
+		if _, err := newMultiImageRun(images).GetImages(); err == nil {
+			t.Errorf("expect an error: %s", images)
+		}
+	}
+}
+
+func TestForImage(t *testing.T) {
+	run := newMultiImageRun(testImages)
+	images, _ := run.GetImages()
+
+	py36 := run.ForImage(images[0])
+	if py36.Settings[common.KeyImageName] != "azurecli:py36" || py36.Settings[common.KeyImagePullSecret] != "azureclidev-registry" {
+		t.Errorf("expect the image and the run's pull secret but found %v", py36.Settings)
+	}
+	if py36.Details[common.KeyImage] != "py36" {
+		t.Errorf("expect the details to name the image but found %v", py36.Details)
+	}
+
+	py39 := run.ForImage(images[1])
+	if py39.Settings[common.KeyImagePullSecret] != "py39-registry" {
+		t.Errorf("expect the image's pull secret but found %v", py39.Settings)
+	}
+
+	if run.Settings[common.KeyImageName] != "azurecli:latest" || len(run.Details) != 1 {
+		t.Errorf("expect the run to be left as is but found %v", run)
+	}
+}
+
+func TestGetJobNames(t *testing.T) {
+	if names := newMultiImageRun(testImages).GetJobNames(); len(names) != 2 || names[0] != "azurecli-42-py36" || names[1] != "azurecli-42-py39" {
+		t.Errorf("expect one job per image but found %v", names)
+	}
+
+	run := newMultiImageRun(nil)
+	if names := run.GetJobNames(); len(names) != 1 || names[0] != "azurecli-42" {
+		t.Errorf("expect the run's job but found %v", names)
+	}
+
+	delete(run.Details, common.KeyJobName)
+	if names := run.GetJobNames(); names != nil {
+		t.Errorf("expect no job before the job name is set but found %v", names)
+	}
+}
+
+func TestTagImage(t *testing.T) {
+	tests := []TaskSetting{{Classifier: map[string]string{"identifier": "test_0"}}, {}}
+	tagged := TagImage(tests, "py36")
+
+	if tagged[0].GetIdentifier() != "test_0" || tagged[0].Classifier[ClassifierKeyImage] != "py36" ||
+		tagged[1].Classifier[ClassifierKeyImage] != "py36" {
+		t.Errorf("expect the tasks to be tagged but found %v", tagged)
+	}
+	if _, ok := tests[0].Classifier[ClassifierKeyImage]; ok {
+		t.Error("expect the given tasks to be left as is")
+	}
+}
+
+func TestCountImageResults(t *testing.T) {
+	var tasks []TaskResult
+	for i, result := range []string{"Passed", "Failed", "Passed", "Passed"} {
+		task := TaskResult{Result: result, Settings: TagImage([]TaskSetting{{}}, []string{"py36", "py39"}[i%2])[0]}
+		tasks = append(tasks, task)
+	}
+	tasks = append(tasks, TaskResult{Result: "Passed"})
+
+	results := CountImageResults(tasks)
+	if results.String() != `{"py36":{"Passed":2},"py39":{"Failed":1,"Passed":1}}` {
+		t.Errorf("unexpected results %s", results)
+	}
+	if images := results.Images(); len(images) != 2 || images[0] != "py36" {
+		t.Errorf("expect the images in order but found %v", images)
+	}
+}
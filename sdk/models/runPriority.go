@@ -0,0 +1,42 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+// Defines the priorities of a run, set by the a01.reserved.priority setting. A run without the setting has the normal
+// priority.
+const (
+	RunPriorityLow    = "low"
+	RunPriorityNormal = "normal"
+	RunPriorityHigh   = "high"
+)
+
+// runPriorities are the supported priorities of a run
+var runPriorities = map[string]bool{
+	RunPriorityLow:    true,
+	RunPriorityNormal: true,
+	RunPriorityHigh:   true,
+}
+
+// GetPriority returns the priority of the run
+func (run *Run) GetPriority() (string, error) {
+	value, ok := run.Settings[common.KeyPriority]
+	if !ok || value == nil {
+		return RunPriorityNormal, nil
+	}
+
+	priority, _ := value.(string)
+	if !runPriorities[priority] {
+		return "", fmt.Errorf("invalid run setting %s: unknown priority %v. Supported priorities are %s, %s and %s.",
+			common.KeyPriority, value, RunPriorityLow, RunPriorityNormal, RunPriorityHigh)
+	}
+	return priority, nil
+}
+
+// PriorityClassName returns the name of the Kubernetes PriorityClass of the droid pods of the runs of the priority
+func PriorityClassName(priority string) string {
+	return "a01-" + priority
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+func TestGetPriority(t *testing.T) {
+	metadata := &DroidMetadata{Scheduling: DroidMetadataScheduling{PriorityClass: "azurecli-default"}}
+
+	for _, tc := range []struct {
+		settings      map[string]interface{}
+		priority      string
+		priorityClass string
+	}{
+		{map[string]interface{}{}, RunPriorityNormal, "azurecli-default"},
+		{map[string]interface{}{common.KeyPriority: RunPriorityNormal}, RunPriorityNormal, "a01-normal"},
+		{map[string]interface{}{common.KeyPriority: RunPriorityHigh}, RunPriorityHigh, "a01-high"},
+		{map[string]interface{}{common.KeyPriority: RunPriorityLow}, RunPriorityLow, "a01-low"},
+		{map[string]interface{}{
+			common.KeyPriority:   RunPriorityHigh,
+			common.KeyScheduling: `{"priorityClass": "azurecli-urgent"}`,
+		}, RunPriorityHigh, "azurecli-urgent"},
+	} {
+		run := &Run{Settings: tc.settings}
+		if priority, err := run.GetPriority(); err != nil || priority != tc.priority {
+			t.Errorf("%v: expect priority %s but found %s, %v", tc.settings, tc.priority, priority, err)
+		}
+		if scheduling, err := run.GetScheduling(metadata); err != nil || scheduling.PriorityClass != tc.priorityClass {
+			t.Errorf("%v: expect priority class %s but found %s, %v", tc.settings, tc.priorityClass, scheduling.PriorityClass, err)
+		}
+	}
+
+	run := &Run{Settings: map[string]interface{}{common.KeyPriority: "urgent"}}
+	if _, err := run.GetPriority(); err == nil {
+		t.Error("expect an error for an unknown priority")
+	}
+	if _, err := run.GetScheduling(metadata); err == nil {
+		t.Error("expect an error for an unknown priority")
+	}
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/cron"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RunSchedule defines the runs of a product created on a cron schedule. The schedules of a product are declared in
+// the schedules key of the product's secret or ConfigMap.
+type RunSchedule struct {
+	Name string `yaml:"name"`
+
+	// Cron is the five-field cron expression of the times the runs are created at, in UTC
+	Cron string `yaml:"cron"`
+
+	Image           string `yaml:"image"`
+	ImagePullSecret string `yaml:"imagePullSecret"`
+	Parallelism     int    `yaml:"parallelism"`
+	Live            bool   `yaml:"live"`
+	Mode            string `yaml:"mode"`
+	Query           string `yaml:"query"`
+	ExcludeQuery    string `yaml:"excludeQuery"`
+	Priority        string `yaml:"priority"`
+
+	// Images, if set, are the images tested by the runs. The image above runs their dispatchers.
+	Images []RunImage `yaml:"images"`
+
+	// Settings are the other settings of the runs by key, e.g. a01.reserved.remark
+	Settings map[string]string `yaml:"settings"`
+
+	schedule *cron.Schedule
+}
+
+// ParseRunSchedules parses and validates the YAML list of the schedules of a product
+func ParseRunSchedules(content []byte) ([]*RunSchedule, error) {
+	var schedules []*RunSchedule
+	if err := yaml.UnmarshalStrict(content, &schedules); err != nil {
+		return nil, fmt.Errorf("invalid run schedules: %s", err.Error())
+	}
+
+	var problems []string
+	names := make(map[string]bool)
+	for i, s := range schedules {
+		if len(s.Name) == 0 {
+			problems = append(problems, fmt.Sprintf("[%d].name: missing", i))
+		} else if names[s.Name] {
+			problems = append(problems, fmt.Sprintf("[%d].name: duplicate name %q", i, s.Name))
+		}
+		names[s.Name] = true
+
+		if len(s.Image) == 0 {
+			problems = append(problems, fmt.Sprintf("[%d].image: missing", i))
+		}
+		if len(s.ImagePullSecret) == 0 {
+			problems = append(problems, fmt.Sprintf("[%d].imagePullSecret: missing", i))
+		}
+		if len(s.Priority) > 0 && !runPriorities[s.Priority] {
+			problems = append(problems, fmt.Sprintf("[%d].priority: unknown priority %q", i, s.Priority))
+		}
+		if len(s.Images) > 0 {
+			run := &Run{Settings: map[string]interface{}{common.KeyImages: s.Images}}
+			if _, err := run.GetImages(); err != nil {
+				problems = append(problems, fmt.Sprintf("[%d].images: %s", i, err.Error()))
+			}
+		}
+		if s.Parallelism < 0 {
+			problems = append(problems, fmt.Sprintf("[%d].parallelism: must not be negative", i))
+		}
+
+		var err error
+		if s.schedule, err = cron.Parse(s.Cron); err != nil {
+			problems = append(problems, fmt.Sprintf("[%d].cron: %s", i, err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid run schedules:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return schedules, nil
+}
+
+// Next returns the first time after the given time a run is created at
+func (s *RunSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.UTC())
+}
+
+// NewRun returns the run of the product created at the given time by the schedule
+func (s *RunSchedule) NewRun(product string, scheduledAt time.Time) *Run {
+	settings := make(map[string]interface{}, len(s.Settings)+8)
+	for key, value := range s.Settings {
+		settings[key] = value
+	}
+
+	settings[common.KeyImageName] = s.Image
+	settings[common.KeyImagePullSecret] = s.ImagePullSecret
+
+	parallelism := s.Parallelism
+	if parallelism == 0 {
+		parallelism = 1
+	}
+	settings[common.KeyInitParallelism] = float64(parallelism)
+
+	if len(s.Images) > 0 {
+		images, _ := json.Marshal(s.Images)
+		settings[common.KeyImages] = string(images)
+	}
+
+	if s.Live {
+		settings[common.KeyLiveMode] = "True"
+	} else {
+		settings[common.KeyLiveMode] = "False"
+	}
+
+	if _, ok := settings[common.KeyAgentVersion]; !ok {
+		settings[common.KeyAgentVersion] = "latest"
+	}
+
+	for key, value := range map[string]string{
+		common.KeyTestModel:        s.Mode,
+		common.KeyTestQuery:        s.Query,
+		common.KeyTestExcludeQuery: s.ExcludeQuery,
+		common.KeyPriority:         s.Priority,
+	} {
+		if len(value) > 0 {
+			settings[key] = value
+		}
+	}
+
+	return &Run{
+		Name:     fmt.Sprintf("%s %s %s", product, s.Name, scheduledAt.UTC().Format("2006-01-02 15:04")),
+		Settings: settings,
+		Details: map[string]string{
+			common.KeyProduct:     product,
+			common.KeySchedule:    s.Name,
+			common.KeyScheduledAt: scheduledAt.UTC().Format(time.RFC3339),
+		},
+		Status: common.RunStatusInitialized,
+	}
+}
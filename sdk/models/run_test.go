@@ -0,0 +1,187 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/httputils"
+)
+
+// versionedStore serves a single run whose version is incremented on each change. A change whose If-Match header
+// doesn't match the version is refused with 412.
+type versionedStore struct {
+	sync.Mutex
+	run     Run
+	changes int
+}
+
+func (store *versionedStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	store.Lock()
+	defer store.Unlock()
+
+	if r.Method == http.MethodPost {
+		if r.Header.Get(httputils.HeaderIfMatch) != store.run.Version {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		var run Run
+		if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		store.change(func(stored *Run) { *stored = run })
+	}
+
+	json.NewEncoder(w).Encode(store.run)
+}
+
+func (store *versionedStore) change(changes func(*Run)) {
+	version, _ := strconv.Atoi(store.run.Version)
+	changes(&store.run)
+	store.run.Version = strconv.Itoa(version + 1)
+	store.changes++
+}
+
+func newVersionedStore(t *testing.T) *versionedStore {
+	store := &versionedStore{run: Run{ID: 42, Status: common.RunStatusRunning, Details: map[string]string{}, Version: "1"}}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	defaultClient := httputils.DefaultClient
+	httputils.DefaultClient = httputils.NewClient(server.URL, "", nil)
+	t.Cleanup(func() { httputils.DefaultClient = defaultClient })
+
+	return store
+}
+
+func TestSubmitChangeConflict(t *testing.T) {
+	store := newVersionedStore(t)
+
+	run, err := QueryRun(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.change(func(stored *Run) { stored.Status = common.RunStatusCanceled })
+
+	run.Status = common.RunStatusCompleted
+	if _, err := run.SubmitChange(); !IsConflict(err) {
+		t.Fatalf("expect a conflict but found %v", err)
+	}
+	if store.run.Status != common.RunStatusCanceled {
+		t.Errorf("expect the concurrent change to be kept but found %s", store.run.Status)
+	}
+}
+
+func TestSubmitChangeWithoutVersion(t *testing.T) {
+	store := newVersionedStore(t)
+	store.run.Version = ""
+
+	run := &Run{ID: 42, Status: common.RunStatusCompleted}
+	if _, err := run.SubmitChange(); err != nil {
+		t.Fatalf("expect a run without version to be saved unconditionally but found %s", err)
+	}
+	if store.run.Status != common.RunStatusCompleted {
+		t.Errorf("expect the run to be saved but found %s", store.run.Status)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	store := newVersionedStore(t)
+
+	run, err := QueryRun(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.change(func(stored *Run) { stored.Details[common.KeyRemark] = "official" })
+
+	applied := 0
+	updated, err := run.Update(func(run *Run) error {
+		applied++
+		run.Details[common.KeyJobName] = "azurecli-42"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if applied != 2 {
+		t.Errorf("expect the changes to be applied again after the conflict but they were applied %d times", applied)
+	}
+	if updated.Details[common.KeyRemark] != "official" || updated.Details[common.KeyJobName] != "azurecli-42" {
+		t.Errorf("expect both changes to be kept but found %v", updated.Details)
+	}
+	if len(run.Details) != 0 {
+		t.Errorf("expect the original run to be left as is but found %v", run.Details)
+	}
+}
+
+func TestUpdateAborted(t *testing.T) {
+	store := newVersionedStore(t)
+
+	run, err := QueryRun(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = run.Update(func(run *Run) error {
+		return &ConflictError{RunID: run.ID}
+	})
+	if err == nil || store.changes != 0 {
+		t.Errorf("expect the update to stop without saving the run but found %v", err)
+	}
+}
+
+func TestUpdateGivesUp(t *testing.T) {
+	store := newVersionedStore(t)
+
+	run, err := QueryRun(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := 0
+	_, err = run.Update(func(run *Run) error {
+		applied++
+		store.Lock()
+		store.change(func(stored *Run) {})
+		store.Unlock()
+		return nil
+	})
+	if !IsConflict(err) {
+		t.Errorf("expect a conflict but found %v", err)
+	}
+	if applied != maxUpdateAttempts {
+		t.Errorf("expect %d attempts but found %d", maxUpdateAttempts, applied)
+	}
+}
+
+func TestGetProduct(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		details  map[string]string
+		expected string
+	}{
+		{"detail", map[string]interface{}{common.KeyImageName: "azurecli:latest"}, map[string]string{common.KeyProduct: "azurecore"}, "azurecore"},
+		{"registry", map[string]interface{}{common.KeyImageName: "azureclidev.azurecr.io/azurecli:python3.6-1234"}, nil, "azurecli"},
+		{"port", map[string]interface{}{common.KeyImageName: "localhost:5000/team/azurecli"}, nil, "azurecli"},
+		{"digest", map[string]interface{}{common.KeyImageName: "azurecli@sha256:0123abcd"}, nil, "azurecli"},
+		{"images", map[string]interface{}{common.KeyImages: []interface{}{
+			map[string]interface{}{"name": "py36", "image": "azureclidev.azurecr.io/azurecli:py36"},
+		}}, nil, "azurecli"},
+		{"unknown", nil, nil, ""},
+	}
+
+	for _, test := range tests {
+		run := &Run{Settings: test.settings, Details: test.details}
+		if product := run.GetProduct(); product != test.expected {
+			t.Errorf("%s: expect product %q but found %q", test.name, test.expected, product)
+		}
+	}
+}
@@ -1,17 +1,21 @@
 package models
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/Azure/adx-automation-agent/sdk/common"
 	"github.com/Azure/adx-automation-agent/sdk/httputils"
+	"github.com/sirupsen/logrus"
 )
 
 // TaskResult is the data model of a task in A01 system
@@ -27,101 +31,187 @@ type TaskResult struct {
 	Status        string                 `json:"status,omitempty"`
 }
 
-// CommitNew save an uncommitted Task to the database
-func (task *TaskResult) CommitNew() (*TaskResult, error) {
-	body, err := json.Marshal(task)
-	if err != nil {
-		return nil, fmt.Errorf("unable to marshal JSON: %s", err.Error())
+// GetKey returns the key which uniquely identifies this task before it is committed. The key is used as the
+// idempotency key when the task is committed and to name the task's log files.
+func (task *TaskResult) GetKey() string {
+	if key, ok := task.ResultDetails[common.KeyTaskKey].(string); ok {
+		return key
 	}
 
-	path := fmt.Sprintf("run/%d/task", task.RunID)
-	req, err := httputils.CreateRequest(http.MethodPost, path, body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create request: %s", err.Error())
-	}
+	return ""
+}
 
-	httpClient := http.Client{CheckRedirect: nil}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("http error: %s", err.Error())
+// IdempotencyKey returns the idempotency key used when the task is committed. It is the task's key if it has one.
+func (task *TaskResult) IdempotencyKey() string {
+	if key := task.GetKey(); len(key) > 0 {
+		return key
 	}
 
-	defer resp.Body.Close()
-	respContent, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read response body: %s", err.Error())
+	return httputils.NewIdempotencyKey()
+}
+
+// BatchIdempotencyKey returns the idempotency key used when the tasks are committed in one batch. It is derived from
+// the tasks' keys so a retried batch doesn't create duplicate tasks. The key depends on the batch, so a batch must be
+// retried with the same tasks, or with the key it was first sent with.
+func BatchIdempotencyKey(tasks []*TaskResult) string {
+	digest := sha256.New()
+	for _, task := range tasks {
+		io.WriteString(digest, task.GetKey())
+		io.WriteString(digest, "\n")
 	}
 
-	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("HTTP Status %d: %s", resp.StatusCode, string(respContent))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// CommitNew save an uncommitted Task to the database. The request carries the task's key as the idempotency key so
+// that a retried request doesn't create a duplicate task.
+func (task *TaskResult) CommitNew() (*TaskResult, error) {
+	return task.CommitNewContext(context.Background())
+}
+
+// CommitNewContext save an uncommitted Task to the database. The request is canceled when the context is done.
+func (task *TaskResult) CommitNewContext(ctx context.Context) (*TaskResult, error) {
+	return task.CommitNewWithClient(ctx, httputils.DefaultClient)
+}
+
+// CommitNewWithClient save an uncommitted Task to the store of the given client
+func (task *TaskResult) CommitNewWithClient(ctx context.Context, client *httputils.Client) (*TaskResult, error) {
+	req, err := client.NewJSONRequest(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("run/%d/task", task.RunID),
+		task)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set(httputils.HeaderIdempotencyKey, task.IdempotencyKey())
 
 	var result TaskResult
-	err = json.Unmarshal(respContent, &result)
-	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal JSON: %s", err.Error())
+	if err := client.SendJSON(req, &result); err != nil {
+		return nil, err
 	}
 
 	return &result, nil
 }
 
-// CommitChanges save a committed task's updated properties to the database
-func (task *TaskResult) CommitChanges() (*TaskResult, error) {
-	body, err := json.Marshal(task)
-	if err != nil {
-		return nil, fmt.Errorf("unable to marshal JSON: %s", err.Error())
-	}
+// CommitTasks save a batch of uncommitted tasks of the given run to the database in a single request.
+func CommitTasks(runID int, tasks []*TaskResult) ([]TaskResult, error) {
+	return CommitTasksContext(context.Background(), runID, tasks)
+}
 
-	path := fmt.Sprintf("task/%d", task.ID)
-	req, err := httputils.CreateRequest(http.MethodPost, path, body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create request: %s", err.Error())
-	}
+// CommitTasksContext save a batch of uncommitted tasks of the given run to the database in a single request. The
+// request is canceled when the context is done.
+func CommitTasksContext(ctx context.Context, runID int, tasks []*TaskResult) ([]TaskResult, error) {
+	return CommitTasksWithKeyContext(ctx, runID, tasks, BatchIdempotencyKey(tasks))
+}
 
-	httpClient := http.Client{CheckRedirect: nil}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("http error: %s", err.Error())
-	}
+// CommitTasksWithKeyContext save a batch of uncommitted tasks of the given run to the database in a single request
+// with the given idempotency key. A batch retried after its first attempt failed is sent with the key of the first
+// attempt.
+func CommitTasksWithKeyContext(ctx context.Context, runID int, tasks []*TaskResult, key string) ([]TaskResult, error) {
+	return CommitTasksWithClient(ctx, httputils.DefaultClient, runID, tasks, key)
+}
 
-	defer resp.Body.Close()
-	respContent, err := ioutil.ReadAll(resp.Body)
+// CommitTasksWithClient save a batch of uncommitted tasks of the given run to the store of the given client in a single
+// request with the given idempotency key
+func CommitTasksWithClient(
+	ctx context.Context,
+	client *httputils.Client,
+	runID int,
+	tasks []*TaskResult,
+	key string) ([]TaskResult, error) {
+	req, err := client.NewJSONRequest(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("run/%d/tasks", runID),
+		tasks)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read response body: %s", err.Error())
+		return nil, err
 	}
+	req.Header.Set(httputils.HeaderIdempotencyKey, key)
 
-	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("HTTP Status %d: %s", resp.StatusCode, string(respContent))
+	var result []TaskResult
+	if err := client.SendJSON(req, &result); err != nil {
+		return nil, err
 	}
 
+	return result, nil
+}
+
+// CommitChanges save a committed task's updated properties to the database
+func (task *TaskResult) CommitChanges() (*TaskResult, error) {
+	return task.CommitChangesContext(context.Background())
+}
+
+// CommitChangesContext save a committed task's updated properties to the database. The request is canceled when the
+// context is done.
+func (task *TaskResult) CommitChangesContext(ctx context.Context) (*TaskResult, error) {
+	return task.CommitChangesWithClient(ctx, httputils.DefaultClient)
+}
+
+// CommitChangesWithClient save a committed task's updated properties to the store of the given client
+func (task *TaskResult) CommitChangesWithClient(ctx context.Context, client *httputils.Client) (*TaskResult, error) {
 	var result TaskResult
-	err = json.Unmarshal(respContent, &result)
+	err := client.Do(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("task/%d", task.ID),
+		task,
+		&result)
 	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal JSON: %s", err.Error())
+		return nil, err
 	}
 
 	return &result, nil
 }
 
-// SaveTaskLog the task execution log to the mounted artifacts folder
-func (task *TaskResult) SaveTaskLog(output []byte) (string, error) {
+// ApplyLogPathTemplate sets the paths of the task log and the recording file in the result details. The template is
+// the product's log path template in which "{}" is replaced by the relative path of the file in the file share.
+func (task *TaskResult) ApplyLogPathTemplate(template string) {
+	if task.ResultDetails == nil {
+		task.ResultDetails = make(map[string]interface{})
+	}
+
+	task.ResultDetails[common.KeyTaskLogPath] = strings.Replace(template, "{}", task.GetLogPath(), 1)
+	task.ResultDetails[common.KeyTaskRecordPath] = strings.Replace(template, "{}", task.GetRecordingPath(), 1)
+}
+
+// GetLogPath returns the relative path of the task's log file in the file share. The file is named after the task's ID
+// once the task is committed, and after its key before.
+func (task *TaskResult) GetLogPath() string {
+	if task.ID > 0 {
+		return fmt.Sprintf(common.PathTemplateCommittedTaskLog, task.RunID, task.ID)
+	}
+	return fmt.Sprintf(common.PathTemplateTaskLog, task.RunID, task.GetKey())
+}
+
+// GetRecordingPath returns the relative path of the task's recording file in the file share. The file is named after
+// the task's ID once the task is committed, and after its key before.
+func (task *TaskResult) GetRecordingPath() string {
+	if task.ID > 0 {
+		return fmt.Sprintf(common.PathTemplateCommittedTaskRecording, task.RunID, task.ID)
+	}
+	return fmt.Sprintf(common.PathTemplateTaskRecording, task.RunID, task.GetKey())
+}
+
+// SaveTaskLog the task execution log to the mounted artifacts folder. It returns false if the artifacts folder is not
+// mounted.
+func (task *TaskResult) SaveTaskLog(output []byte) (bool, error) {
 	stat, err := os.Stat(common.PathMountArtifacts)
 	if err == nil && stat.IsDir() {
 		runLogFolder := path.Join(common.PathMountArtifacts, strconv.Itoa(task.RunID))
 		os.Mkdir(runLogFolder, os.ModeDir)
 
-		taskLogFileName := fmt.Sprintf("task_%d.log", task.ID)
-		taskLogFilePath := path.Join(runLogFolder, taskLogFileName)
-		err = ioutil.WriteFile(taskLogFilePath, output, 0644)
+		err = ioutil.WriteFile(path.Join(common.PathMountArtifacts, task.GetLogPath()), output, 0644)
 		if err != nil {
-			return "", fmt.Errorf("Fail to save task log. Reason: unable to write file. Exception: %s", err.Error())
+			return true, fmt.Errorf("Fail to save task log. Reason: unable to write file. Exception: %s", err.Error())
 		}
 
-		return path.Join(strconv.Itoa(task.RunID), taskLogFileName), nil
+		return true, nil
 	}
 
 	// the mount directory doesn't exist, output the log to stdout and let the pod logs handle it.
-	log.Println("Storage volume is not mount for logging. Print the task output to the stdout instead.")
-	log.Println("\n" + string(output))
-	return "", nil
+	logrus.WithField("output", string(output)).
+		Info("Storage volume is not mount for logging. Print the task output to the stdout instead.")
+	return false, nil
 }
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+)
+
+func newKeyedTasks(keys ...string) []*TaskResult {
+	tasks := make([]*TaskResult, 0, len(keys))
+	for _, key := range keys {
+		tasks = append(tasks, &TaskResult{ResultDetails: map[string]interface{}{common.KeyTaskKey: key}})
+	}
+	return tasks
+}
+
+func TestBatchIdempotencyKey(t *testing.T) {
+	if BatchIdempotencyKey(newKeyedTasks("a", "b")) != BatchIdempotencyKey(newKeyedTasks("a", "b")) {
+		t.Error("expect the same batch to have the same key")
+	}
+	if BatchIdempotencyKey(newKeyedTasks("ab", "c")) == BatchIdempotencyKey(newKeyedTasks("a", "bc")) {
+		t.Error("expect the task keys to be separated")
+	}
+}
+
+func TestTaskPaths(t *testing.T) {
+	task := newKeyedTasks("abc")[0]
+	task.RunID = 42
+	if task.GetLogPath() != "42/task_abc.log" || task.GetRecordingPath() != "42/recording_abc.yaml" {
+		t.Errorf("expect the files of an uncommitted task to be named after its key but found %s, %s",
+			task.GetLogPath(), task.GetRecordingPath())
+	}
+
+	task.ID = 7
+	if task.GetLogPath() != "42/task_7.log" || task.GetRecordingPath() != "42/recording_7.yaml" {
+		t.Errorf("expect the files of a committed task to be named after its ID but found %s, %s",
+			task.GetLogPath(), task.GetRecordingPath())
+	}
+}
+
+func TestNamesTasksByKey(t *testing.T) {
+	if (&DroidMetadata{Version: DroidMetadataV3}).NamesTasksByKey() {
+		t.Error("expect a v3 image to keep the after_test contract of committed tasks")
+	}
+	if !(&DroidMetadata{Version: DroidMetadataV4}).NamesTasksByKey() {
+		t.Error("expect a v4 image to name the tasks by key")
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"os/exec"
 	"strconv"
 	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/httputils"
 )
 
 // TaskSetting is the setting data model of A01Task
@@ -22,15 +25,23 @@ func (setting *TaskSetting) GetIdentifier() string {
 	return setting.Classifier["identifier"]
 }
 
+// taskTimeout is the maximum execution time of a task
+const taskTimeout = time.Hour * 2
+
 // Execute runs the command and returns the execution results
 func (setting *TaskSetting) Execute() (result string, duration int, output []byte) {
+	return setting.ExecuteContext(context.Background())
+}
+
+// ExecuteContext runs the command and returns the execution results. The command is killed when the context is done
+// or the task times out.
+func (setting *TaskSetting) ExecuteContext(parent context.Context) (result string, duration int, output []byte) {
 	shellExec := "/bin/bash"
 	if _, err := os.Stat("/bin/bash"); os.IsNotExist(err) {
 		shellExec = "/bin/sh"
 	}
 
-	timeout := time.Hour * 2
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(parent, taskTimeout)
 	defer cancel()
 
 	execution := []string{"-c", setting.Execution["command"]}
@@ -45,7 +56,7 @@ func (setting *TaskSetting) Execute() (result string, duration int, output []byt
 	if err == nil {
 		result = "Passed"
 	} else {
-		if elapsed >= timeout {
+		if elapsed >= taskTimeout {
 			result = "Timeout"
 		} else {
 			result = "Failed"
@@ -60,13 +71,16 @@ func (setting *TaskSetting) CreateCompletedTask(result string, duration int, pod
 	nRunID, _ := strconv.Atoi(runID)
 
 	task := TaskResult{
-		Name:          fmt.Sprintf("Test: %s", setting.GetIdentifier()),
-		Duration:      duration,
-		Result:        result,
-		ResultDetails: map[string]interface{}{"agent": podName},
-		RunID:         nRunID,
-		Settings:      *setting,
-		Status:        "Completed",
+		Name:     fmt.Sprintf("Test: %s", setting.GetIdentifier()),
+		Duration: duration,
+		Result:   result,
+		ResultDetails: map[string]interface{}{
+			"agent":           podName,
+			common.KeyTaskKey: httputils.NewIdempotencyKey(),
+		},
+		RunID:    nRunID,
+		Settings: *setting,
+		Status:   "Completed",
 	}
 
 	return &task
@@ -80,8 +94,9 @@ func (setting *TaskSetting) CreateUncompletedTask(podName string, runID string,
 		Name:   fmt.Sprintf("Test: %s", setting.GetIdentifier()),
 		Result: "Error",
 		ResultDetails: map[string]interface{}{
-			"agent": podName,
-			"error": errorMsg,
+			"agent":           podName,
+			"error":           errorMsg,
+			common.KeyTaskKey: httputils.NewIdempotencyKey(),
 		},
 		RunID:    nRunID,
 		Settings: *setting,
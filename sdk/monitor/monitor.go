@@ -1,79 +1,116 @@
 package monitor
 
 import (
+	"context"
 	"fmt"
-	"github.com/sirupsen/logrus"
 	"time"
 
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/Azure/adx-automation-agent/sdk/common"
-	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
 	"github.com/Azure/adx-automation-agent/sdk/models"
 	"github.com/Azure/adx-automation-agent/sdk/schedule"
 )
 
-const (
-	interval = time.Second * 30
-)
+// interval is the time between two checks of the job. It is a variable so the tests can shorten it.
+var interval = time.Second * 30
 
-var (
-	namespace = common.GetCurrentNamespace("a01-prod")
-	clientset = kubeutils.TryCreateKubeClientset()
-)
+// Queues inspects the task queues. It is implemented by schedule.TaskBroker.
+type Queues interface {
+	QueueInspect(name string) (amqp.Queue, error)
+}
 
 // WaitTasks blocks the caller till the job finishes.
-func WaitTasks(taskBroker *schedule.TaskBroker, run *models.Run) error {
-	logrus.Info("Begin monitoring task execution ...")
-
-	ch, err := taskBroker.GetChannel()
-	if err != nil {
-		return err
-	}
+func WaitTasks(client kubernetes.Interface, namespace string, queues Queues, run *models.Run) error {
+	return WaitTasksContext(context.Background(), client, namespace, queues, run)
+}
 
-	jobName := run.Details[common.KeyJobName]
-	podListOpt := metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%s", jobName)}
-	api := clientset.CoreV1()
+// WaitTasksContext blocks the caller till the job finishes or the context is done. The job finishes once its queue is
+// empty or deleted and none of its pods is running. The pods are listed in the given namespace.
+func WaitTasksContext(ctx context.Context, client kubernetes.Interface, namespace string, queues Queues, run *models.Run) error {
+	logrus.Info("Begin monitoring task execution ...")
 
 	for {
-		time.Sleep(interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
 
-		queue, err := ch.QueueInspect(jobName)
+		done, _, err := CheckTasksContext(ctx, client, namespace, queues, run)
 		if err != nil {
-			logrus.Info("The queue doesn't exist. All tasks have been executed.")
-			break
+			logrus.Warn(err)
+		} else if done {
+			return nil
 		}
-		logrus.Infof("Queue: messages %d.", queue.Messages)
+	}
+}
 
-		if queue.Messages != 0 {
-			// there are tasks to be run
-			continue
-		}
+// CheckTasksContext returns true if the job finished, which is once its queue is empty or deleted and none of its pods
+// is running. It returns the number of tasks left in the queue as well. A multi-image run finishes once the Jobs of all
+// its images finish, and the tasks left in all their queues are returned.
+func CheckTasksContext(ctx context.Context, client kubernetes.Interface, namespace string, queues Queues, run *models.Run) (done bool, remaining int, err error) {
+	jobNames := run.GetJobNames()
+	if len(jobNames) == 0 {
+		jobNames = []string{run.Details[common.KeyJobName]}
+	}
 
-		// the number of the message in the queue is zero. make sure all the
-		// pods in this job have finished
-		podList, err := api.Pods(namespace).List(podListOpt)
+	done = true
+	for _, jobName := range jobNames {
+		jobDone, jobRemaining, err := checkJob(ctx, client, namespace, queues, jobName)
 		if err != nil {
-			logrus.Warnf("Fail to list pod of %s: %s", jobName, err)
-			continue
+			return false, 0, err
 		}
+		done = done && jobDone
+		remaining += jobRemaining
+	}
+	metrics.SetQueueDepthContext(ctx, remaining)
 
-		runningPods := 0
-		for _, pod := range podList.Items {
-			if pod.Status.Phase == corev1.PodRunning {
-				runningPods++
-			}
-		}
+	return done, remaining, nil
+}
+
+// checkJob returns true if the job of the given name finished and the number of tasks left in its queue
+func checkJob(ctx context.Context, client kubernetes.Interface, namespace string, queues Queues, jobName string) (done bool, remaining int, err error) {
+	queue, err := queues.QueueInspect(jobName)
+	if schedule.IsQueueNotFound(err) {
+		logrus.Infof("Queue %s doesn't exist. All tasks have been executed.", jobName)
+		return true, 0, nil
+	} else if err != nil {
+		return false, 0, fmt.Errorf("fail to inspect queue %s: %s", jobName, err.Error())
+	}
+	logrus.Infof("Queue %s: messages %d.", jobName, queue.Messages)
 
-		if runningPods != 0 {
-			logrus.Infof("%d pod are still running.", runningPods)
-			continue
+	if queue.Messages != 0 {
+		// there are tasks to be run
+		return false, queue.Messages, nil
+	}
+
+	// the number of the message in the queue is zero. make sure all the
+	// pods in this job have finished
+	podListOpt := metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%s", jobName)}
+	podList, err := client.CoreV1().Pods(namespace).List(ctx, podListOpt)
+	if err != nil {
+		return false, 0, fmt.Errorf("fail to list pod of %s: %s", jobName, err.Error())
+	}
+
+	runningPods := 0
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == corev1.PodRunning {
+			runningPods++
 		}
+	}
 
-		// zero task in the queue and all pod stop.
-		break
+	if runningPods != 0 {
+		logrus.Infof("%d pod are still running.", runningPods)
+		return false, 0, nil
 	}
 
-	return nil
+	// zero task in the queue and all pod stop.
+	return true, 0, nil
 }
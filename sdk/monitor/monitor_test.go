@@ -0,0 +1,200 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/streadway/amqp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testNamespace = "a01-test"
+	testJobName   = "azurecli-42-abc"
+)
+
+func init() {
+	interval = time.Millisecond
+}
+
+// fakeQueues returns the queue states in order. The queue is deleted once the states are exhausted. The callback
+// runs before each inspection. The first inspections fail as many times as failures.
+type fakeQueues struct {
+	lock     sync.Mutex
+	messages []int
+	inspects int
+	failures int
+	callback func(inspects int)
+}
+
+func (queues *fakeQueues) QueueInspect(name string) (amqp.Queue, error) {
+	queues.lock.Lock()
+	defer queues.lock.Unlock()
+
+	queues.inspects++
+	if queues.callback != nil {
+		queues.callback(queues.inspects)
+	}
+
+	if queues.inspects <= queues.failures {
+		return amqp.Queue{}, errors.New("connection reset by peer")
+	}
+
+	if len(queues.messages) == 0 {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue"}
+	}
+
+	messages := queues.messages[0]
+	if len(queues.messages) > 1 {
+		queues.messages = queues.messages[1:]
+	}
+	return amqp.Queue{Name: name, Messages: messages}, nil
+}
+
+func newTestRun() *models.Run {
+	return &models.Run{ID: 42, Details: map[string]string{common.KeyJobName: testJobName}}
+}
+
+func newPod(name string, jobName string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{"job-name": jobName},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+func TestWaitTasksQueueDeleted(t *testing.T) {
+	queues := &fakeQueues{}
+	client := fake.NewSimpleClientset(newPod("droid-a", testJobName, corev1.PodRunning))
+
+	if err := WaitTasks(client, testNamespace, queues, newTestRun()); err != nil {
+		t.Fatal(err)
+	}
+	if queues.inspects != 1 {
+		t.Errorf("expect the queue inspected once but found %d", queues.inspects)
+	}
+}
+
+func TestWaitTasksRunningPods(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newPod("droid-a", testJobName, corev1.PodRunning),
+		newPod("droid-b", testJobName, corev1.PodSucceeded),
+		newPod("other", "other-job", corev1.PodRunning))
+
+	queues := &fakeQueues{
+		messages: []int{3, 0},
+		callback: func(inspects int) {
+			// the last droid finishes after the queue has been drained for a while
+			if inspects == 4 {
+				pod := newPod("droid-a", testJobName, corev1.PodSucceeded)
+				if _, err := client.CoreV1().Pods(testNamespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	}
+
+	if err := WaitTasks(client, testNamespace, queues, newTestRun()); err != nil {
+		t.Fatal(err)
+	}
+	if queues.inspects != 4 {
+		t.Errorf("expect the monitor to wait for the running pod but it inspected the queue %d times", queues.inspects)
+	}
+}
+
+func TestWaitTasksInspectFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	queues := &fakeQueues{messages: []int{2, 0}, failures: 2}
+
+	// a queue which fails to be inspected isn't taken for a deleted one
+	if done, _, err := CheckTasksContext(context.Background(), client, testNamespace, queues, newTestRun()); done || err == nil {
+		t.Errorf("expect the failure to be returned but found %v, %v", done, err)
+	}
+
+	if err := WaitTasks(client, testNamespace, queues, newTestRun()); err != nil {
+		t.Fatal(err)
+	}
+	if queues.inspects != 4 {
+		t.Errorf("expect the queue inspected again after a failure till it is drained but found %d inspections", queues.inspects)
+	}
+}
+
+func TestWaitTasksListFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	lists := 0
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists++
+		if lists == 1 {
+			return true, nil, errors.New("the server is unavailable")
+		}
+		return false, nil, nil
+	})
+
+	queues := &fakeQueues{messages: []int{0}}
+	if err := WaitTasks(client, testNamespace, queues, newTestRun()); err != nil {
+		t.Fatal(err)
+	}
+	if lists != 2 {
+		t.Errorf("expect the pods listed again after a failure but they were listed %d times", lists)
+	}
+}
+
+func TestWaitTasksCanceled(t *testing.T) {
+	client := fake.NewSimpleClientset(newPod("droid-a", testJobName, corev1.PodRunning))
+	queues := &fakeQueues{messages: []int{5}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := WaitTasksContext(ctx, client, testNamespace, queues, newTestRun()); err != context.DeadlineExceeded {
+		t.Errorf("expect the deadline exceeded error but found %v", err)
+	}
+}
+
+// namedQueues holds the number of messages of each queue. A queue not in the map doesn't exist.
+type namedQueues map[string]int
+
+func (queues namedQueues) QueueInspect(name string) (amqp.Queue, error) {
+	messages, ok := queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue"}
+	}
+	return amqp.Queue{Name: name, Messages: messages}, nil
+}
+
+func TestCheckTasksMultiImage(t *testing.T) {
+	run := newTestRun()
+	run.Settings = map[string]interface{}{
+		common.KeyImages: `[{"name": "py36", "image": "azurecli:py36"}, {"name": "py39", "image": "azurecli:py39"}]`,
+	}
+	client := fake.NewSimpleClientset(newPod("droid-a", testJobName+"-py39", corev1.PodRunning))
+
+	queues := namedQueues{testJobName + "-py36": 2, testJobName + "-py39": 3}
+	if done, remaining, err := CheckTasksContext(context.Background(), client, testNamespace, queues, run); err != nil || done || remaining != 5 {
+		t.Errorf("expect the tasks of both images to remain but found done %v, remaining %d, error %v", done, remaining, err)
+	}
+
+	// the first image's queue is deleted while the second image's droid is still running
+	queues = namedQueues{testJobName + "-py39": 0}
+	if done, _, err := CheckTasksContext(context.Background(), client, testNamespace, queues, run); err != nil || done {
+		t.Errorf("expect the run to wait for the second image's droid but found done %v, error %v", done, err)
+	}
+
+	pod := newPod("droid-a", testJobName+"-py39", corev1.PodSucceeded)
+	client.CoreV1().Pods(testNamespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+	if done, _, err := CheckTasksContext(context.Background(), client, testNamespace, queues, run); err != nil || !done {
+		t.Errorf("expect the run to be done once the droids of all images finished but found done %v, error %v", done, err)
+	}
+}
@@ -0,0 +1,403 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	entryExt  = ".json"
+	uploadExt = ".upload"
+
+	// batchSeparator separates the batch key from the task key in the name of an entry saved with its batch
+	batchSeparator = "."
+
+	// flushBatchSize is the maximum number of tasks committed in one request during a flush
+	flushBatchSize = 50
+)
+
+// artifactsRoot is where the artifacts storage is mounted
+var artifactsRoot = common.PathMountArtifacts
+
+// Outbox is a durable journal of task results which failed to be committed to the store, and of task logs and
+// recordings which failed to be uploaded to the object store. Each entry is saved to a file in the outbox directory and
+// removed once it is committed or uploaded.
+type Outbox struct {
+	dir      string
+	uploader storage.Uploader
+	lock     sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+
+	// flushLock serializes the flushes, so an entry isn't committed twice at once. The entries are committed without
+	// lock, so the tasks are saved to the outbox while it is flushed.
+	flushLock sync.Mutex
+}
+
+// entry is an outbox entry read by a flush
+type entry struct {
+	name    string
+	path    string
+	info    os.FileInfo
+	content []byte
+}
+
+// Open returns the outbox stored in the given directory. The directory is created if it doesn't exist.
+func Open(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create outbox directory %s: %s", dir, err)
+	}
+
+	return &Outbox{dir: dir}, nil
+}
+
+// OpenForPod returns the outbox of the given pod. The outbox is saved to the artifacts file share when it is mounted
+// so that the dispatcher can reconcile the leftover entries. Otherwise it is saved to a local directory.
+func OpenForPod(runID int, podName string) (*Outbox, error) {
+	if stat, err := os.Stat(artifactsRoot); err == nil && stat.IsDir() {
+		return Open(path.Join(RunDir(runID), podName))
+	}
+
+	logrus.Warn("Storage volume is not mount. The outbox is saved locally and will be lost if the pod exits.")
+	return Open(path.Join(common.PathLocalOutbox, podName))
+}
+
+// RunDir returns the directory in the artifacts file share where the outboxes of a run are saved
+func RunDir(runID int) string {
+	return path.Join(artifactsRoot, fmt.Sprintf(common.PathTemplateOutbox, runID))
+}
+
+// SetUploader sets the uploader of the artifacts journaled by AddUpload
+func (box *Outbox) SetUploader(uploader storage.Uploader) {
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	box.uploader = uploader
+}
+
+// Add saves the uncommitted task to the outbox. The task must have a key.
+func (box *Outbox) Add(task *models.TaskResult) error {
+	return box.AddInBatch(task, "")
+}
+
+// AddInBatch saves the uncommitted task of a batch which failed to be committed to the outbox. The tasks saved with the
+// same batch key are committed again together with that key, so the store recognizes the retried batch if the first
+// attempt did reach it. The task must have a key.
+func (box *Outbox) AddInBatch(task *models.TaskResult, batchKey string) error {
+	content, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("unable to marshal JSON: %s", err)
+	}
+
+	name := task.GetKey() + entryExt
+	if len(batchKey) > 0 {
+		name = batchKey + batchSeparator + name
+	}
+	return box.write(name, content)
+}
+
+// AddUpload saves the artifact at the relative path in the artifacts storage to the outbox, so it is uploaded by the
+// next flush. The relative path is the object's key.
+func (box *Outbox) AddUpload(relPath string) error {
+	name := strings.Replace(filepath.ToSlash(relPath), "/", "_", -1)
+	return box.write(name+uploadExt, []byte(relPath))
+}
+
+// write saves an entry of the given name
+func (box *Outbox) write(name string, content []byte) error {
+	box.lock.Lock()
+	defer box.lock.Unlock()
+
+	// write to a temporary file first so a partially written entry is never picked up
+	file, err := ioutil.TempFile(box.dir, ".pending-")
+	if err != nil {
+		return fmt.Errorf("unable to create outbox entry: %s", err)
+	}
+
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("unable to write outbox entry: %s", err)
+	}
+
+	return os.Rename(file.Name(), filepath.Join(box.dir, name))
+}
+
+// Len returns the number of entries in the outbox
+func (box *Outbox) Len() int {
+	names, _ := box.entries(entryExt)
+	uploads, _ := box.entries(uploadExt)
+	return len(names) + len(uploads)
+}
+
+// Flush commits all the tasks in the outbox in batches and uploads the journaled artifacts. Committed tasks and uploaded
+// artifacts are removed. It returns the number of entries left in the outbox and the last error encountered.
+func (box *Outbox) Flush() (remaining int, err error) {
+	return box.FlushContext(context.Background())
+}
+
+// FlushContext commits all the tasks in the outbox in batches till the context is done. The tasks saved with a batch
+// key are committed in their original batch with its key. The other tasks are committed in batches of flushBatchSize.
+func (box *Outbox) FlushContext(ctx context.Context) (remaining int, err error) {
+	box.flushLock.Lock()
+	defer box.flushLock.Unlock()
+
+	entries, remaining, err := box.read(entryExt)
+	if entries == nil && err != nil {
+		return 0, err
+	}
+
+	type pendingBatch struct {
+		key     string
+		tasks   []*models.TaskResult
+		entries []*entry
+	}
+
+	var batches []*pendingBatch
+	keyed := make(map[string]*pendingBatch)
+	var unkeyed *pendingBatch
+	for _, e := range entries {
+		var task models.TaskResult
+		if jsonErr := json.Unmarshal(e.content, &task); jsonErr != nil {
+			// a corrupted entry can never be committed. keep it for investigation but don't count it.
+			logrus.Errorf("Outbox entry %s is corrupted and is skipped.", e.path)
+			continue
+		}
+
+		var batch *pendingBatch
+		if i := strings.Index(e.name, batchSeparator); i >= 0 && i < len(e.name)-len(entryExt) {
+			key := e.name[:i]
+			if batch = keyed[key]; batch == nil {
+				batch = &pendingBatch{key: key}
+				keyed[key] = batch
+				batches = append(batches, batch)
+			}
+		} else {
+			if unkeyed == nil || len(unkeyed.tasks) >= flushBatchSize {
+				unkeyed = &pendingBatch{}
+				batches = append(batches, unkeyed)
+			}
+			batch = unkeyed
+		}
+
+		batch.tasks = append(batch.tasks, &task)
+		batch.entries = append(batch.entries, e)
+	}
+
+	for _, batch := range batches {
+		key := batch.key
+		if len(key) == 0 {
+			key = models.BatchIdempotencyKey(batch.tasks)
+		}
+
+		if _, commitErr := models.CommitTasksWithKeyContext(ctx, batch.tasks[0].RunID, batch.tasks, key); commitErr != nil {
+			err = commitErr
+			remaining += len(batch.tasks)
+			continue
+		}
+
+		logrus.Infof("Committed %d task(s) from the outbox.", len(batch.tasks))
+		box.remove(batch.entries...)
+	}
+
+	remainingUploads, uploadErr := box.flushUploads(ctx)
+	remaining += remainingUploads
+	if uploadErr != nil {
+		err = uploadErr
+	}
+
+	return
+}
+
+// flushUploads uploads the journaled artifacts. The artifacts are kept if no uploader is set.
+func (box *Outbox) flushUploads(ctx context.Context) (remaining int, err error) {
+	box.lock.Lock()
+	uploader := box.uploader
+	box.lock.Unlock()
+
+	entries, remaining, err := box.read(uploadExt)
+	if len(entries) == 0 {
+		return remaining, err
+	} else if uploader == nil {
+		return remaining + len(entries), fmt.Errorf("no object store to upload %d artifact(s) to", len(entries))
+	}
+
+	uploaded := 0
+	for _, e := range entries {
+		if uploadErr := storage.UploadFile(ctx, uploader, artifactsRoot, string(e.content)); uploadErr != nil {
+			err = uploadErr
+			remaining++
+			continue
+		}
+
+		uploaded++
+		box.remove(e)
+	}
+
+	if uploaded > 0 {
+		logrus.Infof("Uploaded %d artifact(s) from the outbox.", uploaded)
+	}
+	return
+}
+
+// Start flushes the outbox in the background at the given interval till Stop is called.
+func (box *Outbox) Start(interval time.Duration) {
+	box.stop = make(chan struct{})
+	box.done = make(chan struct{})
+
+	go func() {
+		defer close(box.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-box.stop:
+				return
+			case <-ticker.C:
+				if box.Len() == 0 {
+					continue
+				}
+
+				if remaining, err := box.Flush(); err != nil {
+					logrus.Warnf("%d task(s) remain in the outbox: %s", remaining, err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the background flush and waits for the ongoing flush to finish.
+func (box *Outbox) Stop() {
+	if box.stop == nil {
+		return
+	}
+
+	close(box.stop)
+	<-box.done
+	box.stop = nil
+}
+
+// read reads the entries with the given extension in order. The entries which can't be read are counted in unread
+// and the last error is returned.
+func (box *Outbox) read(ext string) (entries []*entry, unread int, err error) {
+	box.lock.Lock()
+	defer box.lock.Unlock()
+
+	names, err := box.entries(ext)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries = make([]*entry, 0, len(names))
+	for _, name := range names {
+		e := &entry{name: name, path: filepath.Join(box.dir, name)}
+		var readErr error
+		if e.info, readErr = os.Stat(e.path); readErr == nil {
+			e.content, readErr = ioutil.ReadFile(e.path)
+		}
+		if readErr != nil {
+			err = fmt.Errorf("unable to read outbox entry %s: %s", name, readErr)
+			unread++
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+	return entries, unread, err
+}
+
+// remove removes the flushed entries. An entry saved again since it was read is kept, as its content wasn't flushed.
+func (box *Outbox) remove(entries ...*entry) {
+	box.lock.Lock()
+	defer box.lock.Unlock()
+
+	for _, e := range entries {
+		if info, err := os.Stat(e.path); err != nil || !os.SameFile(info, e.info) {
+			continue
+		}
+		if err := os.Remove(e.path); err != nil {
+			logrus.Warnf("Fail to remove outbox entry %s: %s", e.path, err)
+		}
+	}
+}
+
+// entries returns the names of the entries with the given extension in order
+func (box *Outbox) entries(ext string) ([]string, error) {
+	files, err := ioutil.ReadDir(box.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list outbox %s: %s", box.dir, err)
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ext) {
+			names = append(names, f.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reconcile commits the entries left in the outboxes of the given run in the artifacts file share. It returns the
+// number of entries which still can't be committed. It fails if the artifacts storage isn't mounted, as the outboxes
+// can't be reached then.
+func Reconcile(runID int) (remaining int, err error) {
+	return ReconcileContext(context.Background(), runID, nil)
+}
+
+// ReconcileContext commits the entries left in the outboxes of the given run in the artifacts file share till the
+// context is done. The journaled artifacts are uploaded with the given uploader.
+func ReconcileContext(ctx context.Context, runID int, uploader storage.Uploader) (remaining int, err error) {
+	if stat, err := os.Stat(artifactsRoot); err != nil || !stat.IsDir() {
+		return 0, fmt.Errorf("the artifacts storage isn't mounted at %s", artifactsRoot)
+	}
+
+	root := RunDir(runID)
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logrus.Infof("No outbox of run %d is found in %s.", runID, root)
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to list outboxes in %s: %s", root, err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		box, openErr := Open(filepath.Join(root, dir.Name()))
+		if openErr != nil {
+			err = openErr
+			continue
+		}
+		box.uploader = uploader
+
+		n, flushErr := box.FlushContext(ctx)
+		remaining += n
+		if flushErr != nil {
+			err = flushErr
+		}
+	}
+
+	return
+}
@@ -0,0 +1,264 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/httputils"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+)
+
+// batchStore records the idempotency key and the task keys of each committed batch. The commits wait for hold if set.
+type batchStore struct {
+	sync.Mutex
+	batches map[string][]string
+	hold    func()
+}
+
+func (store *batchStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if store.hold != nil {
+		store.hold()
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	var tasks []models.TaskResult
+	if err := json.NewDecoder(r.Body).Decode(&tasks); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var keys []string
+	for _, task := range tasks {
+		keys = append(keys, task.GetKey())
+	}
+	store.batches[r.Header.Get(httputils.HeaderIdempotencyKey)] = keys
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// useBatchStore serves the store API with a batchStore till the test ends
+func useBatchStore(t *testing.T) *batchStore {
+	store := &batchStore{batches: make(map[string][]string)}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	defaultClient := httputils.DefaultClient
+	httputils.DefaultClient = httputils.NewClient(server.URL, "", nil)
+	t.Cleanup(func() { httputils.DefaultClient = defaultClient })
+	return store
+}
+
+func newTask(key string) *models.TaskResult {
+	return &models.TaskResult{RunID: 42, ResultDetails: map[string]interface{}{common.KeyTaskKey: key}}
+}
+
+// fakeUploader records the uploaded objects. It fails while err is set.
+type fakeUploader struct {
+	objects map[string]string
+	err     error
+}
+
+func (uploader *fakeUploader) Upload(ctx context.Context, key string, content []byte) error {
+	if uploader.err != nil {
+		return uploader.err
+	}
+	uploader.objects[key] = string(content)
+	return nil
+}
+
+// useArtifactsRoot mounts a temporary directory as the artifacts storage till the test ends
+func useArtifactsRoot(t *testing.T) string {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := artifactsRoot
+	artifactsRoot = root
+	t.Cleanup(func() {
+		artifactsRoot = original
+		os.RemoveAll(root)
+	})
+	return root
+}
+
+func TestFlushBatches(t *testing.T) {
+	useArtifactsRoot(t)
+	store := useBatchStore(t)
+
+	box, err := OpenForPod(42, "azurecli-42-abc-xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := []*models.TaskResult{newTask("c"), newTask("a")}
+	second := []*models.TaskResult{newTask("b")}
+	for _, batch := range [][]*models.TaskResult{first, second} {
+		for _, task := range batch {
+			if err := box.AddInBatch(task, models.BatchIdempotencyKey(batch)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := box.Add(newTask("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining, err := box.FlushContext(context.Background()); remaining != 0 || err != nil {
+		t.Fatalf("expect the outbox to be flushed but found %d, %v", remaining, err)
+	}
+
+	// the batches are retried with the keys they were first sent with
+	if keys := store.batches[models.BatchIdempotencyKey(first)]; len(keys) != 2 {
+		t.Errorf("expect the first batch to be retried with its key but found %v", store.batches)
+	}
+	if keys := store.batches[models.BatchIdempotencyKey(second)]; len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("expect the second batch to be retried with its key but found %v", store.batches)
+	}
+	if keys := store.batches[models.BatchIdempotencyKey([]*models.TaskResult{newTask("d")})]; len(keys) != 1 {
+		t.Errorf("expect the task without batch to be committed but found %v", store.batches)
+	}
+	if len(store.batches) != 3 || box.Len() != 0 {
+		t.Errorf("expect 3 batches committed but found %v", store.batches)
+	}
+}
+
+// TestFlushWhileAdding verifies the tasks are saved to the outbox while it is flushed, and a task saved again while
+// it is committed is kept for the next flush
+func TestFlushWhileAdding(t *testing.T) {
+	store := useBatchStore(t)
+	committing, release := make(chan struct{}), make(chan struct{})
+	store.hold = func() {
+		close(committing)
+		<-release
+	}
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	box, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := box.Add(newTask("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan error)
+	go func() {
+		_, err := box.Flush()
+		flushed <- err
+	}()
+	<-committing
+
+	added := make(chan error)
+	go func() {
+		if err := box.Add(newTask("a")); err != nil {
+			added <- err
+			return
+		}
+		added <- box.Add(newTask("b"))
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the tasks to be saved while the outbox is flushed")
+	}
+
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if box.Len() != 2 {
+		t.Errorf("expect the tasks saved during the flush to be kept but found %d entries", box.Len())
+	}
+}
+
+func TestFlushUploads(t *testing.T) {
+	root := useArtifactsRoot(t)
+	if err := os.MkdirAll(filepath.Join(root, "42"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "42", "task_abc.log"), []byte("PASSED"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	box, err := OpenForPod(42, "azurecli-42-abc-xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := box.AddUpload("42/task_abc.log"); err != nil {
+		t.Fatal(err)
+	}
+	if box.Len() != 1 {
+		t.Fatalf("expect the upload to be journaled but found %d entries", box.Len())
+	}
+
+	uploader := &fakeUploader{objects: make(map[string]string), err: errors.New("the object store is unavailable")}
+	box.SetUploader(uploader)
+	if remaining, err := box.FlushContext(context.Background()); remaining != 1 || err == nil {
+		t.Fatalf("expect the upload to be kept when it fails but found %d, %v", remaining, err)
+	}
+
+	uploader.err = nil
+	if remaining, err := box.FlushContext(context.Background()); remaining != 0 || err != nil {
+		t.Fatalf("expect the upload to be flushed but found %d, %v", remaining, err)
+	}
+	if uploader.objects["42/task_abc.log"] != "PASSED" || box.Len() != 0 {
+		t.Errorf("expect the log to be uploaded once but found %v", uploader.objects)
+	}
+}
+
+func TestReconcileUploads(t *testing.T) {
+	useArtifactsRoot(t)
+
+	box, err := OpenForPod(42, "azurecli-42-abc-xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := box.AddUpload("42/recording_abc.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining, err := ReconcileContext(context.Background(), 42, nil); remaining != 1 || err == nil {
+		t.Errorf("expect the upload to be left without an uploader but found %d, %v", remaining, err)
+	}
+
+	// a journaled file which is gone has nothing to upload
+	uploader := &fakeUploader{objects: make(map[string]string)}
+	if remaining, err := ReconcileContext(context.Background(), 42, uploader); remaining != 0 || err != nil {
+		t.Errorf("expect the outbox to be reconciled but found %d, %v", remaining, err)
+	}
+}
+
+func TestReconcileWithoutStorage(t *testing.T) {
+	root := useArtifactsRoot(t)
+
+	if remaining, err := ReconcileContext(context.Background(), 42, nil); remaining != 0 || err != nil {
+		t.Errorf("expect a run without outbox to be reconciled but found %d, %v", remaining, err)
+	}
+
+	os.RemoveAll(root)
+	if _, err := ReconcileContext(context.Background(), 42, nil); err == nil {
+		t.Error("expect the reconciliation to fail when the artifacts storage isn't mounted")
+	}
+}
@@ -2,6 +2,7 @@ package reportutils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,6 +14,12 @@ import (
 
 // RefreshPowerBI requests the PowerBI service to refresh a data set
 func RefreshPowerBI(run *models.Run, product string) {
+	RefreshPowerBIContext(context.Background(), run, product)
+}
+
+// RefreshPowerBIContext requests the PowerBI service to refresh a data set. The request is canceled when the context
+// is done.
+func RefreshPowerBIContext(ctx context.Context, run *models.Run, product string) {
 	if !run.IsOfficial() {
 		logrus.Info("Skip PowerBI refresh: run is not official")
 		return
@@ -39,7 +46,7 @@ func RefreshPowerBI(run *models.Run, product string) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := httpClient.Do(req)
+	resp, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		logrus.Info(fmt.Sprintf("Fail to send request to PowerBI service: %v", err))
 		return
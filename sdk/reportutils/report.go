@@ -2,6 +2,7 @@ package reportutils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -17,6 +18,12 @@ var httpClient = &http.Client{}
 
 // Report method requests the email service to send emails
 func Report(run *models.Run, receivers []string, templateURL string) {
+	ReportContext(context.Background(), run, receivers, templateURL)
+}
+
+// ReportContext requests the email service to send emails. The results of a multi-image run by image are sent along,
+// so the report breaks them down by image. The request is canceled when the context is done.
+func ReportContext(ctx context.Context, run *models.Run, receivers []string, templateURL string) {
 	logrus.Info("Sending report...")
 
 	// Emails should not be sent to all the team if the run was not set with a remark
@@ -34,6 +41,9 @@ func Report(run *models.Run, receivers []string, templateURL string) {
 		content["run_id"] = strconv.Itoa(run.ID)
 		content["receivers"] = strings.Join(receivers, ",")
 		content["template"] = templateURL
+		if results, ok := run.Details[common.KeyImageResults]; ok {
+			content["image_results"] = results
+		}
 
 		body, err := json.Marshal(content)
 		if err != nil {
@@ -52,7 +62,7 @@ func Report(run *models.Run, receivers []string, templateURL string) {
 		}
 		req.Header.Set("Content-Type", "application/json")
 
-		resp, err := httpClient.Do(req)
+		resp, err := httpClient.Do(req.WithContext(ctx))
 		if err != nil {
 			logrus.Info("Fail to send request to email service.")
 			return
@@ -1,13 +1,21 @@
 package schedule
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Azure/adx-automation-agent/sdk/common"
 	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/Azure/adx-automation-agent/sdk/metrics"
 	"github.com/Azure/adx-automation-agent/sdk/models"
+	"github.com/Azure/adx-automation-agent/sdk/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
 )
 
 // TaskBroker represents an instance of message broker used in the A01 system
@@ -17,11 +25,22 @@ type TaskBroker struct {
 	channel        *amqp.Channel
 	connection     *amqp.Connection
 	declaredQueues []string
+
+	// receive a notification, or are closed, once the connection or the channel is lost
+	connectionClosed chan *amqp.Error
+	channelClosed    chan *amqp.Error
+
+	// lock guards the connection, the channel and the declared queues, which the liveness probe reads while the
+	// broker is used
+	lock sync.Mutex
 }
 
 // GetChannel returns the channel to this task broker. If a channel hasn't been
 // established, a new channel as well as a connection will be created.
 func (broker *TaskBroker) GetChannel() (*amqp.Channel, error) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
 	if broker.channel == nil {
 		if broker.connection == nil {
 			conn, err := amqp.Dial(broker.ConnectionName)
@@ -30,11 +49,12 @@ func (broker *TaskBroker) GetChannel() (*amqp.Channel, error) {
 				return nil, err
 			}
 			broker.connection = conn
+			broker.connectionClosed = conn.NotifyClose(make(chan *amqp.Error, 1))
 		}
 
 		ch, err := broker.connection.Channel()
 		if err != nil {
-			broker.Close()
+			broker.disconnect()
 			return nil, err
 		}
 
@@ -45,25 +65,51 @@ func (broker *TaskBroker) GetChannel() (*amqp.Channel, error) {
 			false, // global
 		)
 		if err != nil {
-			broker.Close()
+			broker.disconnect()
 			return nil, err
 		}
 
 		broker.channel = ch
+		broker.channelClosed = ch.NotifyClose(make(chan *amqp.Error, 1))
 	}
 
 	return broker.channel, nil
 }
 
+// Ping returns an error if the channel to this task broker hasn't been established or has been lost
+func (broker *TaskBroker) Ping() error {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	if broker.channel == nil {
+		return fmt.Errorf("not connected to the task broker")
+	}
+
+	select {
+	case err := <-broker.connectionClosed:
+		return fmt.Errorf("connection to the task broker is lost: %v", err)
+	case err := <-broker.channelClosed:
+		return fmt.Errorf("channel to the task broker is lost: %v", err)
+	default:
+		return nil
+	}
+}
+
 // QueueDeclare declare a queue associated with the given name. It returns the
 // queue as well as the channel associate with this connection. If a channel has
 // not been established, a new one will be created.
 func (broker *TaskBroker) QueueDeclare(name string) (queue amqp.Queue, ch *amqp.Channel, err error) {
+	return broker.queueDeclare(context.Background(), name)
+}
+
+// queueDeclare declares the queue of the given name, and reports the call in the metrics of the context's run
+func (broker *TaskBroker) queueDeclare(ctx context.Context, name string) (queue amqp.Queue, ch *amqp.Channel, err error) {
 	ch, err = broker.GetChannel()
 	if err != nil {
 		return amqp.Queue{}, nil, err
 	}
 
+	begin := time.Now()
 	queue, err = ch.QueueDeclare(
 		name,  // queue name
 		true,  // durable
@@ -72,31 +118,107 @@ func (broker *TaskBroker) QueueDeclare(name string) (queue amqp.Queue, ch *amqp.
 		false, // no-wait
 		nil,   // argument
 	)
+	metrics.ObserveBrokerCallContext(ctx, "declare", begin, err)
 
+	broker.lock.Lock()
 	broker.declaredQueues = append(broker.declaredQueues, queue.Name)
+	broker.lock.Unlock()
 
 	return
 }
 
+// QueueInspect returns the state of the queue of the given name. The broker closes the channel if the queue doesn't
+// exist, so the next call opens a new one.
+func (broker *TaskBroker) QueueInspect(name string) (amqp.Queue, error) {
+	ch, err := broker.GetChannel()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	begin := time.Now()
+	queue, err := ch.QueueInspect(name)
+	metrics.ObserveBrokerCall("inspect", begin, err)
+	if err != nil {
+		broker.dropChannel(ch)
+	}
+
+	return queue, err
+}
+
+// IsQueueNotFound returns true if the error of a queue operation means the queue doesn't exist
+func IsQueueNotFound(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+}
+
+// QueuePurge removes all the messages from the queue of the given name. It returns the number of removed messages.
+func (broker *TaskBroker) QueuePurge(name string) (int, error) {
+	ch, err := broker.GetChannel()
+	if err != nil {
+		return 0, err
+	}
+
+	begin := time.Now()
+	purged, err := ch.QueuePurge(name, false)
+	metrics.ObserveBrokerCall("purge", begin, err)
+	if err != nil {
+		broker.dropChannel(ch)
+	}
+
+	return purged, err
+}
+
+// QueueDelete deletes the queue of the given name with its messages. It returns the number of deleted messages.
+func (broker *TaskBroker) QueueDelete(name string) (int, error) {
+	ch, err := broker.GetChannel()
+	if err != nil {
+		return 0, err
+	}
+
+	begin := time.Now()
+	deleted, err := ch.QueueDelete(name, false, false, false)
+	metrics.ObserveBrokerCall("delete", begin, err)
+	if err != nil {
+		broker.dropChannel(ch)
+	}
+
+	return deleted, err
+}
+
 // PublishTasks publishes the tasks to the queue specified by the given name. The queue will be
-// declared if it doesn't already exist.
-func (broker *TaskBroker) PublishTasks(queueName string, settings []models.TaskSetting) (err error) {
+// declared if it doesn't already exist. It returns the number of published tasks.
+func (broker *TaskBroker) PublishTasks(queueName string, settings []models.TaskSetting) (published int, err error) {
+	return broker.PublishTasksContext(context.Background(), queueName, settings)
+}
+
+// PublishTasksContext publishes the tasks to the queue specified by the given name. The queue will be
+// declared if it doesn't already exist. Publishing stops when the context is done. It returns the number of published
+// tasks. Tasks which fail to be published are skipped.
+func (broker *TaskBroker) PublishTasksContext(ctx context.Context, queueName string, settings []models.TaskSetting) (published int, err error) {
 	logrus.Info(fmt.Sprintf("To schedule %d tests.", len(settings)))
 
-	_, ch, err := broker.QueueDeclare(queueName)
+	ctx, span := tracing.Start(ctx, "publish", trace.WithAttributes(attribute.Int("a01.tasks", len(settings))))
+	defer func() { tracing.End(span, err) }()
+
+	_, ch, err := broker.queueDeclare(ctx, queueName)
 	if err != nil {
 		// TODO: update run's status in DB to failed
-		return fmt.Errorf("fail to decalre queue: %s", err.Error())
+		return 0, fmt.Errorf("fail to decalre queue: %s", err.Error())
 	}
 
 	logrus.Info(fmt.Sprintf("Declared queue %s. Begin publishing tasks ...", queueName))
 	for _, setting := range settings {
+		if ctx.Err() != nil {
+			return published, fmt.Errorf("publishing is canceled: %s", ctx.Err())
+		}
+
 		body, err := json.Marshal(setting)
 		if err != nil {
 			logrus.Warnf("Fail to marshal task %s setting in JSON. Error %s. The task is skipped.", setting, err.Error())
 			continue
 		}
 
+		begin := time.Now()
 		err = ch.Publish(
 			"",        // default exchange
 			queueName, // routing key
@@ -105,31 +227,67 @@ func (broker *TaskBroker) PublishTasks(queueName string, settings []models.TaskS
 			amqp.Publishing{
 				DeliveryMode: amqp.Persistent,
 				ContentType:  "application/json",
+				Headers:      tracing.InjectHeaders(ctx),
 				Body:         body,
 			})
 
+		metrics.ObserveBrokerCallContext(ctx, "publish", begin, err)
+
 		if err != nil {
 			logrus.Warnf("Fail to publish task %s. Error %s. The task is skipped.", setting, err.Error())
+			continue
 		}
+		published++
 	}
 
+	metrics.AddTasksPublishedContext(ctx, published)
 	logrus.Info("Finish publish tasks")
 
-	return nil
+	return published, nil
 }
 
-// Close the channel and connection
+// Close deletes the declared queues and closes the channel and connection
 func (broker *TaskBroker) Close() {
-	for _, queueName := range broker.declaredQueues {
-		broker.channel.QueueDelete(queueName, false, false, true)
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	if broker.channel != nil {
+		for _, queueName := range broker.declaredQueues {
+			broker.channel.QueueDelete(queueName, false, false, true)
+		}
+	}
+
+	broker.disconnect()
+}
+
+// Disconnect closes the channel and connection. The declared queues are kept.
+func (broker *TaskBroker) Disconnect() {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	broker.disconnect()
+}
+
+// dropChannel forgets the given channel, which the broker closes after a failed call, so the next call opens a new one
+func (broker *TaskBroker) dropChannel(ch *amqp.Channel) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	if broker.channel == ch {
+		broker.channel = nil
 	}
+}
 
+// disconnect closes the channel and connection. The caller holds the lock.
+func (broker *TaskBroker) disconnect() {
 	if broker.channel != nil {
-		defer broker.channel.Close()
+		broker.channel.Close()
+		broker.channel = nil
 	}
 
 	if broker.connection != nil {
-		defer broker.connection.Close()
+		broker.connection.Close()
+		broker.connection = nil
 	}
 }
 
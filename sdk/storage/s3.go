@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service        = "s3"
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3DefaultRegion  = "us-east-1"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	headerAmzDate    = "X-Amz-Date"
+	headerAmzContent = "X-Amz-Content-Sha256"
+)
+
+// S3Config defines an S3-compatible object store. The objects are addressed in the path style,
+// <endpoint>/<bucket>/<key>, which is supported by both AWS S3 and MinIO.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Uploader uploads files to an S3-compatible object store
+type S3Uploader struct {
+	config S3Config
+	client *http.Client
+
+	// now returns the time requests are signed at
+	now func() time.Time
+}
+
+// NewS3Uploader returns an uploader of the given object store. A default HTTP client is used if client is nil.
+func NewS3Uploader(config S3Config, client *http.Client) *S3Uploader {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	if len(config.Region) == 0 {
+		config.Region = s3DefaultRegion
+	}
+
+	return &S3Uploader{config: config, client: client, now: time.Now}
+}
+
+// Upload puts the content as the object of the given key
+func (uploader *S3Uploader) Upload(ctx context.Context, key string, content []byte) error {
+	objectURL := fmt.Sprintf("%s/%s/%s",
+		strings.TrimRight(uploader.config.Endpoint, "/"),
+		uploader.config.Bucket,
+		strings.TrimLeft(key, "/"))
+
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("fail to create the request: %s", err.Error())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	uploader.sign(req, content)
+
+	resp, err := uploader.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fail to upload %s: %s", key, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("fail to upload %s: status %d: %s", key, resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 of the request to its Authorization header. The host and all the headers
+// of the request are signed.
+func (uploader *S3Uploader) sign(req *http.Request, payload []byte) {
+	now := uploader.now().UTC()
+	payloadHash := sha256Hex(payload)
+	req.Header.Set(headerAmzDate, now.Format(s3TimeFormat))
+	req.Header.Set(headerAmzContent, payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), uploader.config.Region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+uploader.config.SecretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, uploader.config.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, uploader.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func canonicalURI(u *url.URL) string {
+	p := u.EscapedPath()
+	if len(p) == 0 {
+		return "/"
+	}
+
+	unescaped, err := url.PathUnescape(p)
+	if err != nil {
+		return p
+	}
+
+	segments := strings.Split(unescaped, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes all the characters but the unreserved ones in RFC 3986
+func uriEncode(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
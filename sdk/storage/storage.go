@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Defines the storage backends of the artifacts and the tools volumes
+const (
+	// BackendAzureFile mounts an Azure File share
+	BackendAzureFile = "azurefile"
+
+	// BackendPVC mounts a sub path of a PersistentVolumeClaim
+	BackendPVC = "pvc"
+
+	// BackendHostPath mounts a directory of the node. The artifacts are uploaded to the object store after the run
+	// if one is configured.
+	BackendHostPath = "hostpath"
+
+	// BackendEmptyDir mounts an empty directory. The artifacts are uploaded to the object store after the run.
+	BackendEmptyDir = "emptydir"
+
+	// BackendS3 mounts an empty directory. The droid uploads the artifacts of each task to the object store once the
+	// task is completed, and the other artifacts after the run.
+	BackendS3 = "s3"
+)
+
+// Uploader uploads the artifacts to an object store
+type Uploader interface {
+	Upload(ctx context.Context, key string, content []byte) error
+}
+
+// Config defines where the artifacts and the tools are stored
+type Config struct {
+	Backend   string
+	ClaimName string
+	HostPath  string
+
+	// S3 is the object store the artifacts are uploaded to. It is nil if no object store is configured.
+	S3 *S3Config
+
+	ToolsBackend   string
+	ToolsClaimName string
+	ToolsHostPath  string
+}
+
+// DefaultConfig returns the configuration storing both the artifacts and the tools in Azure File shares
+func DefaultConfig() *Config {
+	return &Config{Backend: BackendAzureFile, ToolsBackend: BackendAzureFile}
+}
+
+// LoadConfig reads the storage configuration from the A01 system config. The backends default to Azure File shares.
+func LoadConfig(ctx context.Context) (*Config, error) {
+	config := DefaultConfig()
+	get := func(key string) string {
+		value, _ := kubeutils.TryGetSystemConfigContext(ctx, key)
+		return strings.TrimSpace(value)
+	}
+
+	if backend := get(common.ConfigKeyStorageBackend); len(backend) > 0 {
+		config.Backend = backend
+	}
+	config.ClaimName = get(common.ConfigKeyStorageClaim)
+	config.HostPath = get(common.ConfigKeyStorageHostPath)
+
+	if endpoint := get(common.ConfigKeyStorageS3Endpoint); len(endpoint) > 0 {
+		config.S3 = &S3Config{
+			Endpoint: endpoint,
+			Bucket:   get(common.ConfigKeyStorageS3Bucket),
+			Region:   get(common.ConfigKeyStorageS3Region),
+		}
+
+		if secretName := get(common.ConfigKeyStorageS3Secret); len(secretName) > 0 {
+			accessKey, _ := kubeutils.TryGetSecretInBytesContext(ctx, secretName, common.StorageSecretKeyAccessKey)
+			secretKey, _ := kubeutils.TryGetSecretInBytesContext(ctx, secretName, common.StorageSecretKeySecretKey)
+			config.S3.AccessKey = string(accessKey)
+			config.S3.SecretKey = string(secretKey)
+		}
+	}
+
+	if backend := get(common.ConfigKeyToolsBackend); len(backend) > 0 {
+		config.ToolsBackend = backend
+	}
+	config.ToolsClaimName = get(common.ConfigKeyToolsClaim)
+	config.ToolsHostPath = get(common.ConfigKeyToolsHostPath)
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validate returns an error if the configuration is incomplete
+func (config *Config) Validate() error {
+	var problems []string
+
+	switch config.Backend {
+	case BackendAzureFile:
+	case BackendPVC:
+		if len(config.ClaimName) == 0 {
+			problems = append(problems, fmt.Sprintf("%s is required by the %s backend", common.ConfigKeyStorageClaim, BackendPVC))
+		}
+	case BackendHostPath:
+		if len(config.HostPath) == 0 {
+			problems = append(problems, fmt.Sprintf("%s is required by the %s backend", common.ConfigKeyStorageHostPath, BackendHostPath))
+		}
+	case BackendEmptyDir, BackendS3:
+		if config.S3 == nil {
+			problems = append(problems, fmt.Sprintf("%s is required by the %s backend", common.ConfigKeyStorageS3Endpoint, config.Backend))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown storage backend %q", config.Backend))
+	}
+
+	if config.S3 != nil && len(config.S3.Bucket) == 0 {
+		problems = append(problems, fmt.Sprintf("%s is required by the object store", common.ConfigKeyStorageS3Bucket))
+	}
+
+	switch config.ToolsBackend {
+	case BackendAzureFile:
+	case BackendPVC:
+		if len(config.ToolsClaimName) == 0 {
+			problems = append(problems, fmt.Sprintf("%s is required by the %s tools backend", common.ConfigKeyToolsClaim, BackendPVC))
+		}
+	case BackendHostPath:
+		if len(config.ToolsHostPath) == 0 {
+			problems = append(problems, fmt.Sprintf("%s is required by the %s tools backend", common.ConfigKeyToolsHostPath, BackendHostPath))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported tools backend %q", config.ToolsBackend))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid storage config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// ArtifactsVolume returns the source and the sub path of the artifacts volume. The share name is the run's storage
+// share. The secret holds the Azure storage account's credential.
+func (config *Config) ArtifactsVolume(shareName string, secretName string) (corev1.VolumeSource, string) {
+	switch config.Backend {
+	case BackendPVC:
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: config.ClaimName},
+		}, shareName
+	case BackendHostPath:
+		hostPathType := corev1.HostPathDirectoryOrCreate
+		return corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: path.Join(config.HostPath, shareName), Type: &hostPathType},
+		}, ""
+	case BackendEmptyDir, BackendS3:
+		return corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}, ""
+	default:
+		return corev1.VolumeSource{
+			AzureFile: &corev1.AzureFileVolumeSource{SecretName: secretName, ShareName: shareName},
+		}, ""
+	}
+}
+
+// ToolsVolume returns the source and the sub path of the volume holding the agents of the given version
+func (config *Config) ToolsVolume(agentVersion string) (corev1.VolumeSource, string) {
+	shareName := fmt.Sprintf("linux-%s", agentVersion)
+
+	switch config.ToolsBackend {
+	case BackendPVC:
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: config.ToolsClaimName, ReadOnly: true},
+		}, shareName
+	case BackendHostPath:
+		hostPathType := corev1.HostPathDirectory
+		return corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: path.Join(config.ToolsHostPath, shareName), Type: &hostPathType},
+		}, ""
+	default:
+		return corev1.VolumeSource{
+			AzureFile: &corev1.AzureFileVolumeSource{SecretName: common.SecretNameAgents, ShareName: shareName},
+		}, ""
+	}
+}
+
+// SharesArtifacts returns true if the artifacts volume is the same for all the pods of a run wherever they run
+func (config *Config) SharesArtifacts() bool {
+	return config.Backend == BackendAzureFile || config.Backend == BackendPVC
+}
+
+// SeparatesPods returns true if each droid pod mounts its own directory of the artifacts volume. The node directory of
+// the hostpath backend is shared by the run's pods on the node, which would upload the artifacts of each other after
+// the run.
+func (config *Config) SeparatesPods() bool {
+	return config.Backend == BackendHostPath
+}
+
+// UploadsEachTask returns true if the droid uploads the artifacts of a task once the task is completed
+func (config *Config) UploadsEachTask() bool {
+	return config.Backend == BackendS3 && config.S3 != nil
+}
+
+// UploadsAfterRun returns true if the droid uploads the artifacts before it exits. The artifacts uploaded after each
+// task are not uploaded again.
+func (config *Config) UploadsAfterRun() bool {
+	switch config.Backend {
+	case BackendS3, BackendEmptyDir, BackendHostPath:
+		return config.S3 != nil
+	default:
+		return false
+	}
+}
+
+// NewUploader returns the uploader of the configured object store, or nil if no object store is configured
+func (config *Config) NewUploader() Uploader {
+	if config.S3 == nil {
+		return nil
+	}
+	return NewS3Uploader(*config.S3, nil)
+}
+
+// UploadFile uploads the file at the relative path under the root. The relative path is the object's key. A missing
+// file is skipped.
+func UploadFile(ctx context.Context, uploader Uploader, root string, relPath string) error {
+	content, err := ioutil.ReadFile(filepath.Join(root, relPath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return uploader.Upload(ctx, filepath.ToSlash(relPath), content)
+}
+
+// UploadDir uploads all the files in the directory under the root. The files' paths relative to the root are the
+// objects' keys. Files and directories for which skip returns true are not uploaded. It returns the number of uploaded
+// files.
+func UploadDir(ctx context.Context, uploader Uploader, root string, dir string, skip func(relPath string) bool) (int, error) {
+	uploaded := 0
+	err := filepath.Walk(filepath.Join(root, dir), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+
+		if skip != nil && skip(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if err := UploadFile(ctx, uploader, root, relPath); err != nil {
+			return err
+		}
+		uploaded++
+		logrus.Debugf("Uploaded %s.", relPath)
+		return nil
+	})
+
+	return uploaded, err
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/httputils"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+)
+
+// defaultPageSize is the number of tasks fetched in one request by ListAllTasks
+const defaultPageSize = 500
+
+// Client is a typed client of the A01 store API
+type Client struct {
+	http *httputils.Client
+}
+
+// NewClient returns a client of the store at the given base URL. The authorization value is sent in the
+// Authorization header of every request. A default HTTP client is used if httpClient is nil.
+func NewClient(baseURL string, authorization string, httpClient *http.Client) *Client {
+	return &Client{http: httputils.NewClient(baseURL, authorization, httpClient)}
+}
+
+// NewClientFromEnv returns a client of the store configured from the environment
+func NewClientFromEnv() *Client {
+	return &Client{http: httputils.NewClientFromEnv()}
+}
+
+// RunListOptions defines the filters of ListRuns. Empty filters are ignored.
+type RunListOptions struct {
+	Product string
+	Status  string
+	Owner   string
+	Remark  string
+
+	// Last limits the result to the latest runs
+	Last int
+}
+
+func (opts RunListOptions) query() string {
+	values := url.Values{}
+	if len(opts.Product) > 0 {
+		values.Set("product", opts.Product)
+	}
+	if len(opts.Status) > 0 {
+		values.Set("status", opts.Status)
+	}
+	if len(opts.Owner) > 0 {
+		values.Set("owner", opts.Owner)
+	}
+	if len(opts.Remark) > 0 {
+		values.Set("remark", opts.Remark)
+	}
+	if opts.Last > 0 {
+		values.Set("last", strconv.Itoa(opts.Last))
+	}
+
+	return values.Encode()
+}
+
+// TaskListOptions defines a page of ListTasks
+type TaskListOptions struct {
+	Skip  int
+	Limit int
+}
+
+func (opts TaskListOptions) query() string {
+	values := url.Values{}
+	if opts.Skip > 0 {
+		values.Set("skip", strconv.Itoa(opts.Skip))
+	}
+	if opts.Limit > 0 {
+		values.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	return values.Encode()
+}
+
+// GetRun returns the run of the given ID
+func (client *Client) GetRun(ctx context.Context, runID int) (*models.Run, error) {
+	return models.QueryRunWithClient(ctx, client.http, runID)
+}
+
+// ListRuns returns the runs matching the given filters
+func (client *Client) ListRuns(ctx context.Context, opts RunListOptions) ([]models.Run, error) {
+	var runs []models.Run
+	if err := client.http.Do(ctx, http.MethodGet, withQuery("runs", opts.query()), nil, &runs); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// CreateRun creates a new run and returns it
+func (client *Client) CreateRun(ctx context.Context, run *models.Run) (*models.Run, error) {
+	var created models.Run
+	if err := client.http.Do(ctx, http.MethodPost, "run", run, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// CreateRunWithKey creates a new run once for the given idempotency key. A retried request with the same key returns
+// the run the first request created.
+func (client *Client) CreateRunWithKey(ctx context.Context, run *models.Run, key string) (*models.Run, error) {
+	req, err := client.http.NewJSONRequest(ctx, http.MethodPost, "run", run)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(httputils.HeaderIdempotencyKey, key)
+
+	var created models.Run
+	if err := client.http.SendJSON(req, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// UpdateRun saves the changes of the run and returns the updated run. If the run has a version, a
+// models.ConflictError is returned when the run was changed in the store after this version.
+func (client *Client) UpdateRun(ctx context.Context, run *models.Run) (*models.Run, error) {
+	return run.SubmitChangeWithClient(ctx, client.http)
+}
+
+// CancelRun sets the status of the run to Canceled. A completed run can't be canceled.
+func (client *Client) CancelRun(ctx context.Context, runID int) (*models.Run, error) {
+	run, err := client.GetRun(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.UpdateRun(ctx, client, run, func(run *models.Run) error {
+		if run.Status == common.RunStatusCompleted {
+			return fmt.Errorf("run %d is already completed", runID)
+		}
+
+		run.Status = common.RunStatusCanceled
+		return nil
+	})
+}
+
+// ListTasks returns a page of the tasks of the given run
+func (client *Client) ListTasks(ctx context.Context, runID int, opts TaskListOptions) ([]models.TaskResult, error) {
+	var tasks []models.TaskResult
+	path := withQuery(fmt.Sprintf("run/%d/tasks", runID), opts.query())
+	if err := client.http.Do(ctx, http.MethodGet, path, nil, &tasks); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// ListAllTasks returns all the tasks of the given run. The tasks are fetched page by page.
+func (client *Client) ListAllTasks(ctx context.Context, runID int) ([]models.TaskResult, error) {
+	var result []models.TaskResult
+	for {
+		page, err := client.ListTasks(ctx, runID, TaskListOptions{Skip: len(result), Limit: defaultPageSize})
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, page...)
+		if len(page) < defaultPageSize {
+			return result, nil
+		}
+	}
+}
+
+// GetTask returns the task of the given ID
+func (client *Client) GetTask(ctx context.Context, taskID int) (*models.TaskResult, error) {
+	var task models.TaskResult
+	if err := client.http.Do(ctx, http.MethodGet, fmt.Sprintf("task/%d", taskID), nil, &task); err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// CreateTask saves an uncommitted task. The task's key is sent as the idempotency key so that a retried request
+// doesn't create a duplicate task.
+func (client *Client) CreateTask(ctx context.Context, task *models.TaskResult) (*models.TaskResult, error) {
+	return task.CommitNewWithClient(ctx, client.http)
+}
+
+// CreateTasks saves a batch of uncommitted tasks of the given run in a single request. The idempotency key of the
+// request is derived from the tasks' keys so a retried batch doesn't create duplicate tasks.
+func (client *Client) CreateTasks(ctx context.Context, runID int, tasks []*models.TaskResult) ([]models.TaskResult, error) {
+	return models.CommitTasksWithClient(ctx, client.http, runID, tasks, models.BatchIdempotencyKey(tasks))
+}
+
+// UpdateTask saves the changes of a committed task and returns the updated task
+func (client *Client) UpdateTask(ctx context.Context, task *models.TaskResult) (*models.TaskResult, error) {
+	return task.CommitChangesWithClient(ctx, client.http)
+}
+
+func withQuery(path string, query string) string {
+	if len(query) == 0 {
+		return path
+	}
+
+	return path + "?" + query
+}
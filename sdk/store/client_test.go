@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/httputils"
+	"github.com/Azure/adx-automation-agent/sdk/models"
+)
+
+// fakeStore serves a run of version "1" and records the headers of the requests it receives by path
+type fakeStore struct {
+	sync.Mutex
+	headers map[string]http.Header
+	tasks   int
+}
+
+func (store *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	store.Lock()
+	defer store.Unlock()
+	store.headers[r.Method+" "+r.URL.Path] = r.Header
+
+	switch r.URL.Path {
+	case "/api/run/42":
+		if r.Method == http.MethodPost && r.Header.Get(httputils.HeaderIfMatch) != "1" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		json.NewEncoder(w).Encode(models.Run{ID: 42, Version: "1"})
+	case "/api/run/42/tasks":
+		if r.Method == http.MethodPost {
+			var tasks []models.TaskResult
+			json.NewDecoder(r.Body).Decode(&tasks)
+			json.NewEncoder(w).Encode(tasks)
+			return
+		}
+
+		skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		var page []models.TaskResult
+		for id := skip + 1; id <= store.tasks && id <= skip+limit; id++ {
+			page = append(page, models.TaskResult{ID: id, RunID: 42})
+		}
+		json.NewEncoder(w).Encode(page)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestClient(t *testing.T, tasks int) (*Client, *fakeStore) {
+	store := &fakeStore{headers: make(map[string]http.Header), tasks: tasks}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	return NewClient(server.URL+"/api", "secret", server.Client()), store
+}
+
+func TestUpdateRun(t *testing.T) {
+	client, store := newTestClient(t, 0)
+
+	run, err := client.GetRun(context.Background(), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.UpdateRun(context.Background(), run); err != nil {
+		t.Fatal(err)
+	}
+	if header := store.headers["POST /api/run/42"]; header.Get("Authorization") != "secret" {
+		t.Errorf("expect the run to be saved with the authorization of the client but found %v", header)
+	}
+
+	run.Version = "0"
+	if _, err := client.UpdateRun(context.Background(), run); !models.IsConflict(err) {
+		t.Errorf("expect a conflict when the run was changed but found %v", err)
+	}
+}
+
+func TestCreateTasks(t *testing.T) {
+	client, store := newTestClient(t, 0)
+
+	tasks := []*models.TaskResult{
+		{RunID: 42, ResultDetails: map[string]interface{}{common.KeyTaskKey: "a"}},
+		{RunID: 42, ResultDetails: map[string]interface{}{common.KeyTaskKey: "b"}},
+	}
+	created, err := client.CreateTasks(context.Background(), 42, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 {
+		t.Errorf("expect 2 tasks created but found %d", len(created))
+	}
+
+	header := store.headers["POST /api/run/42/tasks"]
+	if header.Get(httputils.HeaderIdempotencyKey) != models.BatchIdempotencyKey(tasks) {
+		t.Errorf("expect the batch to be sent with its idempotency key but found %v", header)
+	}
+}
+
+func TestListAllTasks(t *testing.T) {
+	client, _ := newTestClient(t, defaultPageSize+3)
+
+	tasks, err := client.ListAllTasks(context.Background(), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != defaultPageSize+3 || tasks[defaultPageSize].ID != defaultPageSize+1 {
+		t.Errorf("expect all the pages of tasks but found %d tasks", len(tasks))
+	}
+}
@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/Azure/adx-automation-agent/sdk/common"
+	"github.com/Azure/adx-automation-agent/sdk/kubeutils"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/Azure/adx-automation-agent"
+
+const (
+	envOTLPEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envOTLPTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+)
+
+// Well-known span attributes in the A01 system
+const (
+	AttributeRunID   = attribute.Key("a01.run.id")
+	AttributeProduct = attribute.Key("a01.product")
+	AttributeJobName = attribute.Key("a01.job.name")
+	AttributeTask    = attribute.Key("a01.task.identifier")
+	AttributeResult  = attribute.Key("a01.task.result")
+)
+
+// Init configures the global tracer provider to export spans over OTLP/HTTP. The collector endpoint is read from the
+// standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable, or from the A01 system config. If neither is defined,
+// tracing stays disabled. The returned function flushes and stops the exporter.
+func Init(ctx context.Context, serviceName string, attrs ...attribute.KeyValue) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	noop := func(context.Context) error { return nil }
+
+	var options []otlptracehttp.Option
+	if _, ok := os.LookupEnv(envOTLPEndpoint); !ok {
+		if _, ok := os.LookupEnv(envOTLPTracesEndpoint); !ok {
+			endpoint, exists := kubeutils.TryGetSystemConfigContext(ctx, common.ConfigKeyEndpointOTLP)
+			if !exists {
+				logrus.Info("The OTLP endpoint is not configured. Tracing is disabled.")
+				return noop, nil
+			}
+
+			// the collector in the system config is expected to run in the cluster without TLS
+			options = append(options, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+		}
+	}
+
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return noop, err
+	}
+
+	resource, err := sdkresource.Merge(
+		sdkresource.Default(),
+		sdkresource.NewWithAttributes(semconv.SchemaURL, append(attrs, semconv.ServiceNameKey.String(serviceName))...))
+	if err != nil {
+		return noop, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(resource))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span with the A01 tracer
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records the error, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// headerCarrier adapts AMQP message headers to a propagation carrier
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	if v, ok := c[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// InjectHeaders returns AMQP message headers carrying the trace context of ctx
+func InjectHeaders(ctx context.Context) amqp.Table {
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+	return headers
+}
+
+// ExtractHeaders returns a context carrying the trace context in the AMQP message headers
+func ExtractHeaders(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier(headers))
+}